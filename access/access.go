@@ -4,16 +4,26 @@ package access
 // intweb, and HTTP server.
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
-	"github.com/warthog618/gpiod"
 	MQTT "github.com/eclipse/paho.mqtt.golang"
+	"github.com/warthog618/gpiod"
 	
+	"hive13/rfid/cardreader"
+	"hive13/rfid/gpio"
+	"hive13/rfid/gpiofake"
 	"hive13/rfid/intweb"
+	"hive13/rfid/lock"
 	"hive13/rfid/mqtt"
 	"hive13/rfid/sensor"
 	"hive13/rfid/wiegand"
@@ -24,48 +34,214 @@ const (
 	open_door_url = "/open_door"
 	// URL to use for ping:
 	ping_url = "/ping"
+	// URL to use for door status:
+	status_url = "/status"
 	// Form key for badge number:
 	open_door_key_badge = "badge"
 )
 
+// Reader types in Config.Readers:
+const (
+	// Wiegand reader on GPIO pins; options d0 and d1 default to PinD0
+	// and PinD1:
+	ReaderWiegand = "wiegand"
+	// OSDP reader on a serial device; options device, baud, and
+	// address default to OsdpDevice, OsdpBaud, and OsdpAddress:
+	ReaderOSDP = "osdp"
+	// USB keyboard-wedge reader; option device (required) is its
+	// input device, e.g. /dev/input/by-id/usb-foo-event-kbd:
+	ReaderEvdev = "evdev"
+	// Badges as lines of text; option path is a FIFO, a file, or "-"
+	// (the default) for stdin.  See cardreader.Stream.
+	ReaderStream = "stream"
+)
+
+// Values for Config.BadgeEncoding:
+const (
+	// Facility code and card number together as one number, i.e. all
+	// data bits of the Wiegand frame:
+	BadgeCombined = "combined"
+	// Card number alone:
+	BadgeCardOnly = "card"
+	// Facility code and card number as a string, e.g. "123:45678":
+	BadgeFacilityCard = "fc:cn"
+)
+
 type Config struct {
 	// Linux GPIO character device name, without /dev -
 	// e.g. "gpiochip0" for /dev/gpiochip0
 	GpioDev string
+	// Badge readers to listen to, each as a spec like
+	// "wiegand,name=outdoor" or "evdev,name=desk,device=/dev/input/event0"
+	// (see cardreader.Spec, and the Reader* constants for the types
+	// and their options).  If empty, a single Wiegand reader is used.
+	Readers []string
 	// Pin number (input) for Wiegand D0 of the badge reader (as
-	// GPIO/BCM pin):
+	// GPIO/BCM pin), unless a Wiegand reader in Readers gives another:
 	PinD0 int
 	// Pin number (input) for Wiegand D1 of the badge reader (as
-	// GPIO/BCM pin):
+	// GPIO/BCM pin), unless a Wiegand reader in Readers gives another:
 	PinD1 int
+	// Names of Wiegand formats to accept from the badge reader (see
+	// wiegand.FormatNames); if empty, only 26-bit H10301 is accepted:
+	WiegandFormats []string
+	// Longest gap between bits of one Wiegand frame (0 for the
+	// default; see wiegand.Config):
+	WiegandBitGap time.Duration
+	// Time after the last bit before a Wiegand frame is delivered (0
+	// for the default; see wiegand.Config):
+	WiegandFrameTimeout time.Duration
+	// Serial device for OSDP readers, e.g. /dev/ttyUSB0 (unless a
+	// reader in Readers gives another):
+	OsdpDevice string
+	// Baud rate for OSDP readers (0 for the default, 9600):
+	OsdpBaud int
+	// OSDP address of the reader (unless a reader in Readers gives
+	// another):
+	OsdpAddress int
+	// OSDP secure channel key (16 bytes) for all OSDP readers; if nil,
+	// the secure channel is not used:
+	OsdpKey []byte
 	// Pin number (output) for the badge reader's beeper pin (as
-	// GPIO/BCM pin):
+	// GPIO/BCM pin).  Not used with an OSDP reader, which has its own
+	// beeper.
 	PinBeeper int
 	// Pin number (output) for the badge reader's LED pin (as GPIO/BCM
-	// pin):
+	// pin).  Not used with an OSDP reader, which has its own LED.
 	PinLED int
 	// Pin number (output) to control door lock/latch relay (as
 	// GPIO/BCM pin):
 	PinLock int
-	// Time to hold PinLock high before bringing it back low:
+	// How PinLock drives the lock: one of the lock.Mode* constants (if
+	// empty, lock.ModeFailSecure):
+	LockMode string
+	// If true, PinLock is low to energise the lock:
+	LockActiveLow bool
+	// With lock.ModePulse, how long to energise the lock to unlock it
+	// (0 for the default; see lock.Config):
+	LockPulseTime time.Duration
+	// If nonzero, never energise the lock to unlock it for longer than
+	// this (see lock.Config):
+	LockMaxEnergise time.Duration
+	// Pin number (input) for a lock-sense contact, which shows whether
+	// the lock is actually locked; if -1, there is none.  If there is
+	// one, it is checked at startup and shutdown.
+	PinLockSense int
+	// If true: PinLockSense is high when locked.  If false: it is low
+	// when locked.
+	LockSensePolarity bool
+	// Time to hold the lock open before locking it again:
 	LockHoldTime time.Duration
+	// If true, lock again as soon as the door sensor shows the door
+	// opening and then closing again, rather than waiting out the
+	// rest of LockHoldTime (which still applies if the door never
+	// opens).  Needs PinSensor.
+	RelockOnClose bool
+	// With RelockOnClose, the least time to hold the lock open, even
+	// if the door has already opened and closed:
+	LockMinHoldTime time.Duration
+	// If the door sensor shows the door open for longer than this,
+	// raise AlarmHeldOpen until it closes.  (Unlocking the door while
+	// it is open allows it this long again.)  If zero, there is no
+	// such alarm.
+	HeldOpenTime time.Duration
+	// If true, raise AlarmForced when the door sensor shows the door
+	// opening while the lock is closed (i.e. without an unlock).
+	ForcedEntry bool
+	// The door opening this long after the lock closes is still not
+	// forced entry (to allow for slow doors, or for a sensor that
+	// settles later than the lock).
+	ForcedGrace time.Duration
+	// A door that opens while locked only raises AlarmForced if it is
+	// still open this long after, and wasn't unlocked in the meantime
+	// (e.g. by REX).  This allows for a key override or leaving by a
+	// crash bar, where the door closes again soon.
+	ForcedDelay time.Duration
 	// Pin number (input) for door opening sensor; if -1, do not use
 	// door sensor:
 	PinSensor int
 	// If true: PinSensor is high when door is open, low when closed.
 	// If false: PinSensor is low when door is open, high when closed.
 	SensorPolarity bool
-	// URL for intweb, including /api/access
-	IntwebURL string
+	// Time PinSensor must be stable before its state counts (0 for
+	// the default; see sensor.New):
+	SensorSettle time.Duration
+	// Pin number (input) for a request-to-exit (REX) button or motion
+	// sensor inside the door; if -1, there is none.  A press unlocks
+	// the door without asking intweb.
+	PinRex int
+	// If true: PinRex is high when pressed.  If false: PinRex is low
+	// when pressed.
+	RexPolarity bool
+	// Time PinRex must be stable before its state counts (0 for the
+	// default; see sensor.New):
+	RexSettle time.Duration
+	// Time to hold the lock open after a REX press:
+	RexHoldTime time.Duration
+	// URLs for intweb, including /api/access, in order of preference
+	// (see intweb.Session.URLs)
+	IntwebURLs []string
 	// Device name for intweb
 	IntwebDevice string
 	// Device key for intweb
 	IntwebDeviceKey []byte
 	// Item to try to access
 	IntwebItem string
+	// If true, intweb failure replies must be authenticated too (see
+	// intweb.Session.Strict):
+	IntwebStrict bool
+	// Longest time to wait on intweb for one badge (including retries):
+	IntwebTimeout time.Duration
+	// Times to try a request which fails to reach intweb, and the delay
+	// before the first retry (see intweb.RetryPolicy):
+	IntwebAttempts int
+	IntwebRetryDelay time.Duration
+	// Number of requests in a row which fail to reach intweb before it
+	// isn't tried for IntwebBreakerCooldown (see intweb.BreakerPolicy);
+	// 0 to always try it:
+	IntwebBreakerFailures int
+	IntwebBreakerCooldown time.Duration
+	// How a scanned badge is turned to the badge number sent to intweb
+	// (and MQTT); one of BadgeCombined, BadgeCardOnly, or
+	// BadgeFacilityCard.  If empty, BadgeCombined is used.
+	BadgeEncoding string
+	// Facility codes which are allowed; badges with any other facility
+	// code, or with none at all, are denied without asking intweb
+	// (except from readers with facility=skip; see readers.go).  If
+	// empty, any facility code is allowed.
+	FacilityCodes []uint
+	// If non-empty, path to a PIN file (see LoadPins).  This enables
+	// badge-plus-PIN mode: after a badge is scanned, its PIN must be
+	// entered on the reader's keypad (and '#' pressed) within
+	// PinTimeout before intweb is asked.  (The reader's keypad format,
+	// KEY4 or KEY8, must be in WiegandFormats.)
+	PinFile string
+	// Time allowed to enter a PIN after scanning a badge:
+	PinTimeout time.Duration
 	// Length of time to keep a badge in cache for (starting from its
 	// last use):
 	BadgeCacheTime time.Duration
+	// When to hold the door unlocked: weekly windows like "mon-fri
+	// 18:00-22:00", or one-off ranges like "2026-12-24/2026-12-26"
+	// (see schedule.go).  Badges are still checked with intweb, and
+	// logged there, while the door is held unlocked.
+	Schedule []string
+	// Directory for state kept across restarts (e.g. the badge cache,
+	// an "unlock until", or access events not yet reported to intweb);
+	// if empty, nothing is kept:
+	StateDir string
+	// If true, encrypt the badge cache, allowlist, and event queue in
+	// StateDir, with a key derived from IntwebDeviceKey (see state.go):
+	CacheEncrypt bool
+	// Where to sync the offline allowlist from (see allowlist.go):
+	// AllowlistIntweb, "file:" and a path, or an HTTPS URL; if
+	// empty, there is no allowlist.
+	AllowlistSource string
+	// Time between allowlist syncs (0 for DefaultAllowlistInterval):
+	AllowlistInterval time.Duration
+	// If nonzero, the allowlist isn't used once it's been this long
+	// since it was synced:
+	AllowlistMaxAge time.Duration
 	// Address for HTTP server to listen on
 	ListenAddr string
 
@@ -73,6 +249,28 @@ type Config struct {
 
 	// True to log more verbosely (e.g. all HTTP POSTs & replies)
 	Verbose bool
+
+	// If true, never drive the lock, beeper, or LED, but log what
+	// would be done instead.  Everything else (intweb, cache, HTTP,
+	// MQTT) runs as usual.
+	DryRun bool
+	// If true, do a dry run with no GPIO at all: badge scans, key
+	// presses, and the door sensor are simulated by commands on stdin.
+	// (Implies DryRun.  Any OSDP reader is ignored.)
+	Simulate bool
+}
+
+// Redacted returns a copy of the configuration without its secrets,
+// e.g. to log it: the OSDP and intweb keys are left out (nil), and the
+// MQTT password is replaced.
+func (cfg *Config) Redacted() *Config {
+	c := *cfg
+	c.OsdpKey = nil
+	c.IntwebDeviceKey = nil
+	if c.Mqtt.Password != "" {
+		c.Mqtt.Password = "redacted"
+	}
+	return &c
 }
 
 // Some state/context for various pieces:
@@ -85,24 +283,59 @@ type ServerCtx struct {
 	// MQTT client (or nil if no broker was given):
 	MqttClient MQTT.Client
 	
-	// Initialized pin to control door latch:
-	Lock *gpiod.Line
+	// Initialized door lock/latch:
+	Lock *lock.Lock
 	
 	// Initialized pin to control beeper (active-low):
-	Beep *gpiod.Line
+	Beep gpio.OutputLine
+
+	// Initialized pin to control LED (active-low):
+	LED gpio.OutputLine
+
+	// If non-nil, door sensor (see SensorPolarity):
+	Sensor *sensor.Sensor
 
-	// If non-nil, initialized pin for door sensor (see
-	// SensorPolarity):
-	Sensor *gpiod.Line
+	// If non-nil, request-to-exit input (see RexPolarity):
+	Rex *sensor.Sensor
 	
 	// Timer which, upon expiration, will trigger the door latch being
-	// locked again.  Upon every lock, this should have .Stop() and
-	// .Reset() called.
+	// locked again.  Upon every unlock, this should have .Stop() and
+	// .Reset() called (under ctx.door.mu, as the door sensor may also
+	// reset it - see relock_after).
 	ReLockTimer *time.Timer
 
 	// Cached badges. Key = badge number, value = time at which to
 	// expire this badge.
-	Cache map[uint64]time.Time
+	Cache map[intweb.Badge]time.Time
+	// True if Cache has changed since it was saved (see save_cache):
+	cache_dirty bool
+
+	// Parsed Config.Schedule (nil if none):
+	schedule *schedule
+	// End of an "unlock until" (zero if none):
+	hold_until time.Time
+
+	// Offline allowlist (nil if there's no AllowlistSource):
+	allowlist *allowlist
+	// Access events not yet reported to intweb:
+	events *eventQueue
+	// intweb session (for /status):
+	session *intweb.Session
+
+	// Background goroutines that Run waits on when shutting down:
+	running sync.WaitGroup
+
+	// Door state and alarms (see door.go):
+	door doorState
+
+	// PIN hashes, by badge (only in badge-plus-PIN mode - see
+	// Config.PinFile):
+	Pins map[intweb.Badge]string
+	// Keys entered so far on the keypad:
+	pin_entry wiegand.PinEntry
+	// Badge waiting on a PIN ("" if none), and when it stops waiting:
+	pin_badge intweb.Badge
+	pin_deadline time.Time
 }
 
 type HttpRequest interface {
@@ -128,7 +361,7 @@ func (a AsyncReply) SendReply(err error) {
 type HttpOpenRequest struct {
 	AsyncReply
 	// The badge number 
-	Badge uint64
+	Badge intweb.Badge
 }
 
 // HttpPing is a ping or pulse-check message received via HTTP.
@@ -147,47 +380,214 @@ func (a AccessDeniedError) Error() string {
 	return a.Msg
 }
 
+// Run runs the access server until it receives SIGTERM or SIGINT, and
+// then shuts it down cleanly: the lock is closed, the HTTP server is
+// stopped, MQTT is disconnected, and the beeper and LED are turned
+// off.
 func Run(cfg *Config) {
+	var err error
+
+	// Everything started from here stops when this is cancelled:
+	run_ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+
+	var chip gpio.Chip
+	var fake_chip *gpiofake.Chip
+	if cfg.Simulate {
+		log.Printf("Simulating all GPIO")
+		cfg.DryRun = true
+		fake_chip = gpiofake.NewChip()
+		chip = fake_chip
+	} else {
+		chip, err = gpio.NewChip(cfg.GpioDev)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	defer chip.Close()
+
+	formats := make([]wiegand.Format, len(cfg.WiegandFormats))
+	for i, name := range cfg.WiegandFormats {
+		f, err := wiegand.LookupFormat(name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		formats[i] = f
+	}
+
+	var sched *schedule
+	if len(cfg.Schedule) > 0 {
+		sched, err = parse_schedule(cfg.Schedule)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.StateDir != "" {
+		// This holds the badge cache, so only we should read it:
+		if err := os.MkdirAll(cfg.StateDir, 0700); err != nil {
+			log.Printf("Can't create state directory, so nothing will be kept across restarts: %s", err)
+		} else if fi, err := os.Stat(cfg.StateDir); err == nil && fi.Mode().Perm() & 0077 != 0 {
+			log.Printf("WARNING: State directory %s can be read by other users (mode %#o); it should be 0700",
+				cfg.StateDir, fi.Mode().Perm())
+		}
+	}
 
-	chip, err := gpiod.NewChip(cfg.GpioDev)
+	switch cfg.BadgeEncoding {
+	case "":
+		cfg.BadgeEncoding = BadgeCombined
+	case BadgeCombined, BadgeCardOnly, BadgeFacilityCard:
+	default:
+		log.Fatalf("Unknown badge encoding %q", cfg.BadgeEncoding)
+	}
+
+	// Tamper reports from OSDP readers are sent over this:
+	tampers := make(chan tamperEvent)
+	readers, err := open_readers(run_ctx, cfg, chip, formats, tampers)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer chip.Close()
+
+	// In a dry run, outputs only log what they would do.  Otherwise,
+	// the beeper and LED are driven on GPIO pins (if any reader is
+	// Wiegand, or if no reader has its own), and on any OSDP readers:
+	request_output := func(offset int, value int, dry *logOutput,
+		use_pin bool, reader_lines []gpio.OutputLine) (gpio.OutputLine, error) {
+
+		if cfg.DryRun {
+			dry.verbose = cfg.Verbose
+			dry.value = value
+			return dry, nil
+		}
+		lines := teeOutput(reader_lines)
+		for _, l := range lines {
+			l.SetValue(value)
+		}
+		if use_pin {
+			l, err := chip.RequestOutput(offset, value)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, l)
+		}
+		if len(lines) == 1 {
+			return lines[0], nil
+		}
+		return lines, nil
+	}
+	use_pins := readers.wiegand || len(readers.osdp) == 0
+	var reader_beeps, reader_leds []gpio.OutputLine
+	for _, r := range readers.osdp {
+		reader_beeps = append(reader_beeps, r.Beeper())
+		reader_leds = append(reader_leds, r.LED())
+	}
+	if cfg.DryRun {
+		log.Printf("Dry run: lock, beeper, and LED will not be driven")
+	}
 	
-	beep_pin, err := chip.RequestLine(cfg.PinBeeper, gpiod.AsOutput(1))
+	beep_pin, err := request_output(cfg.PinBeeper, 1, &logOutput{
+		on_msg: "beeper on", off_msg: "beeper off", active_low: true},
+		use_pins, reader_beeps)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer beep_pin.SetValue(1) // it's active-low
-	defer beep_pin.Close()
+	defer func() {
+		beep_pin.SetValue(1) // it's active-low
+		beep_pin.Close()
+	}()
 	
-	led_pin, err := chip.RequestLine(cfg.PinLED, gpiod.AsOutput(1))
+	led_pin, err := request_output(cfg.PinLED, 1, &logOutput{
+		on_msg: "LED on", off_msg: "LED off", active_low: true, quiet: true},
+		use_pins, reader_leds)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer led_pin.SetValue(1) // it's active-low
-	defer led_pin.Close()
+	defer func() {
+		led_pin.SetValue(1) // it's active-low
+		led_pin.Close()
+	}()
 	
-	lock_pin, err := chip.RequestLine(cfg.PinLock, gpiod.AsOutput(0))
+	lock_cfg := lock.Config{
+		Mode: cfg.LockMode,
+		ActiveLow: cfg.LockActiveLow,
+		PulseTime: cfg.LockPulseTime,
+		MaxEnergise: cfg.LockMaxEnergise,
+	}
+	if cfg.LockSensePolarity {
+		lock_cfg.SenseLocked = 1
+	}
+	if err := lock_cfg.Check(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Lock: %s", lock_cfg.Describe())
+	if lock_cfg.Mode == lock.ModePulse || lock_cfg.MaxEnergise > 0 {
+		log.Printf("Warning: This lock can't be held unlocked for long (for a schedule or an unlock-until)")
+	}
+	lock_off_msg := "door would lock now"
+	if lock_cfg.Mode == lock.ModePulse {
+		lock_off_msg = "lock pulse would end now"
+	}
+	lock_pin, err := request_output(cfg.PinLock, lock_cfg.LockedLevel(), &logOutput{
+		on_msg: "door would open now", off_msg: lock_off_msg,
+		active_low: lock_cfg.UnlockedLevel() == 0},
+		true, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer lock_pin.SetValue(0) // make sure lock isn't open when we quit
-	defer lock_pin.Close()
-	var sensor_pin *gpiod.Line = nil
+	var lock_sense gpio.InputLine
+	if cfg.PinLockSense >= 0 {
+		if fake_chip != nil {
+			// Pretend the lock works:
+			fake_chip.Input(cfg.PinLockSense).Set(lock_cfg.SenseLocked)
+		}
+		lock_sense, err = chip.RequestInput(cfg.PinLockSense, gpiod.LineEdgeNone, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	door_lock, err := lock.New(lock_pin, lock_sense, lock_cfg)
+	if err != nil {
+		lock_pin.Close()
+		if lock_sense != nil {
+			lock_sense.Close()
+		}
+		log.Fatalf("Lock check failed at startup: %s", err)
+	}
+	// Make sure lock isn't open when we quit (normally, this was
+	// already done when shutting down):
+	defer door_lock.Close()
+	if cfg.RelockOnClose && cfg.PinSensor < 0 {
+		log.Fatal("Relocking on door close needs a door sensor")
+	}
+	var door_sensor *sensor.Sensor
 	if cfg.PinSensor >= 0 {
-		p, err := chip.RequestLine(cfg.PinSensor, gpiod.AsInput)
+		door_sensor, err = sensor.New(chip, cfg.PinSensor, cfg.SensorSettle)
 		if err != nil {
 			log.Fatal(err)
 		}
-		sensor_pin = p
 	}
 	// TODO: Check this
 	// sensor_pin.PullUp()
+	var rex_sensor *sensor.Sensor
+	if cfg.PinRex >= 0 {
+		if fake_chip != nil {
+			// Start out not pressed:
+			value := 0
+			if !cfg.RexPolarity {
+				value = 1
+			}
+			fake_chip.Input(cfg.PinRex).Set(value)
+		}
+		rex_sensor, err = sensor.New(chip, cfg.PinRex, cfg.RexSettle)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
 
 	// Initial beep/blink (useful for a quick startup signal):
-	go func(beep_pin *gpiod.Line, led_pin *gpiod.Line) {
+	go func(beep_pin gpio.OutputLine, led_pin gpio.OutputLine) {
 		for x := 0; x < 5; x++ {
 			beep_pin.SetValue(x % 2)
 			led_pin.SetValue(x % 2)
@@ -198,91 +598,165 @@ func Run(cfg *Config) {
 	}(beep_pin, led_pin)
 
 	log.Printf("Listening for badges...")
-	badges, err := wiegand.ListenBadges(chip, cfg.PinD0, cfg.PinD1)
-	if err != nil {
-		log.Fatal(err)
-	}
+	reader_list := readers.list
 
 	s := intweb.Session{
 		Device: cfg.IntwebDevice,
 		DeviceKey: cfg.IntwebDeviceKey,
-		URL: cfg.IntwebURL,
+		URLs: cfg.IntwebURLs,
 		Verbose: cfg.Verbose,
+		Strict: cfg.IntwebStrict,
 		Client: &http.Client{
 			// Avoid transient network issues blocking forever:
-			Timeout: 15 * time.Second,
+			Timeout: cfg.IntwebTimeout,
+		},
+		Retry: intweb.RetryPolicy{
+			Attempts: cfg.IntwebAttempts,
+			Delay: cfg.IntwebRetryDelay,
+		},
+		Breaker: intweb.BreakerPolicy{
+			Failures: cfg.IntwebBreakerFailures,
+			Cooldown: cfg.IntwebBreakerCooldown,
 		},
 	}
 	log.Printf("Using intweb device: %s", s.Device)
-	log.Printf("Using URL: %s", s.URL)
+	if len(s.URLs) == 0 {
+		log.Fatal("No intweb URL given")
+	}
+	log.Printf("Using URLs: %s", strings.Join(s.URLs, ", "))
 
 	http_rqs := make(chan HttpRequest)
 
-	// Set up re-lock timer:
-	relock := time.AfterFunc(cfg.LockHoldTime, func() {
-		if cfg.Verbose {
-			log.Printf("Closing lock.")
-		}
-		lock_pin.SetValue(0)
-	})
-	// We don't want it to trigger yet:
-	relock.Stop()
-	// We'll call .Stop() & .Reset() every time we unlock.  This way,
-	// it's always the *last* unlock that sets the delay, and repeated
-	// unlocks inside that delay don't trigger repeated re-locks.
-
 	ctx := ServerCtx{
 		Config: cfg,
 		HttpReqs: http_rqs,
 		MqttClient: nil, // add in later
-		Lock: lock_pin,
+		Lock: door_lock,
 		Beep: beep_pin,
-		Sensor: sensor_pin,
-		ReLockTimer: relock,
-		Cache: make(map[uint64]time.Time),
+		LED: led_pin,
+		Sensor: door_sensor,
+		Rex: rex_sensor,
+		schedule: sched,
+		session: &s,
 	}
+	ctx.Cache = ctx.load_cache()
 
-	// If there is a door sensor, then start a goroutine to monitor it
-	// in the background:
-	if ctx.Sensor != nil {
-		err := ctx.monitor_door()
+	// Set up re-lock timer:
+	ctx.ReLockTimer = time.AfterFunc(cfg.LockHoldTime, ctx.relock)
+	// We don't want it to trigger yet:
+	ctx.ReLockTimer.Stop()
+	// We'll call .Stop() & .Reset() every time we unlock (see
+	// relock_after).  This way, it's always the *last* unlock that sets
+	// the delay, and repeated unlocks inside that delay don't trigger
+	// repeated re-locks.
+
+	// Replay any access events that intweb missed:
+	ctx.events = ctx.load_events()
+	ctx.running.Add(1)
+	go ctx.replay_events(run_ctx, &s)
+
+	if cfg.AllowlistSource != "" {
+		fetcher, err := new_fetcher(cfg, &s)
 		if err != nil {
 			log.Fatal(err)
 		}
+		if cfg.AllowlistInterval < 0 {
+			log.Fatal("Allowlist interval can't be negative")
+		}
+		if cfg.AllowlistInterval == 0 {
+			cfg.AllowlistInterval = DefaultAllowlistInterval
+		}
+		ctx.allowlist = ctx.load_allowlist()
+		ctx.running.Add(1)
+		go ctx.sync_allowlist(run_ctx, fetcher)
+	}
+
+	if cfg.PinFile != "" {
+		pins, err := LoadPins(cfg.PinFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Badge-plus-PIN mode: loaded PINs for %d badges", len(pins))
+		ctx.Pins = pins
 	}
 
+	if fake_chip != nil {
+		reader_list = append(reader_list,
+			cardreader.New("simulated", func(run_ctx context.Context) <-chan wiegand.BadgeRead {
+				return ctx.simulate_stdin(run_ctx, fake_chip)
+			}))
+	}
+	badges := cardreader.ListenAll(run_ctx, reader_list)
+
 	// If an MQTT broker address was given, try to connect. (This is
 	// done async and it may fail; it will try in the background to
 	// reconnect.)
 	if cfg.Mqtt.BrokerAddr != "" {
-		ctx.MqttClient = mqtt.NewClient(cfg.Mqtt)
+		mqtt_cfg := cfg.Mqtt
+		mqtt_cfg.OnCommand = ctx.mqtt_command
+		ctx.MqttClient = mqtt.NewClient(mqtt_cfg)
 	}
 	
+	// If there is a door sensor, then start a goroutine to monitor it
+	// in the background:
+	if ctx.Sensor != nil {
+		err := ctx.monitor_door(run_ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Likewise for the REX input (if there isn't one, this stays nil,
+	// and so never receives):
+	var rex_presses <-chan struct{}
+	if ctx.Rex != nil {
+		rex_presses = ctx.monitor_rex(run_ctx)
+	}
+
 	// Start HTTP server and supply some state:
 	http.HandleFunc(open_door_url, ctx.http_open_door_handler)
 	http.HandleFunc(ping_url,      ctx.http_ping_handler)
+	http.HandleFunc(status_url,    ctx.http_status_handler)
+	http.HandleFunc(unlock_until_url, ctx.http_unlock_until_handler)
+	srv := &http.Server{
+		Addr: cfg.ListenAddr,
+		ReadTimeout: 20 * time.Second,
+		WriteTimeout: 20 * time.Second,
+	}
 	go func() {
-		srv := &http.Server{
-			Addr: cfg.ListenAddr,
-			ReadTimeout: 20 * time.Second,
-			WriteTimeout: 20 * time.Second,
-		}
 		log.Printf("Starting HTTP server on %s...", cfg.ListenAddr)
-		log.Fatal(srv.ListenAndServe())
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
 	}()
 
-	cache_expire := make(chan uint64)
+	cache_expire := make(chan intweb.Badge)
+
+	// Resume any "unlock until" from before a restart, and then check
+	// the schedule (and when that ends) every so often:
+	ctx.hold_until = ctx.load_hold()
+	ctx.update_hold(time.Now())
+	hold_ticker := time.NewTicker(5 * time.Second)
+	defer hold_ticker.Stop()
 	
-	// We now have two channels that receive request to open the door:
-	// 'badges' for badge scans, 'http_rqs' for HTTP requests.
-	// Monitor both. They intentionally block each other.
+	// We now have three channels that receive request to open the door:
+	// 'badges' for badge scans, 'http_rqs' for HTTP requests, and
+	// 'rex_presses' for the REX input.  Monitor all of them. They
+	// intentionally block each other.
 	log.Printf("Starting main loop...")
+main_loop:
 	for {
 		select {
+		// Signal to shut down:
+		case sig := <-sigs:
+			log.Printf("Main loop: Received %s, shutting down", sig)
+			break main_loop
+
 		// Badge scan:
 		case v := <-badges:
-			if cfg.Verbose {
-				log.Printf("Main loop: Scanned badge: %+v", v)
+			// (Key presses aren't logged, as they may be PINs.)
+			if cfg.Verbose && v.Key == 0 {
+				log.Printf("Main loop: Scanned badge on %s: %+v", v.Source, v.BadgeRead)
 			}
 
 			if !v.LengthOK {
@@ -298,29 +772,64 @@ func Run(cfg *Config) {
 				break
 			}
 
-			badge := v.Value
-			log.Printf("Main loop: Scanned badge %d (bits OK, checksum OK)", badge)
+			// Key press from a keypad:
+			if v.Key != 0 {
+				ctx.handle_key(run_ctx, &s, v.Key, cache_expire)
+				break
+			}
+
+			badge := ctx.badge_id(v.BadgeRead)
+			log.Printf("Main loop: Scanned badge %s on %s (format %s, facility %d, card %d, bits OK, checksum OK)",
+				badge, v.Source, v.Format, v.FacilityCode, v.CardNumber)
 
 			// Publish badge scan to MQTT if we can:
 			if ctx.MqttClient != nil {
-				b_str := fmt.Sprintf("%d", badge)
-				ctx.MqttClient.Publish(cfg.Mqtt.TopicBadge, 0, false, b_str)
+				ctx.MqttClient.Publish(cfg.Mqtt.TopicBadge, 0, false, string(badge))
 			}
 
-			_, err := ctx.handle_badge(&s, badge, cache_expire)
+			if !readers.skip_facility[v.Source] && !ctx.facility_ok(v.BadgeRead) {
+				why := fmt.Sprintf("facility code %d not allowed", v.FacilityCode)
+				if v.NoFacilityCode {
+					why = "reader gave no facility code"
+				}
+				ctx.handle_access(false, badge, why)
+				break
+			}
+
+			// In badge-plus-PIN mode, we need the PIN first:
+			if ctx.Pins != nil {
+				ctx.await_pin(badge)
+				break
+			}
+
+			_, err := ctx.handle_badge(run_ctx, &s, badge, cache_expire)
 			if err != nil {
 				log.Printf("%+v", err)
 			}
 
+		// Request to exit:
+		case <-rex_presses:
+			ctx.handle_rex()
+
 		// Incoming HTTP request:
 		case r := <-http_rqs:
 			switch rq := r.(type) {
 			case HttpOpenRequest:
 				badge := rq.Badge
 
-				log.Printf("Main loop: HTTP request for badge %+v", badge)
+				log.Printf("Main loop: HTTP request for badge %s", badge)
 
-				_, err := ctx.handle_badge(&s, badge, cache_expire)
+				_, err := ctx.handle_badge(run_ctx, &s, badge, cache_expire)
+				rq.SendReply(err)
+			case HoldRequest:
+				log.Printf("Main loop: Unlock-until request for badge %s", rq.Badge)
+
+				// The badge has to be allowed (which also opens the
+				// door, like any other badge):
+				access, err := ctx.handle_badge(run_ctx, &s, rq.Badge, cache_expire)
+				if err == nil && access {
+					ctx.set_hold_until(rq.Until)
+				}
 				rq.SendReply(err)
 			case HttpPing:
 				if cfg.Verbose {
@@ -329,34 +838,125 @@ func Run(cfg *Config) {
 				rq.SendReply(nil)
 			}
 
-		// While idle, blink LED and scrub cache if needed:
+		// Start or stop holding the door unlocked, and save the
+		// cache if it has changed:
+		case now := <-hold_ticker.C:
+			ctx.update_hold(now)
+			ctx.save_cache()
+			ctx.flush_events()
+
+		// While idle, blink LED (unless an alarm is flashing it, or it
+		// is on steadily as the door is held unlocked) and scrub cache
+		// if needed:
 		case <-time.After(1000 * time.Millisecond):
 			ctx.scrub_cache()
+			ctx.expire_pin()
+			if ctx.alarm_active() {
+				break
+			}
+			if ctx.held_unlocked() {
+				led_pin.SetValue(0)
+				break
+			}
 			go func() {
 				led_pin.SetValue(0)
 				<-time.After(50 * time.Millisecond)
 				led_pin.SetValue(1)
 			}()
 			
+		// Tamper switch on an OSDP reader:
+		case t := <-tampers:
+			status := "normal"
+			if t.tamper {
+				status = "tamper"
+				log.Printf("Main loop: Badge reader %s reports tampering!", t.source)
+			} else {
+				log.Printf("Main loop: Badge reader %s tamper cleared", t.source)
+			}
+			if ctx.MqttClient != nil && cfg.Mqtt.TopicTamper != "" {
+				ctx.MqttClient.Publish(cfg.Mqtt.TopicTamper, 0, false, status)
+			}
+
 		// Expire cache entries from background requests as-needed:
 		case badge := <-cache_expire:
 			log.Printf("Main loop: Removed badge %+v from cache (denied access in background)", badge)
 			delete(ctx.Cache, badge)
+			ctx.cache_dirty = true
 		}
 	}
+
+	// Lock the door first, as that matters most:
+	ctx.door_shutdown()
+	if err := door_lock.Close(); err != nil {
+		log.Printf("WARNING: Door may be left unlocked! %s", err)
+	}
+
+	shutdown_ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdown_ctx); err != nil {
+		log.Printf("Error stopping HTTP server: %s", err)
+	}
+
+	if ctx.MqttClient != nil {
+		ctx.MqttClient.Disconnect(250)
+	}
+
+	ctx.save_cache()
+
+	// Stop the badge reader and door sensor, and wait for them to
+	// release their lines:
+	stop()
+	for range badges {
+	}
+	ctx.running.Wait()
+	// (After replaying stops, so that nothing changes it meanwhile.)
+	ctx.flush_events()
+
+	log.Printf("Shut down")
+	// (Deferred calls turn off the beeper & LED, and close all lines.)
 }
 
-// Monitor the door sensor for activity.  (Mostly a placeholder
-// function so far.)
-func (ctx *ServerCtx) monitor_door() error {
-	log.Printf("Started monitor_door() goroutine")
-	settle := 300 * time.Millisecond
-	sensor_chan, err := sensor.ListenSensor(ctx.Sensor, settle)
-	if err != nil {
-		return err
+// badge_id turns a scanned badge to the badge number for intweb,
+// according to BadgeEncoding.
+func (ctx *ServerCtx) badge_id(b wiegand.BadgeRead) intweb.Badge {
+	switch ctx.BadgeEncoding {
+	case BadgeCardOnly:
+		return intweb.BadgeNumber(b.CardNumber)
+	case BadgeFacilityCard:
+		return intweb.Badge(fmt.Sprintf("%d:%d", b.FacilityCode, b.CardNumber))
+	default:
+		return intweb.BadgeNumber(b.Value)
+	}
+}
+
+// facility_ok returns true if the badge's facility code is allowed by
+// FacilityCodes.  A badge with no facility code at all (see
+// wiegand.BadgeRead.NoFacilityCode) is only allowed if any facility
+// code is.
+func (ctx *ServerCtx) facility_ok(br wiegand.BadgeRead) bool {
+	if len(ctx.FacilityCodes) == 0 {
+		return true
+	}
+	if br.NoFacilityCode {
+		return false
+	}
+	for _, allowed := range ctx.FacilityCodes {
+		if uint64(allowed) == br.FacilityCode {
+			return true
+		}
 	}
+	return false
+}
+
+// Monitor the door sensor for activity: log and publish every change,
+// and keep track of the door's state for alarms (see door.go).
+func (ctx *ServerCtx) monitor_door(run_ctx context.Context) error {
+	log.Printf("Started monitor_door() goroutine")
+	sensor_chan := ctx.Sensor.Listen(run_ctx)
 
+	ctx.running.Add(1)
 	go func (sensor_chan <-chan bool) {
+		defer ctx.running.Done()
 		for s := range sensor_chan {
 			status := ""
 			if ctx.SensorPolarity == s {
@@ -370,12 +970,48 @@ func (ctx *ServerCtx) monitor_door() error {
 			if ctx.MqttClient != nil {
 				ctx.MqttClient.Publish(ctx.Mqtt.TopicSensor, 0, false, status)
 			}
+
+			ctx.door_changed(ctx.SensorPolarity == s)
 		}
 	}(sensor_chan)
 
 	return nil
 }
 
+// monitor_rex watches the REX input, and returns a channel which
+// receives every time it is pressed (but not for its state at
+// startup, even if that is pressed).
+func (ctx *ServerCtx) monitor_rex(run_ctx context.Context) <-chan struct{} {
+	presses := make(chan struct{})
+	rex_chan := ctx.Rex.Listen(run_ctx)
+
+	ctx.running.Add(1)
+	go func() {
+		defer ctx.running.Done()
+		first := true
+		for s := range rex_chan {
+			pressed := ctx.RexPolarity == s
+			if first {
+				first = false
+				if pressed {
+					log.Printf("monitor_rex(): REX is pressed at startup, ignoring")
+				}
+				continue
+			}
+			if !pressed {
+				continue
+			}
+			select {
+			case presses <- struct{}{}:
+			case <-run_ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return presses
+}
+
 // Handle door-open request (whether from badge reader or from HTTP).
 //
 // This returns: (access allowed, error).
@@ -389,29 +1025,33 @@ func (ctx *ServerCtx) monitor_door() error {
 // If access is true, but the badge was cached, then a goroutine is
 // started which checks the badge with intweb in the background.  If
 // access for this badge is denied, the badge is sent over
-// 'cache_expire'. (The point of this is so the main loop can safely
-// clear a badge entry out of the cache if it was denied access.)
+// 'cache_expire' (unless 'run_ctx' is cancelled first). (The point of
+// this is so the main loop can safely clear a badge entry out of the
+// cache if it was denied access.)
+//
+// If intweb never saw the access request, the scan is queued to report
+// later (see events.go).  If it may have seen it (see
+// intweb.IsMaybeDelivered), it isn't, so that intweb doesn't log it
+// twice.
 //
 // Cache is always updated if there is no error. A badge that is
 // granted access always has its cache expiration updated. A badge
 // that is denied access always has its cache entry removed.
-func (ctx *ServerCtx) handle_badge(s *intweb.Session, badge uint64,
-	cache_expire chan<- uint64) (bool, error) {
+func (ctx *ServerCtx) handle_badge(run_ctx context.Context, s *intweb.Session,
+	badge intweb.Badge, cache_expire chan<- intweb.Badge) (bool, error) {
 
 	access := false
 	var why string
 	var err error
+	// Time of the scan (in case it has to be reported later):
+	now := time.Now()
 
 	check_intweb := func() (bool, string, error) {
-		nonce, err := s.GetNonce()
+		req_ctx, cancel := context.WithTimeout(context.Background(), ctx.IntwebTimeout)
+		defer cancel()
+		access, why, err := s.AccessContext(req_ctx, ctx.IntwebItem, badge)
 		if err != nil {
-			log.Printf("handle_badge: Failed to get nonce, %s", err)
-			return false, "", err
-		}
-
-		access, why, err = s.Access(nonce, ctx.IntwebItem, badge)
-		if err != nil {
-			log.Printf("handle_badge: Access request failed, %s", err)
+			log_intweb_error("handle_badge: Access request failed", err)
 			return false, "", err
 		}
 
@@ -425,15 +1065,38 @@ func (ctx *ServerCtx) handle_badge(s *intweb.Session, badge uint64,
 		// background:
 		log.Printf("handle_badge: Badge %+v is in cache", badge)
 		access = true
+		ctx.running.Add(1)
 		go func() {
+			defer ctx.running.Done()
 			acc2, _, err2 := check_intweb()
-			if err2 == nil && !acc2 {
-				cache_expire <- badge
+			if unreported(err2) {
+				ctx.queue_event(badge, now)
+			} else if err2 == nil && !acc2 {
+				select {
+				case cache_expire <- badge:
+				case <-run_ctx.Done():
+				}
 			}
 		}()
 	} else {
 		// If it wasn't in the cache, then check intweb now:
 		if access, why, err = check_intweb(); err != nil {
+			if unreported(err) {
+				ctx.queue_event(badge, now)
+			}
+
+			// If intweb is unreachable, the allowlist may decide (but
+			// that isn't cached):
+			if allowed, ok := ctx.check_allowlist(badge, err); ok {
+				err = nil
+				if !allowed {
+					why = "not in offline allowlist"
+					err = AccessDeniedError{ why }
+				}
+				ctx.handle_access(allowed, badge, why)
+				return allowed, err
+			}
+
 			// Beep 3 times to indicate an error that prevented even
 			// checking access:
 			go func() {
@@ -450,6 +1113,7 @@ func (ctx *ServerCtx) handle_badge(s *intweb.Session, badge uint64,
 	}
 
 	ctx.Cache[badge] = time.Now().Add(ctx.BadgeCacheTime)
+	ctx.cache_dirty = true
 
 	if !access {
 		log.Printf("handle_badge: Removed badge %+v from cache (denied access)",
@@ -463,6 +1127,18 @@ func (ctx *ServerCtx) handle_badge(s *intweb.Session, badge uint64,
 	return access, err
 }
 
+// log_intweb_error logs an error from an intweb request - loudly if the
+// response failed authentication, since then something may be
+// pretending to be intweb.
+func log_intweb_error(what string, err error) {
+	if intweb.IsAuthError(err) {
+		log.Printf("*** SECURITY: %s, %s ***", what, err)
+		log.Printf("*** Something may be impersonating intweb at this address! ***")
+		return
+	}
+	log.Printf("%s, %s", what, err)
+}
+
 // Sends a request to the main loop, waits for a response, and sends it.
 //
 // This call incorporates timeouts, such that if the main loop is
@@ -532,9 +1208,9 @@ func (ctx *ServerCtx) http_open_door_handler(w http.ResponseWriter,
 		return
 	}
 	
-	badge, err := strconv.ParseUint(badges[0], 10, 0)
-	if err != nil {
-		errstr := fmt.Sprintf("Error parsing badge: %s", err)
+	badge := intweb.Badge(strings.TrimSpace(badges[0]))
+	if badge == "" {
+		errstr := fmt.Sprintf("Form key '%s' is empty", open_door_key_badge)
 		log.Printf("%s: %s", r.URL, errstr)
 		http.Error(w, errstr, http.StatusBadRequest)
 		return
@@ -548,11 +1224,42 @@ func (ctx *ServerCtx) http_open_door_handler(w http.ResponseWriter,
 		},
 		Badge: badge,
 	}
-	log.Printf("%s: Got badge %d, sending request to main loop...",
+	log.Printf("%s: Got badge %s, sending request to main loop...",
 		r.URL, badge)
 	ctx.request_to_main_loop(rq, err_ch, w, r)
 }
 
+// Status is everything returned by /status.
+type Status struct {
+	DoorStatus
+	// Offline allowlist (if there is one):
+	Allowlist *AllowlistStatus `json:"allowlist,omitempty"`
+	// Number of access events not yet reported to intweb:
+	QueuedEvents int `json:"queued_events"`
+	// State of each intweb URL:
+	Intweb []intweb.EndpointStatus `json:"intweb"`
+}
+
+// HTTP handler for a request to /status:
+func (ctx *ServerCtx) http_status_handler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		log.Printf("%s: Unsupported HTTP %s", r.URL, r.Method)
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	st := Status{
+		DoorStatus: ctx.door_status(),
+		Allowlist: ctx.allowlist_status(),
+		QueuedEvents: ctx.queued_events(),
+		Intweb: ctx.session.Endpoints(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(st); err != nil {
+		log.Printf("%s: %s", r.URL, err)
+	}
+}
+
 // HTTP handler for a request to /ping:
 func (ctx *ServerCtx) http_ping_handler(w http.ResponseWriter, r *http.Request) {
 	
@@ -579,11 +1286,11 @@ func (ctx *ServerCtx) http_ping_handler(w http.ResponseWriter, r *http.Request)
 //
 // 'why' is set only if 'access' is false, and supplies a reason why
 // access was denied.
-func (ctx *ServerCtx) handle_access(access bool, badge uint64,
+func (ctx *ServerCtx) handle_access(access bool, badge intweb.Badge,
 	why string) error {
 
 	if access {
-		log.Printf("Access allowed for %d!", badge)
+		log.Printf("Access allowed for %s!", badge)
 		if ctx.Verbose {
 			log.Printf("Opening lock for %s...", ctx.LockHoldTime)
 		}
@@ -596,12 +1303,12 @@ func (ctx *ServerCtx) handle_access(access bool, badge uint64,
 			<-time.After(500 * time.Millisecond)
 		}()
 			
-		ctx.Lock.SetValue(1)
-		
-		ctx.ReLockTimer.Stop()
-		ctx.ReLockTimer.Reset(ctx.LockHoldTime)
+		if err := ctx.Lock.Unlock(); err != nil {
+			log.Printf("Error opening lock: %s", err)
+		}
+		ctx.door_unlocked(ctx.LockHoldTime)
 	} else {
-		log.Printf("Access denied for %d (why: %s)", badge, why)
+		log.Printf("Access denied for %s (why: %s)", badge, why)
 
 		// Beep twice for access denied:
 		go func() {
@@ -617,12 +1324,28 @@ func (ctx *ServerCtx) handle_access(access bool, badge uint64,
 	return nil
 }
 
+// handle_rex handles a press of the REX input: the door unlocks for
+// RexHoldTime, with no intweb call (and no beep, as the person is
+// leaving).
+func (ctx *ServerCtx) handle_rex() {
+	log.Printf("Request to exit, opening lock for %s", ctx.RexHoldTime)
+
+	if ctx.MqttClient != nil && ctx.Mqtt.TopicRex != "" {
+		ctx.MqttClient.Publish(ctx.Mqtt.TopicRex, 0, false, "pressed")
+	}
+
+	if err := ctx.Lock.Unlock(); err != nil {
+		log.Printf("Error opening lock: %s", err)
+	}
+	ctx.door_rex(ctx.RexHoldTime)
+}
+
 // scrub_cache removes expired entries in the badge cache.  It returns
 // the number of entries removed.
 func (ctx *ServerCtx) scrub_cache() int {
 
 	now := time.Now()
-	to_del := make(map[uint64]bool)
+	to_del := make(map[intweb.Badge]bool)
 	
 	for badge, expiration := range ctx.Cache {
 		if now.After(expiration) {
@@ -634,6 +1357,9 @@ func (ctx *ServerCtx) scrub_cache() int {
 	for badge, _ := range to_del {
 		delete(ctx.Cache, badge)
 	}
+	if len(to_del) > 0 {
+		ctx.cache_dirty = true
+	}
 
 	return len(to_del)
 }
@@ -0,0 +1,310 @@
+package access
+
+// The offline allowlist: every badge allowed access to IntwebItem,
+// synced in the background from Config.AllowlistSource and kept in
+// Config.StateDir.  When intweb can't be reached at all (see
+// intweb.IsNetworkError), and a badge isn't in the cache, this decides
+// instead.
+//
+// The allowlist has a version, which goes up whenever a sync changes
+// it, so that the log and /status show when it last changed (and not
+// just when it was last synced).
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+const (
+	// Name of the allowlist's state file:
+	allowlist_state = "allowlist"
+	// Values for Config.AllowlistSource (besides URLs):
+	AllowlistIntweb = "intweb"
+	allowlist_file_prefix = "file:"
+	// Default for Config.AllowlistInterval:
+	DefaultAllowlistInterval = 60 * time.Minute
+)
+
+// allowlistFetcher fetches the full list of badges allowed access.
+type allowlistFetcher interface {
+	fetch(ctx context.Context) ([]intweb.Badge, error)
+}
+
+// intwebFetcher fetches the allowlist from intweb (with the badge_list
+// operation; see intweb.Session.BadgeList).
+type intwebFetcher struct {
+	session *intweb.Session
+	item string
+}
+
+func (f intwebFetcher) fetch(ctx context.Context) ([]intweb.Badge, error) {
+	return f.session.BadgeListContext(ctx, f.item)
+}
+
+// textFetcher fetches the allowlist as text, one badge per line, from a
+// file (e.g. one copied over by some other means) or an HTTPS URL.
+// Blank lines, and lines starting with '#', are ignored.
+//
+// Only HTTPS is allowed, as the allowlist is used exactly when intweb
+// can't be reached, so anyone who could both cut intweb off and answer
+// a plain HTTP request in place of the server could let in any badge.
+type textFetcher struct {
+	// Either a path or a URL:
+	path string
+	url string
+	client *http.Client
+}
+
+func (f textFetcher) fetch(ctx context.Context) ([]intweb.Badge, error) {
+	var r io.Reader
+	if f.url != "" {
+		req, err := http.NewRequest("GET", f.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := f.client.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("HTTP code %d", resp.StatusCode)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	badges := []intweb.Badge{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		badges = append(badges, intweb.Badge(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return badges, nil
+}
+
+// new_fetcher returns the fetcher for Config.AllowlistSource.
+func new_fetcher(cfg *Config, s *intweb.Session) (allowlistFetcher, error) {
+	src := cfg.AllowlistSource
+	switch {
+	case src == AllowlistIntweb:
+		return intwebFetcher{session: s, item: cfg.IntwebItem}, nil
+	case strings.HasPrefix(src, allowlist_file_prefix):
+		return textFetcher{path: strings.TrimPrefix(src, allowlist_file_prefix)}, nil
+	case strings.HasPrefix(src, "https://"):
+		return textFetcher{url: src, client: s.Client}, nil
+	case strings.HasPrefix(src, "http://"):
+		return nil, fmt.Errorf("Allowlist source %q must use https://, so that it can't be spoofed", src)
+	}
+	return nil, fmt.Errorf("Unknown allowlist source %q (expected %s, %sPATH, or an https:// URL)",
+		src, AllowlistIntweb, allowlist_file_prefix)
+}
+
+// savedAllowlist is the content of the allowlist file.
+type savedAllowlist struct {
+	Version int `json:"version"`
+	// Source it was synced from (if that changes, this isn't used):
+	Source string `json:"source"`
+	Item string `json:"item"`
+	// When it was last synced:
+	Synced time.Time `json:"synced"`
+	Badges []intweb.Badge `json:"badges"`
+}
+
+// allowlist is the offline allowlist.  It is synced in its own
+// goroutine, and checked from the main loop, so everything is guarded
+// by 'mu'.
+type allowlist struct {
+	mu sync.Mutex
+	saved savedAllowlist
+	badges map[intweb.Badge]bool
+	// Error from the last sync ("" if it worked), and when that was:
+	last_error string
+	last_attempt time.Time
+}
+
+// set replaces the allowlist's content.  a.mu must be held.
+func (a *allowlist) set(saved savedAllowlist) {
+	a.saved = saved
+	a.badges = make(map[intweb.Badge]bool, len(saved.Badges))
+	for _, b := range saved.Badges {
+		a.badges[b] = true
+	}
+}
+
+// same_badges returns true if 'badges' is exactly what the allowlist
+// has now.  a.mu must be held.
+func (a *allowlist) same_badges(badges []intweb.Badge) bool {
+	seen := make(map[intweb.Badge]bool, len(badges))
+	for _, b := range badges {
+		if !a.badges[b] {
+			return false
+		}
+		seen[b] = true
+	}
+	return len(seen) == len(a.badges)
+}
+
+// load_allowlist reads the allowlist file, if there is one and it is
+// from the same source and item.
+func (ctx *ServerCtx) load_allowlist() *allowlist {
+	a := &allowlist{}
+	a.set(savedAllowlist{Source: ctx.AllowlistSource, Item: ctx.IntwebItem})
+
+	var saved savedAllowlist
+	ok, err := ctx.load_state(allowlist_state, &saved, ctx.CacheEncrypt)
+	if err != nil {
+		log.Printf("Error loading allowlist: %s", err)
+	}
+	if !ok {
+		return a
+	}
+	if saved.Source != ctx.AllowlistSource || saved.Item != ctx.IntwebItem {
+		log.Printf("Ignoring saved allowlist, which is from another source or item")
+		return a
+	}
+	a.set(saved)
+	log.Printf("Loaded allowlist version %d (%d badges, synced %s)",
+		saved.Version, len(saved.Badges), saved.Synced.Format(time.RFC3339))
+	return a
+}
+
+// sync_allowlist syncs the allowlist from 'fetcher' now, and then
+// every AllowlistInterval until 'run_ctx' is cancelled.
+func (ctx *ServerCtx) sync_allowlist(run_ctx context.Context, fetcher allowlistFetcher) {
+	defer ctx.running.Done()
+	for {
+		ctx.sync_allowlist_once(run_ctx, fetcher)
+		select {
+		case <-time.After(ctx.AllowlistInterval):
+		case <-run_ctx.Done():
+			return
+		}
+	}
+}
+
+func (ctx *ServerCtx) sync_allowlist_once(run_ctx context.Context, fetcher allowlistFetcher) {
+	badges, err := fetcher.fetch(run_ctx)
+	if run_ctx.Err() != nil {
+		return
+	}
+
+	a := ctx.allowlist
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.last_attempt = time.Now()
+	if err != nil {
+		log_intweb_error("Allowlist sync failed", err)
+		a.last_error = err.Error()
+		return
+	}
+	a.last_error = ""
+
+	saved := a.saved
+	saved.Synced = time.Now()
+	if !a.same_badges(badges) {
+		saved.Version += 1
+		saved.Badges = badges
+		log.Printf("Allowlist synced: now version %d, with %d badges",
+			saved.Version, len(badges))
+	} else if ctx.Verbose {
+		log.Printf("Allowlist synced: no change")
+	}
+	a.set(saved)
+	if err := ctx.save_state(allowlist_state, a.saved, ctx.CacheEncrypt); err != nil {
+		log.Printf("Error saving allowlist: %s", err)
+	}
+}
+
+// check_allowlist decides on 'badge' from the allowlist, after intweb
+// failed with 'err'.  It returns whether the badge is allowed, and
+// whether the allowlist could decide at all (which it can only if
+// intweb was unreachable, and the allowlist has been synced recently
+// enough).
+func (ctx *ServerCtx) check_allowlist(badge intweb.Badge, err error) (bool, bool) {
+	a := ctx.allowlist
+	if a == nil || !intweb.IsNetworkError(err) {
+		return false, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.saved.Synced.IsZero() {
+		log.Printf("check_allowlist: Allowlist was never synced, can't use it")
+		return false, false
+	}
+	age := time.Since(a.saved.Synced)
+	if ctx.AllowlistMaxAge > 0 && age > ctx.AllowlistMaxAge {
+		log.Printf("check_allowlist: Allowlist is too old to use (synced %s ago)",
+			age.Round(time.Second))
+		return false, false
+	}
+	allowed := a.badges[badge]
+	if allowed {
+		log.Printf("check_allowlist: intweb unreachable; badge %s is in allowlist version %d",
+			badge, a.saved.Version)
+	} else {
+		log.Printf("check_allowlist: intweb unreachable; badge %s is not in allowlist version %d",
+			badge, a.saved.Version)
+	}
+	return allowed, true
+}
+
+// AllowlistStatus is the offline allowlist's state, as returned by
+// /status.
+type AllowlistStatus struct {
+	Version int `json:"version"`
+	// Number of badges in it:
+	Entries int `json:"entries"`
+	// When it was last synced, and how long ago that was (in seconds):
+	Synced *time.Time `json:"synced,omitempty"`
+	AgeSeconds *int64 `json:"age_seconds,omitempty"`
+	// Error from the last sync, if it failed:
+	LastError string `json:"last_error,omitempty"`
+}
+
+// allowlist_status returns the allowlist's state (or nil if there is
+// no allowlist).
+func (ctx *ServerCtx) allowlist_status() *AllowlistStatus {
+	a := ctx.allowlist
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	st := &AllowlistStatus{
+		Version: a.saved.Version,
+		Entries: len(a.badges),
+		LastError: a.last_error,
+	}
+	if !a.saved.Synced.IsZero() {
+		t := a.saved.Synced
+		age := int64(time.Since(t) / time.Second)
+		st.Synced = &t
+		st.AgeSeconds = &age
+	}
+	return st
+}
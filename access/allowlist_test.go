@@ -0,0 +1,198 @@
+package access
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+// stubFetcher returns fixed badges, or an error.
+type stubFetcher struct {
+	badges []intweb.Badge
+	err error
+}
+
+func (f *stubFetcher) fetch(ctx context.Context) ([]intweb.Badge, error) {
+	return f.badges, f.err
+}
+
+// new_allowlist returns a ServerCtx with an empty allowlist from
+// 'source', kept in a temporary StateDir, and a function to remove
+// that at the end of the test.
+func new_allowlist(t *testing.T, source string) (*ServerCtx, func()) {
+	t.Helper()
+	ctx, cleanup := new_state(t, false)
+	ctx.AllowlistSource = source
+	ctx.IntwebItem = "door"
+	ctx.allowlist = ctx.load_allowlist()
+	return ctx, cleanup
+}
+
+var test_unreachable = &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+func TestNewFetcher(t *testing.T) {
+	s := &intweb.Session{Client: http.DefaultClient}
+	good := []string{AllowlistIntweb, "file:/etc/allowlist", "https://example.com/list"}
+	for _, src := range good {
+		if _, err := new_fetcher(&Config{AllowlistSource: src}, s); err != nil {
+			t.Errorf("%s: %s", src, err)
+		}
+	}
+	// (Plain HTTP could be spoofed.)
+	bad := []string{"http://example.com/list", "/etc/allowlist", "ftp://example.com/list"}
+	for _, src := range bad {
+		if _, err := new_fetcher(&Config{AllowlistSource: src}, s); err == nil {
+			t.Errorf("%s was allowed", src)
+		}
+	}
+}
+
+const test_allowlist_text = "# Members\n123\n\n  456  \n#789\n"
+
+func TestTextFetcherFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "list")
+	if err := ioutil.WriteFile(path, []byte(test_allowlist_text), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := new_fetcher(&Config{AllowlistSource: "file:" + path}, &intweb.Session{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badges, err := f.fetch(context.Background())
+	if err != nil || fmt.Sprint(badges) != "[123 456]" {
+		t.Errorf("Fetched %v, %v", badges, err)
+	}
+
+	f = textFetcher{path: filepath.Join(dir, "missing")}
+	if _, err := f.fetch(context.Background()); err == nil {
+		t.Error("Fetched a missing file")
+	}
+}
+
+func TestTextFetcherHTTPS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/list" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, test_allowlist_text)
+	}))
+	defer srv.Close()
+	s := &intweb.Session{Client: srv.Client()}
+
+	f, err := new_fetcher(&Config{AllowlistSource: srv.URL + "/list"}, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	badges, err := f.fetch(context.Background())
+	if err != nil || fmt.Sprint(badges) != "[123 456]" {
+		t.Errorf("Fetched %v, %v", badges, err)
+	}
+
+	f, _ = new_fetcher(&Config{AllowlistSource: srv.URL + "/other"}, s)
+	if _, err := f.fetch(context.Background()); err == nil {
+		t.Error("Fetched despite HTTP 404")
+	}
+}
+
+func TestAllowlistSync(t *testing.T) {
+	ctx, cleanup := new_allowlist(t, AllowlistIntweb)
+	defer cleanup()
+	f := &stubFetcher{badges: []intweb.Badge{"1", "2"}}
+	version := func() int { return ctx.allowlist_status().Version }
+
+	ctx.sync_allowlist_once(context.Background(), f)
+	if version() != 1 {
+		t.Fatalf("Version %d after first sync", version())
+	}
+	// The version only goes up when the badges change:
+	f.badges = []intweb.Badge{"2", "1"}
+	ctx.sync_allowlist_once(context.Background(), f)
+	if version() != 1 {
+		t.Errorf("Version %d after no change", version())
+	}
+	f.badges = []intweb.Badge{"1", "3"}
+	ctx.sync_allowlist_once(context.Background(), f)
+	if version() != 2 {
+		t.Errorf("Version %d after a change", version())
+	}
+
+	// A failed sync keeps the list:
+	f.err = test_unreachable
+	ctx.sync_allowlist_once(context.Background(), f)
+	st := ctx.allowlist_status()
+	if st.Version != 2 || st.Entries != 2 || st.LastError == "" {
+		t.Errorf("After failed sync: %+v", st)
+	}
+
+	// It is kept across restarts, but only for the same source and
+	// item:
+	ctx.allowlist = ctx.load_allowlist()
+	if st := ctx.allowlist_status(); st.Version != 2 || st.Entries != 2 {
+		t.Errorf("Reloaded as %+v", st)
+	}
+	ctx.IntwebItem = "other door"
+	ctx.allowlist = ctx.load_allowlist()
+	if st := ctx.allowlist_status(); st.Version != 0 || st.Entries != 0 {
+		t.Errorf("Reloaded for another item as %+v", st)
+	}
+}
+
+func TestCheckAllowlist(t *testing.T) {
+	ctx, cleanup := new_allowlist(t, AllowlistIntweb)
+	defer cleanup()
+
+	if _, ok := ctx.check_allowlist("1", test_unreachable); ok {
+		t.Error("Decided from an allowlist that was never synced")
+	}
+	ctx.sync_allowlist_once(context.Background(), &stubFetcher{badges: []intweb.Badge{"1"}})
+
+	tests := []struct {
+		name string
+		badge intweb.Badge
+		err error
+		allowed bool
+		ok bool
+	}{
+		{"in list", "1", test_unreachable, true, true},
+		{"not in list", "2", test_unreachable, false, true},
+		{"breaker open", "1", &intweb.BreakerOpenError{}, true, true},
+		// intweb answered, so it decides, not the allowlist:
+		{"denied by intweb", "1", &intweb.Error{Msg: "Unknown badge"}, false, false},
+		{"bad reply", "1", &intweb.AuthError{Msg: "Checksum is wrong"}, false, false},
+	}
+	for _, test := range tests {
+		allowed, ok := ctx.check_allowlist(test.badge, test.err)
+		if allowed != test.allowed || ok != test.ok {
+			t.Errorf("%s: got %t, %t", test.name, allowed, ok)
+		}
+	}
+
+	// Too old to use:
+	ctx.AllowlistMaxAge = time.Hour
+	ctx.allowlist.saved.Synced = time.Now().Add(-2 * time.Hour)
+	if _, ok := ctx.check_allowlist("1", test_unreachable); ok {
+		t.Error("Decided from an allowlist past AllowlistMaxAge")
+	}
+
+	ctx.allowlist = nil
+	if _, ok := ctx.check_allowlist("1", test_unreachable); ok {
+		t.Error("Decided with no allowlist")
+	}
+}
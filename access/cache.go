@@ -0,0 +1,64 @@
+package access
+
+// Keeping the badge cache (ServerCtx.Cache) in Config.StateDir, so
+// that it survives a restart - otherwise, if intweb were down just
+// then, nobody could get in.  With Config.CacheEncrypt, it is
+// encrypted (see state.go).
+
+import (
+	"log"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+// Name of the badge cache's state file:
+const cache_state = "badge_cache"
+
+// savedCache is the content of the cache file:
+type savedCache struct {
+	// Expiration time, by badge:
+	Badges map[intweb.Badge]time.Time `json:"badges"`
+}
+
+// load_cache reads the cache file, and returns the badges in it which
+// haven't expired yet.  If there is no cache file, or it can't be read,
+// this returns an empty cache.
+func (ctx *ServerCtx) load_cache() map[intweb.Badge]time.Time {
+	cache := make(map[intweb.Badge]time.Time)
+
+	var saved savedCache
+	ok, err := ctx.load_state(cache_state, &saved, ctx.CacheEncrypt)
+	if err != nil {
+		log.Printf("Error loading badge cache: %s", err)
+	}
+	if !ok {
+		return cache
+	}
+
+	now := time.Now()
+	expired := 0
+	for badge, expiration := range saved.Badges {
+		if now.After(expiration) {
+			expired += 1
+			continue
+		}
+		cache[badge] = expiration
+	}
+	log.Printf("Loaded %d badges from cache file (%d expired)", len(cache), expired)
+	return cache
+}
+
+// save_cache writes the cache file (if the cache has changed since it
+// was last written).
+func (ctx *ServerCtx) save_cache() {
+	if !ctx.cache_dirty {
+		return
+	}
+	err := ctx.save_state(cache_state, savedCache{Badges: ctx.Cache}, ctx.CacheEncrypt)
+	if err != nil {
+		log.Printf("Error saving badge cache: %s", err)
+		return
+	}
+	ctx.cache_dirty = false
+}
@@ -0,0 +1,53 @@
+package access
+
+import (
+	"testing"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+func TestCacheSaved(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		ctx, cleanup := new_state(t, encrypt)
+		defer cleanup()
+
+		now := time.Now()
+		ctx.Cache = map[intweb.Badge]time.Time{
+			"1": now.Add(time.Hour),
+			"2": now.Add(-time.Hour),
+		}
+		// Only written once it has changed:
+		ctx.save_cache()
+		if got := ctx.load_cache(); len(got) != 0 {
+			t.Errorf("Encrypt %t: unchanged cache was saved", encrypt)
+		}
+		ctx.cache_dirty = true
+		ctx.save_cache()
+		if ctx.cache_dirty {
+			t.Errorf("Encrypt %t: still dirty after saving", encrypt)
+		}
+
+		// The expired badge is dropped:
+		got := ctx.load_cache()
+		if len(got) != 1 || !got["1"].Equal(now.Add(time.Hour)) {
+			t.Errorf("Encrypt %t: loaded %v", encrypt, got)
+		}
+	}
+}
+
+// A cache that can't be decrypted (e.g. after the device key changed)
+// is just empty.
+func TestCacheWrongKey(t *testing.T) {
+	ctx, cleanup := new_state(t, true)
+	defer cleanup()
+
+	ctx.Cache = map[intweb.Badge]time.Time{"1": time.Now().Add(time.Hour)}
+	ctx.cache_dirty = true
+	ctx.save_cache()
+
+	ctx.IntwebDeviceKey = []byte("other key")
+	if got := ctx.load_cache(); len(got) != 0 {
+		t.Errorf("Loaded %v with the wrong key", got)
+	}
+}
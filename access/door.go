@@ -0,0 +1,475 @@
+package access
+
+// Door state, from the door sensor, and the alarms that come from it.
+//
+// The door sensor's goroutine (see monitor_door) and the main loop
+// (on every unlock) both report here, and timers raise alarms from
+// their own goroutines, so everything is guarded by doorState.mu.
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// Alarms (as published to MQTT and shown by /status):
+const (
+	// Door stayed open longer than HeldOpenTime:
+	AlarmHeldOpen = "held_open"
+	// Door opened while it was locked (see ForcedEntry):
+	AlarmForced = "forced"
+)
+
+// Published to MQTT when an alarm is cleared:
+const alarm_cleared = "cleared"
+
+type doorState struct {
+	mu sync.Mutex
+	// True once the door sensor's state is known:
+	known bool
+	open bool
+	// When the door last opened or closed:
+	changed_at time.Time
+	// When the door was last unlocked:
+	unlocked_at time.Time
+	// True from when the lock is released until it closes again, and
+	// when it last closed:
+	released bool
+	locked_at time.Time
+	// True if the door has been open since the lock was released (for
+	// RelockOnClose):
+	opened_since_unlock bool
+	// True from a REX press until the door closes (or until the lock
+	// closes, if the door never opened), so that this opening raises
+	// no alarm:
+	rex bool
+	// Why the door is held unlocked (HeldBySchedule or HeldByRequest),
+	// or "" if it isn't; while it is, ReLockTimer doesn't lock, and no
+	// new alarm is raised.  With HeldByRequest, until when:
+	held_by string
+	held_until time.Time
+	// Running while the door is open, to raise AlarmHeldOpen:
+	held_timer *time.Timer
+	// Running while the door is open after opening while locked, to
+	// raise AlarmForced after ForcedDelay:
+	forced_timer *time.Timer
+	// Current alarm ("" if none), and since when:
+	alarm string
+	alarm_at time.Time
+	// Stops the beeper & LED pattern of the current alarm:
+	stop_alarm context.CancelFunc
+	// True once shutting down, after which no alarm is raised:
+	closed bool
+}
+
+// door_changed handles the door sensor reporting the door open or
+// closed.
+func (ctx *ServerCtx) door_changed(open bool) {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.known && d.open == open {
+		return
+	}
+	// (Only a change from closed to open can be forced, not the first
+	// state that the sensor reports.)
+	was_closed := d.known && !d.open
+	last_change := d.changed_at
+	d.known = true
+	d.open = open
+	d.changed_at = time.Now()
+
+	if open {
+		if d.released {
+			d.opened_since_unlock = true
+		}
+		if d.rex {
+			log.Printf("Door opened for request to exit")
+		}
+		if ctx.HeldOpenTime > 0 && !d.rex && d.held_by == "" {
+			d.start_held_timer(ctx)
+		}
+		if ctx.ForcedEntry && was_closed && !d.released && !d.rex &&
+			d.changed_at.Sub(d.locked_at) > ctx.ForcedGrace {
+
+			if ctx.ForcedDelay > 0 {
+				log.Printf("Door opened while locked, alarm in %s unless it closes",
+					ctx.ForcedDelay)
+				d.start_forced_timer(ctx)
+			} else {
+				d.forced(ctx)
+			}
+		}
+	} else {
+		d.rex = false
+		if d.held_timer != nil {
+			d.held_timer.Stop()
+			d.held_timer = nil
+		}
+		if d.forced_timer != nil {
+			log.Printf("Door closed again within %s of opening while locked",
+				ctx.ForcedDelay)
+			d.stop_forced_timer()
+		}
+		if d.alarm != "" {
+			log.Printf("Door closed after being open since %s",
+				last_change.Format(time.RFC3339))
+			ctx.clear_alarm()
+		}
+		// Someone has gone through, so don't leave the door unlocked
+		// for anyone else:
+		if ctx.RelockOnClose && d.released && d.opened_since_unlock &&
+			d.held_by == "" {
+
+			delay := ctx.LockMinHoldTime - time.Since(d.unlocked_at)
+			if delay < 0 {
+				delay = 0
+			}
+			log.Printf("Door closed after unlock, closing lock in %s", delay)
+			ctx.relock_after(delay)
+		}
+	}
+}
+
+// door_unlocked records that the door was just unlocked, and starts
+// ReLockTimer to close the lock after 'hold'.  If it is already open,
+// it gets another HeldOpenTime before the alarm (but if AlarmHeldOpen
+// was already raised, that stays until the door closes).
+func (ctx *ServerCtx) door_unlocked(hold time.Duration) {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.unlock(ctx, hold)
+	if d.open && d.held_timer != nil {
+		d.start_held_timer(ctx)
+	}
+}
+
+// unlock records an unlock for door_unlocked or door_rex.  d.mu must
+// be held.
+func (d *doorState) unlock(ctx *ServerCtx, hold time.Duration) {
+	// An unlock within ForcedDelay means the opening wasn't forced:
+	d.stop_forced_timer()
+	d.unlocked_at = time.Now()
+	d.released = true
+	// (If the door is already open, then it closing is someone going
+	// through.)
+	d.opened_since_unlock = d.open
+	ctx.relock_after(hold)
+}
+
+// door_held records whether the door is held unlocked, and why (see
+// doorState.held_by); 'until' is when a hold by request ends.  It
+// returns true if 'held_by' changed.  When the hold ends, the lock
+// closes (through ReLockTimer).
+func (ctx *ServerCtx) door_held(held_by string, until time.Time) bool {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.held_until = until
+	if d.held_by == held_by {
+		return false
+	}
+	d.held_by = held_by
+
+	if held_by != "" {
+		d.stop_forced_timer()
+		d.unlocked_at = time.Now()
+		d.released = true
+		d.opened_since_unlock = d.open
+		if d.held_timer != nil {
+			d.held_timer.Stop()
+			d.held_timer = nil
+		}
+	} else {
+		ctx.relock_after(0)
+		// If it's been left open, it has HeldOpenTime from now:
+		if d.open && ctx.HeldOpenTime > 0 {
+			d.start_held_timer(ctx)
+		}
+	}
+	return true
+}
+
+// held_unlocked returns true if the door is held unlocked.
+func (ctx *ServerCtx) held_unlocked() bool {
+	ctx.door.mu.Lock()
+	defer ctx.door.mu.Unlock()
+	return ctx.door.held_by != ""
+}
+
+// relock_after (re)starts ReLockTimer to close the lock after 'delay'.
+// ctx.door.mu must be held.
+func (ctx *ServerCtx) relock_after(delay time.Duration) {
+	if ctx.door.closed {
+		return
+	}
+	ctx.ReLockTimer.Stop()
+	ctx.ReLockTimer.Reset(delay)
+}
+
+// relock closes the lock (when ReLockTimer expires), unless the door is
+// held unlocked.
+func (ctx *ServerCtx) relock() {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed || d.held_by != "" {
+		return
+	}
+
+	if ctx.Verbose {
+		log.Printf("Closing lock.")
+	}
+	if err := ctx.Lock.Lock(); err != nil {
+		log.Printf("Error closing lock: %s", err)
+	}
+	d.released = false
+	d.opened_since_unlock = false
+	d.locked_at = time.Now()
+	// A REX press only covers the opening it allowed:
+	if !d.open {
+		d.rex = false
+	}
+}
+
+// door_rex records a REX press, which has just unlocked the door, and
+// starts ReLockTimer to close the lock after 'hold'.  Neither
+// AlarmForced nor AlarmHeldOpen is raised for the opening that this
+// allows (or for the current one, if the door is already open).
+func (ctx *ServerCtx) door_rex(hold time.Duration) {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.unlock(ctx, hold)
+	d.rex = true
+	if d.held_timer != nil {
+		d.held_timer.Stop()
+		d.held_timer = nil
+	}
+}
+
+// start_held_timer (re)starts the timer for AlarmHeldOpen.  d.mu must
+// be held.
+func (d *doorState) start_held_timer(ctx *ServerCtx) {
+	if d.held_timer != nil {
+		d.held_timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(ctx.HeldOpenTime, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Make sure this timer wasn't stopped or replaced while it
+		// was waiting on the lock:
+		if d.held_timer != timer || !d.open {
+			return
+		}
+		d.held_timer = nil
+		log.Printf("ALARM: Door has been held open for over %s", ctx.HeldOpenTime)
+		ctx.raise_alarm(AlarmHeldOpen)
+	})
+	d.held_timer = timer
+}
+
+// forced raises AlarmForced for the door opening while locked.  d.mu
+// must be held.
+func (d *doorState) forced(ctx *ServerCtx) {
+	if d.locked_at.IsZero() {
+		log.Printf("ALARM: Door forced open (not unlocked since startup)")
+	} else {
+		log.Printf("ALARM: Door forced open (lock closed since %s)",
+			d.locked_at.Format(time.RFC3339))
+	}
+	ctx.raise_alarm(AlarmForced)
+}
+
+// start_forced_timer starts the timer to raise AlarmForced after
+// ForcedDelay, unless the door closes or is unlocked first.  d.mu must
+// be held.
+func (d *doorState) start_forced_timer(ctx *ServerCtx) {
+	d.stop_forced_timer()
+	var timer *time.Timer
+	timer = time.AfterFunc(ctx.ForcedDelay, func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Make sure this timer wasn't stopped or replaced while it
+		// was waiting on the lock:
+		if d.forced_timer != timer || !d.open {
+			return
+		}
+		d.forced_timer = nil
+		d.forced(ctx)
+	})
+	d.forced_timer = timer
+}
+
+// stop_forced_timer stops the timer for AlarmForced, if it is running.
+// d.mu must be held.
+func (d *doorState) stop_forced_timer() {
+	if d.forced_timer != nil {
+		d.forced_timer.Stop()
+		d.forced_timer = nil
+	}
+}
+
+// raise_alarm sets the current alarm, publishes it to MQTT, and starts
+// the alarm pattern on the beeper & LED.  ctx.door.mu must be held.
+func (ctx *ServerCtx) raise_alarm(alarm string) {
+	d := &ctx.door
+	if d.closed || d.alarm == alarm {
+		return
+	}
+	if d.stop_alarm != nil {
+		d.stop_alarm()
+	}
+	d.alarm = alarm
+	d.alarm_at = time.Now()
+
+	if ctx.MqttClient != nil && ctx.Mqtt.TopicAlarm != "" {
+		ctx.MqttClient.Publish(ctx.Mqtt.TopicAlarm, 0, false, alarm)
+	}
+
+	alarm_ctx, cancel := context.WithCancel(context.Background())
+	d.stop_alarm = cancel
+	ctx.running.Add(1)
+	go ctx.alarm_pattern(alarm_ctx)
+}
+
+// clear_alarm clears the current alarm, if any.  ctx.door.mu must be
+// held.
+func (ctx *ServerCtx) clear_alarm() {
+	d := &ctx.door
+	if d.alarm == "" {
+		return
+	}
+	log.Printf("Alarm %s cleared", d.alarm)
+	d.alarm = ""
+	if d.stop_alarm != nil {
+		d.stop_alarm()
+		d.stop_alarm = nil
+	}
+	if ctx.MqttClient != nil && ctx.Mqtt.TopicAlarm != "" {
+		ctx.MqttClient.Publish(ctx.Mqtt.TopicAlarm, 0, false, alarm_cleared)
+	}
+}
+
+// alarm_pattern sounds the alarm on the reader until 'alarm_ctx' is
+// cancelled: three quick beeps with the LED flashing, then a pause.
+// (This is unlike any of the long beeps for access allowed or denied.)
+func (ctx *ServerCtx) alarm_pattern(alarm_ctx context.Context) {
+	defer ctx.running.Done()
+	defer func() {
+		ctx.Beep.SetValue(1)
+		ctx.LED.SetValue(1)
+	}()
+	for {
+		for i := 0; i < 3; i++ {
+			ctx.Beep.SetValue(0)
+			ctx.LED.SetValue(0)
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-alarm_ctx.Done():
+				return
+			}
+			ctx.Beep.SetValue(1)
+			ctx.LED.SetValue(1)
+			select {
+			case <-time.After(100 * time.Millisecond):
+			case <-alarm_ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-time.After(2 * time.Second):
+		case <-alarm_ctx.Done():
+			return
+		}
+	}
+}
+
+// alarm_active returns true if there is an alarm.
+func (ctx *ServerCtx) alarm_active() bool {
+	ctx.door.mu.Lock()
+	defer ctx.door.mu.Unlock()
+	return ctx.door.alarm != ""
+}
+
+// door_shutdown stops all door timers (including ReLockTimer) and
+// alarms, for shutting down.
+func (ctx *ServerCtx) door_shutdown() {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.closed = true
+	ctx.ReLockTimer.Stop()
+	if d.held_timer != nil {
+		d.held_timer.Stop()
+		d.held_timer = nil
+	}
+	d.stop_forced_timer()
+	if d.stop_alarm != nil {
+		d.stop_alarm()
+		d.stop_alarm = nil
+	}
+}
+
+// DoorStatus is the door's state, as returned by /status.
+type DoorStatus struct {
+	// "open", "closed", or "unknown" (if there is no door sensor, or
+	// it hasn't settled yet):
+	Door string `json:"door"`
+	// When the door last opened or closed:
+	DoorChanged *time.Time `json:"door_changed,omitempty"`
+	// When the door was last unlocked:
+	Unlocked *time.Time `json:"unlocked,omitempty"`
+	// Current alarm (e.g. AlarmHeldOpen or AlarmForced), or "" if
+	// none:
+	Alarm string `json:"alarm"`
+	// When the current alarm was raised:
+	AlarmSince *time.Time `json:"alarm_since,omitempty"`
+	// Why the door is held unlocked (HeldBySchedule or HeldByRequest),
+	// or "" if it isn't:
+	HeldBy string `json:"held_by"`
+	// With HeldByRequest, when the hold ends:
+	HeldUntil *time.Time `json:"held_until,omitempty"`
+}
+
+// door_status returns the door's current state.
+func (ctx *ServerCtx) door_status() DoorStatus {
+	d := &ctx.door
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ds := DoorStatus{
+		Door: "unknown",
+		Alarm: d.alarm,
+		HeldBy: d.held_by,
+	}
+	if d.known {
+		ds.Door = "closed"
+		if d.open {
+			ds.Door = "open"
+		}
+		t := d.changed_at
+		ds.DoorChanged = &t
+	}
+	if !d.unlocked_at.IsZero() {
+		t := d.unlocked_at
+		ds.Unlocked = &t
+	}
+	if d.alarm != "" {
+		t := d.alarm_at
+		ds.AlarmSince = &t
+	}
+	if d.held_by == HeldByRequest {
+		t := d.held_until
+		ds.HeldUntil = &t
+	}
+	return ds
+}
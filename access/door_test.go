@@ -0,0 +1,287 @@
+package access
+
+import (
+	"testing"
+	"time"
+
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/lock"
+)
+
+const (
+	test_pin_lock = 1
+	test_pin_beep = 2
+	test_pin_led = 3
+)
+
+// new_door returns a ServerCtx with just enough (a lock, beeper and
+// LED on a fake chip, and ReLockTimer) for the door's state and
+// alarms, and a function to shut it down at the end of the test.
+func new_door(t *testing.T, cfg *Config) (*ServerCtx, func()) {
+	t.Helper()
+	chip := gpiofake.NewChip()
+	lock_cfg := lock.Config{}
+	line, err := chip.RequestOutput(test_pin_lock, lock_cfg.LockedLevel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := lock.New(line, nil, lock_cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	beep, err := chip.RequestOutput(test_pin_beep, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	led, err := chip.RequestOutput(test_pin_led, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerCtx{
+		Config: cfg,
+		Lock: l,
+		Beep: beep,
+		LED: led,
+	}
+	ctx.ReLockTimer = time.AfterFunc(time.Hour, ctx.relock)
+	ctx.ReLockTimer.Stop()
+	return ctx, func() {
+		ctx.door_shutdown()
+		ctx.running.Wait()
+		l.Close()
+	}
+}
+
+// alarm returns the current alarm ("" if none).
+func alarm(ctx *ServerCtx) string {
+	return ctx.door_status().Alarm
+}
+
+// check_alarm fails the test if the current alarm isn't 'want'.
+func check_alarm(t *testing.T, ctx *ServerCtx, want string) {
+	t.Helper()
+	if got := alarm(ctx); got != want {
+		t.Fatalf("Alarm is %q, expected %q", got, want)
+	}
+}
+
+func TestForcedEntry(t *testing.T) {
+	ctx, stop := new_door(t, &Config{ForcedEntry: true})
+	defer stop()
+
+	// The first state reported isn't a change, so can't be forced:
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+
+	ctx.door_changed(true)
+	check_alarm(t, ctx, AlarmForced)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+}
+
+func TestForcedEntryOff(t *testing.T) {
+	ctx, stop := new_door(t, &Config{})
+	defer stop()
+
+	ctx.door_changed(false)
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+}
+
+func TestForcedEntryUnlocked(t *testing.T) {
+	ctx, stop := new_door(t, &Config{ForcedEntry: true})
+	defer stop()
+
+	ctx.door_changed(false)
+	ctx.door_unlocked(time.Hour)
+	ctx.door_changed(true)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+
+	// Once the lock closes, the door is locked again:
+	ctx.relock()
+	time.Sleep(10 * time.Millisecond)
+	ctx.door_changed(true)
+	check_alarm(t, ctx, AlarmForced)
+}
+
+func TestForcedEntryRex(t *testing.T) {
+	ctx, stop := new_door(t, &Config{ForcedEntry: true})
+	defer stop()
+
+	ctx.door_changed(false)
+	ctx.door_rex(time.Hour)
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+}
+
+func TestForcedGrace(t *testing.T) {
+	ctx, stop := new_door(t, &Config{
+		ForcedEntry: true,
+		ForcedGrace: time.Second,
+	})
+	defer stop()
+
+	ctx.door_changed(false)
+	ctx.door_unlocked(time.Hour)
+	ctx.relock()
+	// Just after the lock closes:
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+}
+
+func TestForcedDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	ctx, stop := new_door(t, &Config{
+		ForcedEntry: true,
+		ForcedDelay: delay,
+	})
+	defer stop()
+	ctx.door_changed(false)
+
+	// A key override or crash bar: the door closes again in time.
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+	ctx.door_changed(false)
+	time.Sleep(2 * delay)
+	check_alarm(t, ctx, "")
+
+	// Unlocked (e.g. by REX) in time:
+	ctx.door_changed(true)
+	ctx.door_rex(time.Hour)
+	time.Sleep(2 * delay)
+	check_alarm(t, ctx, "")
+	ctx.door_changed(false)
+	ctx.relock()
+
+	// Still open after the delay:
+	ctx.door_changed(true)
+	check_alarm(t, ctx, "")
+	time.Sleep(2 * delay)
+	check_alarm(t, ctx, AlarmForced)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+}
+
+func TestForcedDelayShutdown(t *testing.T) {
+	ctx, stop := new_door(t, &Config{
+		ForcedEntry: true,
+		ForcedDelay: 20 * time.Millisecond,
+	})
+	ctx.door_changed(false)
+	ctx.door_changed(true)
+	stop()
+	time.Sleep(50 * time.Millisecond)
+	check_alarm(t, ctx, "")
+}
+
+func TestHeldOpen(t *testing.T) {
+	const held = 50 * time.Millisecond
+	ctx, stop := new_door(t, &Config{HeldOpenTime: held})
+	defer stop()
+	ctx.door_changed(false)
+
+	ctx.door_unlocked(time.Hour)
+	ctx.door_changed(true)
+	time.Sleep(held / 2)
+	check_alarm(t, ctx, "")
+	ctx.door_changed(false)
+	time.Sleep(held)
+	check_alarm(t, ctx, "")
+
+	ctx.door_changed(true)
+	time.Sleep(2 * held)
+	check_alarm(t, ctx, AlarmHeldOpen)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+}
+
+func TestHeldOpenUnlock(t *testing.T) {
+	const held = 80 * time.Millisecond
+	ctx, stop := new_door(t, &Config{HeldOpenTime: held})
+	defer stop()
+	ctx.door_changed(false)
+
+	// An unlock while open allows HeldOpenTime again:
+	ctx.door_changed(true)
+	time.Sleep(held / 2)
+	ctx.door_unlocked(time.Hour)
+	time.Sleep(3 * held / 4)
+	check_alarm(t, ctx, "")
+	time.Sleep(held)
+	check_alarm(t, ctx, AlarmHeldOpen)
+
+	// ...but once raised, the alarm stays until the door closes:
+	ctx.door_unlocked(time.Hour)
+	check_alarm(t, ctx, AlarmHeldOpen)
+	time.Sleep(2 * held)
+	check_alarm(t, ctx, AlarmHeldOpen)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+}
+
+func TestHeldOpenRex(t *testing.T) {
+	const held = 30 * time.Millisecond
+	ctx, stop := new_door(t, &Config{HeldOpenTime: held})
+	defer stop()
+	ctx.door_changed(false)
+
+	ctx.door_rex(time.Hour)
+	ctx.door_changed(true)
+	time.Sleep(3 * held)
+	check_alarm(t, ctx, "")
+}
+
+func TestHeldOpenHeldUnlocked(t *testing.T) {
+	const held = 30 * time.Millisecond
+	ctx, stop := new_door(t, &Config{HeldOpenTime: held})
+	defer stop()
+	ctx.door_changed(false)
+
+	ctx.door_held(HeldBySchedule, time.Time{})
+	ctx.door_changed(true)
+	time.Sleep(3 * held)
+	check_alarm(t, ctx, "")
+
+	// Once the hold ends, the door has HeldOpenTime from then:
+	ctx.door_held("", time.Time{})
+	check_alarm(t, ctx, "")
+	time.Sleep(3 * held)
+	check_alarm(t, ctx, AlarmHeldOpen)
+
+	// A hold doesn't clear the alarm, only closing the door does:
+	ctx.door_held(HeldBySchedule, time.Time{})
+	check_alarm(t, ctx, AlarmHeldOpen)
+	ctx.door_changed(false)
+	check_alarm(t, ctx, "")
+}
+
+func TestAlarmPattern(t *testing.T) {
+	ctx, stop := new_door(t, &Config{HeldOpenTime: time.Millisecond})
+	defer stop()
+	beep := ctx.Beep.(*gpiofake.Output)
+	ctx.door_changed(false)
+
+	ctx.door_changed(true)
+	// Three beeps take 600ms:
+	time.Sleep(700 * time.Millisecond)
+	check_alarm(t, ctx, AlarmHeldOpen)
+	ctx.door_changed(false)
+	// (Give alarm_pattern time to see that it was stopped.)
+	time.Sleep(50 * time.Millisecond)
+
+	beeps := 0
+	for _, c := range beep.History() {
+		if c.Value == 0 {
+			beeps++
+		}
+	}
+	if beeps != 3 {
+		t.Errorf("Beeped %d times, expected 3", beeps)
+	}
+	if beep.Value() != 1 {
+		t.Errorf("Beeper left on after the alarm cleared")
+	}
+}
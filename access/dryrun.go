@@ -0,0 +1,181 @@
+package access
+
+// Dry-run and simulation support.
+//
+// In a dry run, the lock, beeper, and LED outputs are never requested
+// from the GPIO chip; logOutput stands in for them and only logs.  In
+// a simulation, the inputs are fake too (see gpiofake), and commands
+// on stdin stand in for badge scans, key presses, the door sensor, and the
+// REX input.
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"hive13/rfid/cardreader"
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/sensor"
+	"hive13/rfid/wiegand"
+)
+
+// logOutput is a gpio.OutputLine that logs the values it is set to,
+// rather than driving any GPIO.
+type logOutput struct {
+	// What to log when the output turns on or off, e.g. "beeper on":
+	on_msg string
+	off_msg string
+	// If true, 0 means "on":
+	active_low bool
+	// If true, log only in verbose mode (e.g. for the LED, which
+	// blinks constantly):
+	quiet bool
+	verbose bool
+
+	mu sync.Mutex
+	value int
+}
+
+func (o *logOutput) SetValue(value int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if value == o.value {
+		return nil
+	}
+	o.value = value
+	if o.quiet && !o.verbose {
+		return nil
+	}
+	on := value != 0
+	if o.active_low {
+		on = !on
+	}
+	msg := o.off_msg
+	if on {
+		msg = o.on_msg
+	}
+	log.Printf("Dry run: %s", msg)
+	return nil
+}
+
+func (o *logOutput) Close() error {
+	return nil
+}
+
+// Commands accepted on stdin in simulation mode:
+const simulate_help = `Simulation commands:
+  badge <number>     scan a badge (number as sent to intweb)
+  badge <fc>:<cn>    scan a badge by facility code and card number
+  key <keys>         press keys on the keypad, e.g. "key 1234#"
+  open               door sensor reports open
+  close              door sensor reports closed
+  rex                press (and release) the request-to-exit button`
+
+// simulate_stdin reads simulation commands from stdin.  Badge scans
+// and key presses are sent over the returned channel (which is closed
+// when 'run_ctx' is cancelled); door open/close commands drive the
+// fake door sensor input on 'chip'.
+func (ctx *ServerCtx) simulate_stdin(run_ctx context.Context,
+	chip *gpiofake.Chip) <-chan wiegand.BadgeRead {
+
+	// Reading stdin can't be cancelled, so this goroutine is simply
+	// left behind at shutdown:
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		log.Printf("Simulation: stdin closed")
+	}()
+
+	log.Printf("%s", simulate_help)
+
+	ch := make(chan wiegand.BadgeRead)
+	go func() {
+		defer close(ch)
+		send := func(br wiegand.BadgeRead) bool {
+			select {
+			case ch <- br:
+				return true
+			case <-run_ctx.Done():
+				return false
+			}
+		}
+
+		for {
+			var line string
+			select {
+			case line = <-lines:
+			case <-run_ctx.Done():
+				return
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			switch {
+			case fields[0] == "badge" && len(fields) == 2:
+				br, ok := cardreader.ParseBadge(fields[1])
+				if !ok {
+					log.Printf("Simulation: can't parse badge %q", fields[1])
+					continue
+				}
+				if !send(br) {
+					return
+				}
+			case fields[0] == "key" && len(fields) == 2:
+				keys, err := cardreader.ParseKeys(fields[1])
+				if err != nil {
+					log.Printf("Simulation: %s", err)
+					continue
+				}
+				for _, br := range keys {
+					if !send(br) {
+						return
+					}
+				}
+			case fields[0] == "open" || fields[0] == "close":
+				if ctx.PinSensor < 0 {
+					log.Printf("Simulation: no door sensor is configured")
+					continue
+				}
+				// Set the pin to whatever the sensor would show:
+				open := fields[0] == "open"
+				value := 0
+				if open == ctx.SensorPolarity {
+					value = 1
+				}
+				chip.Input(ctx.PinSensor).Set(value)
+			case fields[0] == "rex":
+				if ctx.PinRex < 0 {
+					log.Printf("Simulation: no REX input is configured")
+					continue
+				}
+				// Press, and release once the press has settled:
+				pressed := 0
+				if ctx.RexPolarity {
+					pressed = 1
+				}
+				settle := ctx.RexSettle
+				if settle <= 0 {
+					settle = sensor.DefaultSettle
+				}
+				in := chip.Input(ctx.PinRex)
+				in.Set(pressed)
+				time.AfterFunc(2*settle, func() {
+					in.Set(1 - pressed)
+				})
+			default:
+				log.Printf("%s", simulate_help)
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,234 @@
+package access
+
+// The queue of access events that couldn't be reported to intweb.
+//
+// Every badge scan is sent to intweb as an access request, even when
+// the cache or the offline allowlist decides it, so that intweb logs
+// it.  If that request fails, the event goes in this queue (kept in
+// Config.StateDir, so that it survives a restart), and is replayed
+// later with its original time (see intweb.Session.AccessAt), backing
+// off while intweb is still down.
+//
+// The queue file is only written every few seconds (from the main
+// loop; see flush_events) and after each replay, not for every event,
+// since it may hold thousands of them and sits on an SD card.
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+const (
+	// Name of the queue's state file:
+	event_queue_state = "event_queue"
+	// Most events to keep; past this, the oldest are dropped:
+	event_queue_max = 10000
+	// Time to wait before replaying, and after a failure, which doubles
+	// on every further failure up to event_retry_max:
+	event_retry_min = 10 * time.Second
+	event_retry_max = 10 * time.Minute
+)
+
+// queuedEvent is an access event that wasn't reported.
+type queuedEvent struct {
+	Badge intweb.Badge `json:"badge"`
+	// When the badge was scanned:
+	At time.Time `json:"at"`
+}
+
+// savedEventQueue is the content of the queue file.
+type savedEventQueue struct {
+	Events []queuedEvent `json:"events"`
+}
+
+// eventQueue is the queue.  Events are added from the main loop and
+// from background access checks, and replayed in their own goroutine,
+// so everything is guarded by 'mu'.
+type eventQueue struct {
+	mu sync.Mutex
+	events []queuedEvent
+	// True if 'events' has changed since the queue file was written:
+	dirty bool
+	// Signalled (without blocking) when an event is added:
+	added chan struct{}
+}
+
+// load_events reads the queue file, if there is one.
+func (ctx *ServerCtx) load_events() *eventQueue {
+	q := &eventQueue{added: make(chan struct{}, 1)}
+
+	var saved savedEventQueue
+	ok, err := ctx.load_state(event_queue_state, &saved, ctx.CacheEncrypt)
+	if err != nil {
+		log.Printf("Error loading event queue: %s", err)
+	}
+	if ok && len(saved.Events) > 0 {
+		q.events = saved.Events
+		log.Printf("Loaded %d unreported access events", len(q.events))
+	}
+	return q
+}
+
+// save_events writes the queue file, if the queue has changed since
+// it was last written.  ctx.events.mu must be held.
+func (ctx *ServerCtx) save_events() {
+	q := ctx.events
+	if !q.dirty {
+		return
+	}
+	saved := savedEventQueue{Events: q.events}
+	if err := ctx.save_state(event_queue_state, saved, ctx.CacheEncrypt); err != nil {
+		log.Printf("Error saving event queue: %s", err)
+		return
+	}
+	q.dirty = false
+}
+
+// flush_events writes the queue file if it needs it (see save_events).
+func (ctx *ServerCtx) flush_events() {
+	q := ctx.events
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	ctx.save_events()
+}
+
+// unreported returns true if 'err', from an access request, means that
+// intweb couldn't be reached and so never saw it, and so the event
+// should be queued.  (If the request may have reached intweb, it isn't
+// queued, so that intweb doesn't log it twice.)
+func unreported(err error) bool {
+	return intweb.IsNetworkError(err) && !intweb.IsMaybeDelivered(err)
+}
+
+// queue_event adds an access event for 'badge' (scanned at 'at') that
+// couldn't be reported to intweb.
+func (ctx *ServerCtx) queue_event(badge intweb.Badge, at time.Time) {
+	q := ctx.events
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.events = append(q.events, queuedEvent{Badge: badge, At: at})
+	if len(q.events) > event_queue_max {
+		drop := len(q.events) - event_queue_max
+		log.Printf("Event queue is full, dropping %d oldest events", drop)
+		q.events = append([]queuedEvent(nil), q.events[drop:]...)
+	}
+	log.Printf("Queued access event for badge %s (%d unreported)",
+		badge, len(q.events))
+	q.dirty = true
+
+	select {
+	case q.added <- struct{}{}:
+	default:
+	}
+}
+
+// queued_events returns the number of events in the queue.
+func (ctx *ServerCtx) queued_events() int {
+	q := ctx.events
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.events)
+}
+
+// replay_events replays queued events to intweb through 's', until
+// 'run_ctx' is cancelled.
+func (ctx *ServerCtx) replay_events(run_ctx context.Context, s *intweb.Session) {
+	defer ctx.running.Done()
+
+	delay := event_retry_min
+	for {
+		// Wait for there to be anything to replay:
+		if ctx.queued_events() == 0 {
+			delay = event_retry_min
+			select {
+			case <-ctx.events.added:
+				continue
+			case <-run_ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-run_ctx.Done():
+			return
+		}
+
+		if ctx.replay_queued(run_ctx, s) {
+			delay = event_retry_min
+		} else {
+			delay *= 2
+			if delay > event_retry_max {
+				delay = event_retry_max
+			}
+			log.Printf("replay_events: Retrying in %s", delay)
+		}
+	}
+}
+
+// replay_queued replays events, oldest first, until the queue is empty
+// (returning true) or intweb can't be reached (returning false).  An
+// event that intweb replies to with an error is dropped, rather than
+// holding up everything after it, as is one that may have reached
+// intweb without a reply (see intweb.IsMaybeDelivered), since intweb
+// would log it again.  The queue file is written once, at the end.
+func (ctx *ServerCtx) replay_queued(run_ctx context.Context, s *intweb.Session) bool {
+	q := ctx.events
+	defer ctx.flush_events()
+	for run_ctx.Err() == nil {
+		q.mu.Lock()
+		if len(q.events) == 0 {
+			q.mu.Unlock()
+			return true
+		}
+		ev := q.events[0]
+		q.mu.Unlock()
+
+		// This doesn't hold q.mu, so that new events can still be
+		// queued meanwhile (after this one):
+		access, err := replay_event(run_ctx, s, ctx.IntwebItem, ev)
+
+		// If intweb couldn't be reached, or something else answered in
+		// its place, keep the event for later:
+		maybe := intweb.IsMaybeDelivered(err)
+		if err != nil && !maybe && (intweb.IsNetworkError(err) || intweb.IsAuthError(err)) {
+			log_intweb_error("replay_events: Can't reach intweb", err)
+			return false
+		}
+		if maybe {
+			// This may have reached intweb, so replaying it again
+			// could log it twice:
+			log_intweb_error("replay_events: Can't reach intweb", err)
+			log.Printf("replay_events: Dropping badge %s from %s, which intweb may have received",
+				ev.Badge, ev.At.Format(time.RFC3339))
+		} else if err != nil {
+			log.Printf("replay_events: Dropping badge %s from %s, which intweb rejected: %s",
+				ev.Badge, ev.At.Format(time.RFC3339), err)
+		} else {
+			log.Printf("replay_events: Reported badge %s from %s (intweb says access %t)",
+				ev.Badge, ev.At.Format(time.RFC3339), access)
+		}
+
+		q.mu.Lock()
+		q.events = q.events[1:]
+		q.dirty = true
+		q.mu.Unlock()
+		if maybe {
+			return false
+		}
+	}
+	return false
+}
+
+// replay_event sends one queued event to intweb.
+func replay_event(run_ctx context.Context, s *intweb.Session, item string,
+	ev queuedEvent) (bool, error) {
+
+	access, _, err := s.AccessAtContext(run_ctx, item, ev.Badge, ev.At)
+	return access, err
+}
@@ -0,0 +1,242 @@
+package access
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+var test_device_key = []byte("device key")
+
+// fakeIntweb is an intweb server which allows any badge but "666" (which
+// it replies to with an error), and records every access request.
+type fakeIntweb struct {
+	mu sync.Mutex
+	// Badges and timestamps of access requests, in order:
+	badges []intweb.Badge
+	times []int64
+	// If true, reply to access requests with HTTP 500:
+	fail bool
+}
+
+func (f *fakeIntweb) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Data struct {
+			Operation string `json:"operation"`
+			RandomResponse []int `json:"random_response"`
+			Badge intweb.Badge `json:"badge"`
+			Timestamp int64 `json:"timestamp"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := map[string]interface{}{
+		"response": true,
+		"nonce_valid": true,
+		"new_nonce": "nonce",
+		"random_response": req.Data.RandomResponse,
+		"error": "",
+	}
+	if req.Data.Operation == "access" {
+		f.mu.Lock()
+		f.badges = append(f.badges, req.Data.Badge)
+		f.times = append(f.times, req.Data.Timestamp)
+		fail := f.fail
+		f.mu.Unlock()
+		if fail {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		if req.Data.Badge == "666" {
+			fmt.Fprint(w, `{"response": false, "data": "Unknown badge"}`)
+			return
+		}
+		data["access"] = true
+	}
+	// (Marshalling a map sorts its keys, as verify_checksum allows.)
+	data_json, _ := json.Marshal(data)
+	sum := sha512.Sum512(append(append([]byte(nil), test_device_key...), data_json...))
+	fmt.Fprintf(w, `{"response": true, "data": %s, "checksum": "%X"}`, data_json, sum)
+}
+
+// requests returns the badges of all access requests so far.
+func (f *fakeIntweb) requests() []intweb.Badge {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]intweb.Badge(nil), f.badges...)
+}
+
+// new_events returns a ServerCtx with an empty event queue, kept in a
+// temporary StateDir, and a function to remove that at the end of the
+// test.
+func new_events(t *testing.T) (*ServerCtx, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerCtx{Config: &Config{
+		StateDir: dir,
+		IntwebItem: "door",
+		IntwebDeviceKey: test_device_key,
+	}}
+	ctx.events = ctx.load_events()
+	return ctx, func() { os.RemoveAll(dir) }
+}
+
+// new_session returns a Session for 'url'.
+func new_session(url string) *intweb.Session {
+	return &intweb.Session{
+		Device: "test",
+		DeviceKey: test_device_key,
+		URLs: []string{url},
+		Client: &http.Client{Timeout: time.Second},
+	}
+}
+
+// check_queue fails the test unless the queued events are for 'badges'.
+func check_queue(t *testing.T, ctx *ServerCtx, badges ...intweb.Badge) {
+	t.Helper()
+	ctx.events.mu.Lock()
+	defer ctx.events.mu.Unlock()
+	var got []intweb.Badge
+	for _, ev := range ctx.events.events {
+		got = append(got, ev.Badge)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(badges) {
+		t.Fatalf("Queue has %v, expected %v", got, badges)
+	}
+}
+
+func TestUnreported(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	tests := []struct {
+		name string
+		err error
+		queue bool
+	}{
+		{"no error", nil, false},
+		{"refused", refused, true},
+		{"breaker open", &intweb.BreakerOpenError{}, true},
+		{"maybe delivered",
+			&intweb.MaybeDeliveredError{Err: &intweb.Error{HTTPStatus: 500}}, false},
+		{"wrapped maybe delivered",
+			fmt.Errorf("access: %w", &intweb.MaybeDeliveredError{Err: refused}), false},
+		{"denied", &intweb.Error{Msg: "Unknown badge"}, false},
+		{"auth", &intweb.AuthError{Msg: "Checksum is wrong"}, false},
+	}
+	for _, test := range tests {
+		if got := unreported(test.err); got != test.queue {
+			t.Errorf("%s: unreported is %t, expected %t", test.name, got, test.queue)
+		}
+	}
+}
+
+func TestEventQueueSaved(t *testing.T) {
+	ctx, cleanup := new_events(t)
+	defer cleanup()
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx.queue_event("1", at)
+	ctx.queue_event("2", at.Add(time.Minute))
+	ctx.flush_events()
+
+	ctx.events = ctx.load_events()
+	check_queue(t, ctx, "1", "2")
+	if ev := ctx.events.events[1]; !ev.At.Equal(at.Add(time.Minute)) {
+		t.Errorf("Event time loaded as %s", ev.At)
+	}
+}
+
+func TestEventQueueMax(t *testing.T) {
+	ctx, cleanup := new_events(t)
+	defer cleanup()
+
+	for i := 0; i < event_queue_max + 5; i++ {
+		ctx.queue_event(intweb.BadgeNumber(uint64(i)), time.Now())
+	}
+	if n := ctx.queued_events(); n != event_queue_max {
+		t.Fatalf("Queue has %d events", n)
+	}
+	if b := ctx.events.events[0].Badge; b != intweb.BadgeNumber(5) {
+		t.Errorf("Oldest event is badge %s", b)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	ctx, cleanup := new_events(t)
+	defer cleanup()
+	f := &fakeIntweb{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ctx.queue_event("1", at)
+	ctx.queue_event("666", at)
+	ctx.queue_event("2", at.Add(time.Minute))
+
+	if !ctx.replay_queued(context.Background(), new_session(srv.URL)) {
+		t.Fatal("Replay didn't finish")
+	}
+	// (The event that intweb rejected is dropped, not retried.)
+	check_queue(t, ctx)
+	if got := fmt.Sprint(f.requests()); got != "[1 666 2]" {
+		t.Errorf("intweb got %s", got)
+	}
+	if f.times[2] != at.Add(time.Minute).Unix() {
+		t.Errorf("Replayed with timestamp %d", f.times[2])
+	}
+
+	// The queue file is written after replaying:
+	ctx.events = ctx.load_events()
+	check_queue(t, ctx)
+}
+
+func TestReplayDown(t *testing.T) {
+	ctx, cleanup := new_events(t)
+	defer cleanup()
+	srv := httptest.NewServer(&fakeIntweb{})
+	url := srv.URL
+	srv.Close()
+
+	ctx.queue_event("1", time.Now())
+	ctx.queue_event("2", time.Now())
+	if ctx.replay_queued(context.Background(), new_session(url)) {
+		t.Fatal("Replay finished with intweb down")
+	}
+	check_queue(t, ctx, "1", "2")
+}
+
+// An event whose replay may have reached intweb is dropped, so that
+// intweb doesn't log it twice, and replaying backs off.
+func TestReplayMaybeDelivered(t *testing.T) {
+	ctx, cleanup := new_events(t)
+	defer cleanup()
+	f := &fakeIntweb{fail: true}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	ctx.queue_event("1", time.Now())
+	ctx.queue_event("2", time.Now())
+	if ctx.replay_queued(context.Background(), new_session(srv.URL)) {
+		t.Fatal("Replay finished with intweb failing")
+	}
+	check_queue(t, ctx, "2")
+	if got := fmt.Sprint(f.requests()); got != "[1]" {
+		t.Errorf("intweb got %s", got)
+	}
+}
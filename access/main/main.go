@@ -4,18 +4,38 @@ package main
 // configuration, but is not responsible for any of the actual logic.
 
 import (
+	"encoding/hex"
 	"log"
 	"time"
 	
 	"github.com/spf13/cobra"
 
 	"hive13/rfid/access"
+	"hive13/rfid/osdp"
 )
 
 var cfg *access.Config
 var device_key string
 var hold_msec int
+var min_hold_msec int
+var lock_pulse_msec int
+var lock_max_energise_msec int
 var cache_hours int
+var allowlist_min int
+var allowlist_max_age_hours int
+var intweb_timeout_sec int
+var intweb_retry_delay_msec int
+var intweb_breaker_cooldown_sec int
+var wiegand_gap_msec int
+var wiegand_timeout_msec int
+var pin_timeout_sec int
+var sensor_settle_msec int
+var rex_settle_msec int
+var rex_hold_msec int
+var held_open_sec int
+var forced_grace_msec int
+var forced_delay_msec int
+var osdp_key string
 
 func main() {
 	if err := rootCmd.Execute(); err != nil {
@@ -38,9 +58,37 @@ var rootCmd = &cobra.Command{
 		// fine but Cobra can't read bytestrings or durations directly):
 		cfg.IntwebDeviceKey = []byte(device_key)
 		cfg.LockHoldTime = time.Duration(hold_msec) * time.Millisecond
+		cfg.LockMinHoldTime = time.Duration(min_hold_msec) * time.Millisecond
+		cfg.LockPulseTime = time.Duration(lock_pulse_msec) * time.Millisecond
+		cfg.AllowlistInterval = time.Duration(allowlist_min) * time.Minute
+		cfg.AllowlistMaxAge = time.Duration(allowlist_max_age_hours) * time.Hour
+		cfg.IntwebTimeout = time.Duration(intweb_timeout_sec) * time.Second
+		cfg.IntwebRetryDelay = time.Duration(intweb_retry_delay_msec) * time.Millisecond
+		cfg.IntwebBreakerCooldown = time.Duration(intweb_breaker_cooldown_sec) * time.Second
+		cfg.LockMaxEnergise = time.Duration(lock_max_energise_msec) * time.Millisecond
 		cfg.BadgeCacheTime = time.Duration(cache_hours) * time.Hour
+		cfg.WiegandBitGap = time.Duration(wiegand_gap_msec) * time.Millisecond
+		cfg.WiegandFrameTimeout = time.Duration(wiegand_timeout_msec) * time.Millisecond
+		cfg.PinTimeout = time.Duration(pin_timeout_sec) * time.Second
+		cfg.SensorSettle = time.Duration(sensor_settle_msec) * time.Millisecond
+		cfg.RexSettle = time.Duration(rex_settle_msec) * time.Millisecond
+		cfg.RexHoldTime = time.Duration(rex_hold_msec) * time.Millisecond
+		cfg.HeldOpenTime = time.Duration(held_open_sec) * time.Second
+		cfg.ForcedGrace = time.Duration(forced_grace_msec) * time.Millisecond
+		cfg.ForcedDelay = time.Duration(forced_delay_msec) * time.Millisecond
+		switch osdp_key {
+		case "":
+		case "default":
+			cfg.OsdpKey = osdp.DefaultSCBK
+		default:
+			key, err := hex.DecodeString(osdp_key)
+			if err != nil || len(key) != 16 {
+				log.Fatalf("--osdp-key must be 32 hex digits or 'default'")
+			}
+			cfg.OsdpKey = key
+		}
 		
-		log.Printf("%+v", cfg)
+		log.Printf("%+v", cfg.Redacted())
 
 		// We have a configuration. Go run the server.
 		access.Run(cfg)
@@ -53,10 +101,28 @@ func init() {
 
 	rootCmd.PersistentFlags().StringVar(&cfg.GpioDev, "gpio", "gpiochip0",
 		"GPIO character device, e.g. gpiochip0 for /dev/gpiochip0")
+	rootCmd.PersistentFlags().StringArrayVar(&cfg.Readers, "reader", []string{},
+		"Badge reader as type[,key=value...], e.g. 'wiegand', 'osdp,address=1', 'evdev,name=desk,device=/dev/input/event0', 'stream,path=/run/badges'; may be repeated (default: one Wiegand reader)")
 	rootCmd.PersistentFlags().IntVar(&cfg.PinD0, "d0", 17,
 		"BCM/GPIO input pin number for badge reader's Wiegand D0 pin")
 	rootCmd.PersistentFlags().IntVar(&cfg.PinD1, "d1", 18,
 		"BCM/GPIO input pin number for badge reader's Wiegand D1 pin")
+	rootCmd.PersistentFlags().StringSliceVar(&cfg.WiegandFormats, "formats",
+		[]string{"H10301"},
+		"Comma-separated Wiegand formats to accept (H10301, H10306, H10304, C1K35, C1K48)")
+	rootCmd.PersistentFlags().IntVar(&wiegand_gap_msec, "wiegand-gap", 10,
+		"Longest time in milliseconds between bits of one Wiegand frame")
+	rootCmd.PersistentFlags().IntVar(&wiegand_timeout_msec, "wiegand-timeout", 25,
+		"Time in milliseconds after the last bit before a Wiegand frame is handled")
+	rootCmd.PersistentFlags().StringVar(&cfg.OsdpDevice, "osdp-device",
+		"/dev/ttyUSB0", "Serial device for OSDP reader")
+	rootCmd.PersistentFlags().IntVar(&cfg.OsdpBaud, "osdp-baud", 9600,
+		"Baud rate for OSDP reader")
+	rootCmd.PersistentFlags().IntVar(&cfg.OsdpAddress, "osdp-address", 0,
+		"OSDP address of reader")
+	// This needs conversion to []byte:
+	rootCmd.PersistentFlags().StringVar(&osdp_key, "osdp-key", "",
+		"OSDP secure channel key as 32 hex digits, or 'default' for the default key; if empty, don't use secure channel")
 	rootCmd.PersistentFlags().IntVar(&cfg.PinBeeper, "beeper", 26,
 		"BCM/GPIO output pin number for badge reader's beeper pin")
 	rootCmd.PersistentFlags().IntVar(&cfg.PinLED, "led", 16,
@@ -65,19 +131,77 @@ func init() {
 		"BCM/GPIO input pin number for door sensor; if -1, disable")
 	rootCmd.PersistentFlags().BoolVar(&cfg.SensorPolarity, "polarity", true,
 		"If true, open door = sensor high, closed = low. If false, open = low, closed = high.")
+	rootCmd.PersistentFlags().IntVar(&sensor_settle_msec, "sensor-settle", 300,
+		"Time in milliseconds the door sensor must be stable before its state counts")
+	rootCmd.PersistentFlags().IntVar(&cfg.PinRex, "rex", -1,
+		"BCM/GPIO input pin number for request-to-exit button or sensor; if -1, disable")
+	rootCmd.PersistentFlags().BoolVar(&cfg.RexPolarity, "rex-polarity", true,
+		"If true, REX pressed = high. If false, pressed = low.")
+	rootCmd.PersistentFlags().IntVar(&rex_settle_msec, "rex-settle", 50,
+		"Time in milliseconds the REX input must be stable before its state counts")
+	rootCmd.PersistentFlags().IntVar(&rex_hold_msec, "rex-hold", 5000,
+		"Time in milliseconds for which to hold lock open after a REX press")
 
 	rootCmd.PersistentFlags().IntVar(&cfg.PinLock, "lock", 24,
 		"BCM/GPIO output pin number to control door lock/latch")
+	rootCmd.PersistentFlags().StringVar(&cfg.LockMode, "lock-mode", "fail-secure",
+		"How the lock works: 'fail-secure' (energise to unlock, e.g. a strike), 'fail-safe' or 'maglock' (energise to lock), or 'pulse' (energise briefly to unlock)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.LockActiveLow, "lock-active-low", false,
+		"If true, the lock pin is low to energise the lock (e.g. an active-low relay)")
+	rootCmd.PersistentFlags().IntVar(&lock_pulse_msec, "lock-pulse", 500,
+		"With --lock-mode=pulse, time in milliseconds to energise the lock to unlock it")
+	rootCmd.PersistentFlags().IntVar(&lock_max_energise_msec, "lock-max-energise", 0,
+		"Longest time in milliseconds to energise the lock to unlock it; if 0, no limit")
+	rootCmd.PersistentFlags().IntVar(&cfg.PinLockSense, "lock-sense", -1,
+		"BCM/GPIO input pin number for a contact showing the lock is locked, checked at startup and shutdown; if -1, disable (and then those checks only catch errors setting the lock pin)")
+	rootCmd.PersistentFlags().BoolVar(&cfg.LockSensePolarity, "lock-sense-polarity", true,
+		"If true, locked = lock-sense high. If false, locked = low.")
 
 	rootCmd.PersistentFlags().IntVar(&hold_msec, "hold", 3000,
 		"Time in milliseconds for which to hold lock open")
+	rootCmd.PersistentFlags().BoolVar(&cfg.RelockOnClose, "relock-on-close", false,
+		"Close the lock as soon as the door sensor shows the door opened and closed again, rather than after --hold")
+	rootCmd.PersistentFlags().IntVar(&min_hold_msec, "min-hold", 1000,
+		"With --relock-on-close, least time in milliseconds to hold lock open")
+	rootCmd.PersistentFlags().IntVar(&held_open_sec, "held-open", 0,
+		"Time in seconds the door may stay open (per the sensor) before an alarm; if 0, no alarm")
+	rootCmd.PersistentFlags().BoolVar(&cfg.ForcedEntry, "forced-entry", false,
+		"Raise an alarm if the door sensor shows the door opening while locked")
+	rootCmd.PersistentFlags().IntVar(&forced_grace_msec, "forced-grace", 2000,
+		"Time in milliseconds after the lock closes that the door may still open without a forced-entry alarm")
+	rootCmd.PersistentFlags().IntVar(&forced_delay_msec, "forced-delay", 0,
+		"Time in milliseconds that a door opened while locked may stay open (or until an unlock or REX) before a forced-entry alarm")
+
+	rootCmd.PersistentFlags().StringVar(&cfg.BadgeEncoding, "badge-encoding",
+		"combined",
+		"Badge number to send to intweb: 'combined' (facility code & card number as one number), 'card' (card number only), or 'fc:cn'")
+	rootCmd.PersistentFlags().UintSliceVar(&cfg.FacilityCodes, "facility",
+		[]uint{}, "Comma-separated facility codes to allow; if empty, allow any")
+
+	rootCmd.PersistentFlags().StringVar(&cfg.PinFile, "pin-file", "",
+		"File of badge PIN hashes; if given, require a PIN on the keypad after each badge")
+	rootCmd.PersistentFlags().IntVar(&pin_timeout_sec, "pin-timeout", 10,
+		"Time in seconds allowed to enter a PIN after scanning a badge")
 
 	rootCmd.PersistentFlags().IntVar(&cache_hours, "cache-time", 96,
 		"Time in hours to keep a badge in cache")
+
+	rootCmd.PersistentFlags().StringArrayVar(&cfg.Schedule, "schedule",
+		[]string{}, "When to hold the door unlocked, e.g. 'mon-fri 18:00-22:00' or '2026-12-24/2026-12-26'; may be repeated")
+	rootCmd.PersistentFlags().StringVar(&cfg.StateDir, "state-dir",
+		"/var/lib/door_access", "Directory for state kept across restarts; if empty, keep nothing")
+	rootCmd.PersistentFlags().BoolVar(&cfg.CacheEncrypt, "cache-encrypt", false,
+		"Encrypt the badge cache, allowlist, and event queue in --state-dir with a key derived from the device key")
+	rootCmd.PersistentFlags().StringVar(&cfg.AllowlistSource, "allowlist",
+		"", "Where to sync the offline allowlist from: 'intweb', 'file:PATH', or an https:// URL; if empty, no allowlist")
+	rootCmd.PersistentFlags().IntVar(&allowlist_min, "allowlist-interval", 60,
+		"Time in minutes between allowlist syncs; if 0, the default (60)")
+	rootCmd.PersistentFlags().IntVar(&allowlist_max_age_hours, "allowlist-max-age", 168,
+		"Time in hours after the last sync that the allowlist stops being used; if 0, no limit")
 	
-	rootCmd.PersistentFlags().StringVar(&cfg.IntwebURL, "url",
-		"https://intweb.at.hive13.org/api/access",
-		"URL of intweb server, including /api/access")
+	rootCmd.PersistentFlags().StringArrayVar(&cfg.IntwebURLs, "url",
+		[]string{"https://intweb.at.hive13.org/api/access"},
+		"URL of intweb server, including /api/access; may be repeated, to fail over between them in order")
 	rootCmd.PersistentFlags().StringVar(&cfg.IntwebDevice, "device",
 		"", "intweb device name (required)")
 	rootCmd.MarkPersistentFlagRequired("device")
@@ -88,6 +212,18 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfg.IntwebItem, "item",
 		"", "intweb item to attempt to access (required)")
 	rootCmd.MarkPersistentFlagRequired("item")
+	rootCmd.PersistentFlags().BoolVar(&cfg.IntwebStrict, "intweb-strict",
+		false, "Also refuse intweb failure replies without a checksum (successful replies always need one)")
+	rootCmd.PersistentFlags().IntVar(&intweb_timeout_sec, "intweb-timeout",
+		15, "Longest time in seconds to wait on intweb for a badge, including retries")
+	rootCmd.PersistentFlags().IntVar(&cfg.IntwebAttempts, "intweb-attempts",
+		2, "Times to try an intweb request that fails to reach it")
+	rootCmd.PersistentFlags().IntVar(&intweb_retry_delay_msec, "intweb-retry-delay",
+		500, "Time in milliseconds before retrying an intweb request (doubling for each retry)")
+	rootCmd.PersistentFlags().IntVar(&cfg.IntwebBreakerFailures, "intweb-breaker",
+		3, "Number of intweb requests in a row that fail to reach it before it isn't tried for a while; if 0, always try it")
+	rootCmd.PersistentFlags().IntVar(&intweb_breaker_cooldown_sec, "intweb-breaker-cooldown",
+		30, "Time in seconds not to try intweb after --intweb-breaker failures")
 	
 	rootCmd.PersistentFlags().StringVar(&cfg.ListenAddr, "addr",
 		":9000", "Address for HTTP server to listen on")
@@ -98,6 +234,14 @@ func init() {
 		"door/sensor", "MQTT topic to publish door sensor readings")
 	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.TopicBadge, "topic-badge",
 		"door/badge", "MQTT topic to publish badge scans")
+	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.TopicTamper, "topic-tamper",
+		"door/tamper", "MQTT topic to publish badge reader tamper reports")
+	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.TopicAlarm, "topic-alarm",
+		"door/alarm", "MQTT topic to publish door alarms")
+	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.TopicRex, "topic-rex",
+		"door/rex", "MQTT topic to publish request-to-exit presses")
+	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.TopicCommand, "topic-command",
+		"", "MQTT topic to receive commands (e.g. unlock_until); if empty, don't")
 	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.Username, "mqtt-username",
 		"", "Username for MQTT")
 	rootCmd.PersistentFlags().StringVar(&cfg.Mqtt.Password, "mqtt-password",
@@ -107,4 +251,8 @@ func init() {
 	
 	rootCmd.PersistentFlags().BoolVarP(&cfg.Verbose, "verbose", "v",
 		false, "Enable more verbose logging")
+	rootCmd.PersistentFlags().BoolVar(&cfg.DryRun, "dry-run", false,
+		"Log lock, beeper, and LED actions instead of driving GPIO")
+	rootCmd.PersistentFlags().BoolVar(&cfg.Simulate, "simulate", false,
+		"Dry run with no GPIO at all; read badges and door events from stdin")
 }
@@ -0,0 +1,189 @@
+package access
+
+// Local PIN storage for badge-plus-PIN mode.
+//
+// The PIN file has one badge per line: the badge number (exactly as
+// sent to intweb), whitespace, then the hash from HashPin. Blank lines
+// and lines starting with '#' are ignored.
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"hive13/rfid/intweb"
+)
+
+const (
+	// Prefix on every hash from HashPin:
+	pin_hash_scheme = "pbkdf2-sha256"
+	// PBKDF2 iterations for new hashes. (This is low by modern
+	// standards, but it has to run on a Pi Zero while someone waits at
+	// the door, and a short PIN is easy to brute-force anyway.)
+	pin_hash_iter = 10000
+	pin_salt_len  = 16
+)
+
+// pbkdf2_sha256 is PBKDF2 with HMAC-SHA256, for a single block of
+// output (32 bytes).
+func pbkdf2_sha256(password []byte, salt []byte, iter int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	var block [4]byte
+	binary.BigEndian.PutUint32(block[:], 1)
+	mac.Write(block[:])
+	u := mac.Sum(nil)
+
+	t := make([]byte, len(u))
+	copy(t, u)
+	for i := 1; i < iter; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range t {
+			t[j] ^= u[j]
+		}
+	}
+	return t
+}
+
+// HashPin returns a salted hash of 'pin', suitable for the PIN file.
+func HashPin(pin string) (string, error) {
+	salt := make([]byte, pin_salt_len)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	hash := pbkdf2_sha256([]byte(pin), salt, pin_hash_iter)
+	return fmt.Sprintf("%s$%d$%x$%x", pin_hash_scheme, pin_hash_iter, salt, hash), nil
+}
+
+// CheckPin returns true if 'pin' matches 'hash' (from HashPin).
+func CheckPin(hash string, pin string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != pin_hash_scheme {
+		return false
+	}
+	iter, err := strconv.Atoi(parts[1])
+	if err != nil || iter < 1 {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expect, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expect, pbkdf2_sha256([]byte(pin), salt, iter))
+}
+
+// LoadPins reads the PIN file at 'path'. It returns a map from badge
+// to PIN hash.
+func LoadPins(path string) (map[intweb.Badge]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pins := make(map[intweb.Badge]string)
+	scanner := bufio.NewScanner(f)
+	line_num := 0
+	for scanner.Scan() {
+		line_num += 1
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], pin_hash_scheme+"$") {
+			return nil, fmt.Errorf("%s:%d: expected badge and PIN hash", path, line_num)
+		}
+		pins[intweb.Badge(fields[0])] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+// await_pin starts waiting for the PIN for 'badge' (replacing any
+// other badge that was waiting).
+func (ctx *ServerCtx) await_pin(badge intweb.Badge) {
+	log.Printf("await_pin: Waiting %s for PIN for badge %s", ctx.PinTimeout, badge)
+	ctx.pin_entry.Clear()
+	ctx.pin_badge = badge
+	ctx.pin_deadline = time.Now().Add(ctx.PinTimeout)
+
+	// Short beep to prompt for the PIN:
+	go func() {
+		ctx.Beep.SetValue(0)
+		<-time.After(100 * time.Millisecond)
+		ctx.Beep.SetValue(1)
+	}()
+}
+
+// expire_pin stops waiting for a PIN if PinTimeout has passed.
+func (ctx *ServerCtx) expire_pin() {
+	if ctx.pin_badge == "" || time.Now().Before(ctx.pin_deadline) {
+		return
+	}
+	badge := ctx.pin_badge
+	ctx.pin_badge = ""
+	ctx.pin_entry.Clear()
+	ctx.handle_access(false, badge, "timed out waiting for PIN")
+}
+
+// handle_key handles a key press from the reader's keypad.  When a PIN
+// is submitted for a badge that is waiting on one, this checks the
+// PIN, and if it matches, goes on to handle_badge.
+func (ctx *ServerCtx) handle_key(run_ctx context.Context, s *intweb.Session,
+	key rune, cache_expire chan<- intweb.Badge) {
+
+	if ctx.Pins == nil {
+		if ctx.Verbose {
+			log.Printf("handle_key: Not in badge-plus-PIN mode, ignoring key")
+		}
+		return
+	}
+
+	pin, submitted := ctx.pin_entry.Key(key)
+	if !submitted {
+		return
+	}
+
+	ctx.expire_pin()
+	badge := ctx.pin_badge
+	if badge == "" {
+		log.Printf("handle_key: PIN entered, but no badge is waiting for one")
+		return
+	}
+	ctx.pin_badge = ""
+
+	hash, ok := ctx.Pins[badge]
+	if !ok {
+		ctx.handle_access(false, badge, "no PIN set for badge")
+		return
+	}
+	if !CheckPin(hash, pin) {
+		ctx.handle_access(false, badge, "wrong PIN")
+		return
+	}
+
+	log.Printf("handle_key: PIN OK for badge %s", badge)
+	_, err := ctx.handle_badge(run_ctx, s, badge, cache_expire)
+	if err != nil {
+		log.Printf("%+v", err)
+	}
+}
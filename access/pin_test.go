@@ -0,0 +1,88 @@
+package access
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// PBKDF2-HMAC-SHA256 test vectors (from RFC 7914, and widely used):
+func TestPbkdf2(t *testing.T) {
+	tests := []struct {
+		iter int
+		want string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{2, "ae4d0c95af6b46d32d0adff928f06dd02a303f8ef3c251dfd6e2d85a95474c43"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, test := range tests {
+		got := hex.EncodeToString(pbkdf2_sha256([]byte("password"), []byte("salt"), test.iter))
+		if got != test.want {
+			t.Errorf("%d iterations: %s", test.iter, got)
+		}
+	}
+}
+
+func TestHashPin(t *testing.T) {
+	hash, err := HashPin("1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, pin_hash_scheme + "$") {
+		t.Errorf("Hash %q has the wrong scheme", hash)
+	}
+	if !CheckPin(hash, "1234") {
+		t.Error("Right PIN refused")
+	}
+	for _, pin := range []string{"", "123", "12345", "4321"} {
+		if CheckPin(hash, pin) {
+			t.Errorf("Wrong PIN %q accepted", pin)
+		}
+	}
+
+	// Salted, so the same PIN hashes differently:
+	if hash2, _ := HashPin("1234"); hash2 == hash {
+		t.Error("Same hash twice")
+	}
+
+	for _, bad := range []string{"", "1234", "md5$1$00$00", pin_hash_scheme + "$0$00$00",
+		pin_hash_scheme + "$x$00$00", pin_hash_scheme + "$1$zz$00"} {
+		if CheckPin(bad, "1234") {
+			t.Errorf("Bad hash %q accepted", bad)
+		}
+	}
+}
+
+func TestLoadPins(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pins")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hash, _ := HashPin("1234")
+
+	path := filepath.Join(dir, "pins")
+	text := "# Members\n\n12345  " + hash + "\n"
+	if err := ioutil.WriteFile(path, []byte(text), 0600); err != nil {
+		t.Fatal(err)
+	}
+	pins, err := LoadPins(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pins) != 1 || !CheckPin(pins["12345"], "1234") {
+		t.Errorf("Loaded %v", pins)
+	}
+
+	// A plain PIN isn't a hash:
+	if err := ioutil.WriteFile(path, []byte("12345 1234\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPins(path); err == nil {
+		t.Error("Loaded a plain PIN")
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+// Utility to produce a line for the PIN file used in badge-plus-PIN
+// mode (see access.LoadPins).  The badge number is given as the only
+// argument; the PIN is read from stdin so that it does not end up in
+// shell history.
+//
+// Example: ./pinhash 12345678 >> /etc/door_access.pins
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"hive13/rfid/access"
+)
+
+func main() {
+	if len(os.Args) != 2 {
+		log.Fatalf("Usage: %s <badge number>  (PIN is read from stdin)", os.Args[0])
+	}
+	badge := os.Args[1]
+
+	fmt.Fprintf(os.Stderr, "PIN: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		log.Fatal(err)
+	}
+	pin := strings.TrimSpace(line)
+	for _, c := range pin {
+		if c < '0' || c > '9' {
+			log.Fatal("PIN must be digits only")
+		}
+	}
+	if pin == "" {
+		log.Fatal("PIN is empty")
+	}
+
+	hash, err := access.HashPin(pin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%s %s\n", badge, hash)
+}
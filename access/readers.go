@@ -0,0 +1,227 @@
+package access
+
+// Setting up badge readers from Config.Readers.
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"hive13/rfid/cardreader"
+	"hive13/rfid/gpio"
+	"hive13/rfid/osdp"
+	"hive13/rfid/wiegand"
+)
+
+// tamperEvent is a tamper report from an OSDP reader.
+type tamperEvent struct {
+	// Name of the reader:
+	source string
+	tamper bool
+}
+
+// readerSet is every badge reader opened from Config.Readers.
+type readerSet struct {
+	list []cardreader.CardReader
+	// OSDP readers, which have their own beeper and LED:
+	osdp []*osdp.Reader
+	// True if any reader is Wiegand (and so uses the beeper and LED
+	// pins):
+	wiegand bool
+	// Names of readers whose badges aren't checked against
+	// Config.FacilityCodes (see facility_option):
+	skip_facility map[string]bool
+}
+
+// Values for the "facility" option, which every type of reader has:
+const (
+	// Badges from the reader are checked against FacilityCodes (the
+	// default):
+	facility_check = "check"
+	// They aren't, e.g. for a desk reader that only types the card
+	// number, so that intweb alone decides:
+	facility_skip = "skip"
+)
+
+// facility_option returns true if 'spec' has facility=skip, and then
+// removes the option (so that each type doesn't have to allow it).
+func facility_option(spec cardreader.Spec) (bool, error) {
+	v := spec.Option("facility", facility_check)
+	delete(spec.Options, "facility")
+	switch v {
+	case facility_check:
+		return false, nil
+	case facility_skip:
+		return true, nil
+	}
+	return false, fmt.Errorf("Reader %s: option facility must be %s or %s, not %q",
+		spec.Name, facility_check, facility_skip, v)
+}
+
+// open_readers opens every reader in cfg.Readers (or a Wiegand reader
+// on PinD0 and PinD1, if none are given).  Tamper reports from OSDP
+// readers go to 'tampers' until 'run_ctx' is cancelled.
+func open_readers(run_ctx context.Context, cfg *Config, chip gpio.Chip,
+	formats []wiegand.Format, tampers chan<- tamperEvent) (*readerSet, error) {
+
+	specs := cfg.Readers
+	if len(specs) == 0 {
+		specs = []string{ReaderWiegand}
+	}
+
+	rs := &readerSet{skip_facility: make(map[string]bool)}
+	names := make(map[string]bool)
+	for _, s := range specs {
+		spec, err := cardreader.ParseSpec(s)
+		if err != nil {
+			return nil, err
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("Reader name %q is used twice", spec.Name)
+		}
+		names[spec.Name] = true
+		skip_facility, err := facility_option(spec)
+		if err != nil {
+			return nil, err
+		}
+		if skip_facility {
+			rs.skip_facility[spec.Name] = true
+			if len(cfg.FacilityCodes) > 0 {
+				log.Printf("Reader %s: not checking facility codes", spec.Name)
+			}
+		}
+
+		switch spec.Type {
+		case ReaderWiegand:
+			if err := spec.Check("d0", "d1"); err != nil {
+				return nil, err
+			}
+			d0, err := spec.IntOption("d0", cfg.PinD0)
+			if err != nil {
+				return nil, err
+			}
+			d1, err := spec.IntOption("d1", cfg.PinD1)
+			if err != nil {
+				return nil, err
+			}
+			r, err := wiegand.NewReader(chip, wiegand.Config{
+				PinD0: d0,
+				PinD1: d1,
+				Formats: formats,
+				BitGap: cfg.WiegandBitGap,
+				FrameTimeout: cfg.WiegandFrameTimeout,
+			})
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Reader %s: Wiegand on pins %d and %d", spec.Name, d0, d1)
+			rs.list = append(rs.list, cardreader.New(spec.Name, r.Listen))
+			rs.wiegand = true
+
+		case ReaderOSDP:
+			if err := spec.Check("device", "baud", "address"); err != nil {
+				return nil, err
+			}
+			if cfg.Simulate {
+				log.Printf("Simulating: ignoring OSDP reader %s", spec.Name)
+				continue
+			}
+			device := spec.Option("device", cfg.OsdpDevice)
+			baud, err := spec.IntOption("baud", cfg.OsdpBaud)
+			if err != nil {
+				return nil, err
+			}
+			addr, err := spec.IntOption("address", cfg.OsdpAddress)
+			if err != nil {
+				return nil, err
+			}
+			if addr < 0 || addr >= osdp.AddressBroadcast {
+				return nil, fmt.Errorf("Reader %s: OSDP address must be 0 to %d",
+					spec.Name, osdp.AddressBroadcast-1)
+			}
+			name := spec.Name
+			r, err := osdp.Open(osdp.Config{
+				Device: device,
+				Baud: baud,
+				Address: byte(addr),
+				Formats: formats,
+				SCBK: cfg.OsdpKey,
+				OnTamper: func(tamper bool) {
+					select {
+					case tampers <- tamperEvent{name, tamper}:
+					case <-run_ctx.Done():
+					}
+				},
+			})
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Reader %s: OSDP address %d at %s", spec.Name, addr, device)
+			rs.list = append(rs.list, cardreader.New(spec.Name, r.Listen))
+			rs.osdp = append(rs.osdp, r)
+
+		case ReaderEvdev:
+			if err := spec.Check("device"); err != nil {
+				return nil, err
+			}
+			device := spec.Option("device", "")
+			if device == "" {
+				return nil, fmt.Errorf("Reader %s: device is required", spec.Name)
+			}
+			// Every badge from it would be denied:
+			if len(cfg.FacilityCodes) > 0 && !skip_facility {
+				return nil, fmt.Errorf("Reader %s: a keyboard reader gives no facility codes, so with --facility it needs facility=%s",
+					spec.Name, facility_skip)
+			}
+			r, err := cardreader.OpenKeyboard(spec.Name, device)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Reader %s: keyboard at %s", spec.Name, device)
+			rs.list = append(rs.list, r)
+
+		case ReaderStream:
+			if err := spec.Check("path"); err != nil {
+				return nil, err
+			}
+			path := spec.Option("path", "-")
+			if path == "-" && cfg.Simulate {
+				return nil, fmt.Errorf("Reader %s: can't read stdin, which --simulate reads commands from", spec.Name)
+			}
+			r, err := cardreader.OpenStream(spec.Name, path)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Reader %s: text from %s", spec.Name, path)
+			rs.list = append(rs.list, r)
+
+		default:
+			return nil, fmt.Errorf("Reader %s: unknown type %q", spec.Name, spec.Type)
+		}
+	}
+	return rs, nil
+}
+
+// teeOutput is a gpio.OutputLine that sets several lines at once (e.g.
+// the beeper pin and the beepers of OSDP readers).
+type teeOutput []gpio.OutputLine
+
+func (t teeOutput) SetValue(value int) error {
+	var err error
+	for _, l := range t {
+		if e := l.SetValue(value); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (t teeOutput) Close() error {
+	var err error
+	for _, l := range t {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,447 @@
+package access
+
+// Holding the door unlocked: on a schedule (Config.Schedule), or on
+// request until a given time (see "unlock until" below).
+//
+// Each schedule entry is either a weekly window or a one-off range:
+//
+//   mon-fri 18:00-22:00             weekly, on the given days
+//   tue,thu 19:00-01:00             past midnight (ends on wed & fri)
+//   daily 12:00-13:00               every day (as is "*")
+//   2026-12-24/2026-12-26           one-off, from the start of the
+//                                   first day to the end of the last
+//   2026-10-31T18:00/2026-11-01T02:00  one-off, with times
+//
+// All times are local.
+//
+// An "unlock until" request (from HTTP or MQTT, by a badge that intweb
+// allows) holds the door unlocked until the next time it is HH:MM, or
+// ends such a hold early if it is "now".  It is saved in
+// Config.StateDir, so that it survives a restart.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	MQTT "github.com/eclipse/paho.mqtt.golang"
+
+	"hive13/rfid/intweb"
+)
+
+const (
+	// URL for an "unlock until" request:
+	unlock_until_url = "/unlock_until"
+	// Form key for the time to hold unlocked until:
+	unlock_until_key = "until"
+	// MQTT command for an "unlock until" request; the message is this,
+	// then the time, then the badge number (e.g. "unlock_until 22:00
+	// 12345678"):
+	unlock_until_cmd = "unlock_until"
+	// File (in StateDir) where an "unlock until" is saved:
+	unlock_until_file = "unlock_until.json"
+)
+
+// Why the door is held unlocked (see door_held):
+const (
+	HeldBySchedule = "schedule"
+	HeldByRequest = "request"
+)
+
+var day_names = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// weeklyWindow is a window on certain days of every week.
+type weeklyWindow struct {
+	// Indexed by time.Weekday:
+	days [7]bool
+	// Minutes after midnight; if end <= start, the window goes past
+	// midnight, into the next day:
+	start int
+	end int
+}
+
+func (w weeklyWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	day := int(t.Weekday())
+	if w.start < w.end {
+		return w.days[day] && m >= w.start && m < w.end
+	}
+	yesterday := (day + 6) % 7
+	return (w.days[day] && m >= w.start) || (w.days[yesterday] && m < w.end)
+}
+
+// dateRange is a one-off range of time.
+type dateRange struct {
+	from time.Time
+	until time.Time
+}
+
+// schedule is when the door is held unlocked (see the top of this
+// file).
+type schedule struct {
+	weekly []weeklyWindow
+	dates []dateRange
+}
+
+// parse_schedule parses schedule entries (see the top of this file).
+func parse_schedule(specs []string) (*schedule, error) {
+	sched := &schedule{}
+	for _, spec := range specs {
+		fields := strings.Fields(spec)
+		switch len(fields) {
+		case 1:
+			r, err := parse_date_range(fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("Schedule %q: %s", spec, err)
+			}
+			sched.dates = append(sched.dates, r)
+		case 2:
+			w, err := parse_weekly(fields[0], fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("Schedule %q: %s", spec, err)
+			}
+			sched.weekly = append(sched.weekly, w)
+		default:
+			return nil, fmt.Errorf("Schedule %q: expected days and times, or a date range", spec)
+		}
+	}
+	return sched, nil
+}
+
+// parse_weekly parses a weekly window, e.g. "mon-fri" and
+// "18:00-22:00".
+func parse_weekly(days string, times string) (weeklyWindow, error) {
+	var w weeklyWindow
+	if days == "daily" || days == "*" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+	} else {
+		for _, part := range strings.Split(days, ",") {
+			ends := strings.SplitN(part, "-", 2)
+			first, err := parse_day(ends[0])
+			if err != nil {
+				return w, err
+			}
+			last := first
+			if len(ends) == 2 {
+				if last, err = parse_day(ends[1]); err != nil {
+					return w, err
+				}
+			}
+			// (A range like fri-mon wraps around the weekend.)
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	}
+
+	ends := strings.SplitN(times, "-", 2)
+	if len(ends) != 2 {
+		return w, fmt.Errorf("expected times as HH:MM-HH:MM")
+	}
+	var err error
+	if w.start, err = parse_clock(ends[0]); err != nil {
+		return w, err
+	}
+	if w.end, err = parse_clock(ends[1]); err != nil {
+		return w, err
+	}
+	if w.start == w.end || w.start >= 24*60 {
+		return w, fmt.Errorf("window %q is empty", times)
+	}
+	return w, nil
+}
+
+func parse_day(s string) (int, error) {
+	s = strings.ToLower(s)
+	for i, name := range day_names {
+		if s == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown day %q (expected e.g. mon)", s)
+}
+
+// parse_clock parses a time of day as HH:MM, returning minutes after
+// midnight.  (24:00 is allowed, for the end of a window.)
+func parse_clock(s string) (int, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 ||
+		h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+
+		return 0, fmt.Errorf("bad time %q (expected HH:MM)", s)
+	}
+	return h*60 + m, nil
+}
+
+// parse_date_range parses a one-off range, e.g. "2026-12-24/2026-12-26"
+// or "2026-10-31T18:00/2026-11-01T02:00".
+func parse_date_range(s string) (dateRange, error) {
+	var r dateRange
+	ends := strings.SplitN(s, "/", 2)
+	if len(ends) != 2 {
+		return r, fmt.Errorf("expected a date range as START/END")
+	}
+	var err error
+	if r.from, _, err = parse_date(ends[0]); err != nil {
+		return r, err
+	}
+	var date_only bool
+	if r.until, date_only, err = parse_date(ends[1]); err != nil {
+		return r, err
+	}
+	// The end date itself is included:
+	if date_only {
+		r.until = r.until.AddDate(0, 0, 1)
+	}
+	if !r.until.After(r.from) {
+		return r, fmt.Errorf("range %q is empty", s)
+	}
+	return r, nil
+}
+
+// parse_date parses YYYY-MM-DD or YYYY-MM-DDTHH:MM as local time, and
+// returns whether it was only a date.
+func parse_date(s string) (time.Time, bool, error) {
+	if t, err := time.ParseInLocation("2006-01-02T15:04", s, time.Local); err == nil {
+		return t, false, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return t, false, fmt.Errorf("bad date %q (expected YYYY-MM-DD or YYYY-MM-DDTHH:MM)", s)
+	}
+	return t, true, nil
+}
+
+// active returns true if the schedule holds the door unlocked at 't'.
+func (s *schedule) active(t time.Time) bool {
+	for _, w := range s.weekly {
+		if w.contains(t) {
+			return true
+		}
+	}
+	for _, r := range s.dates {
+		if !t.Before(r.from) && t.Before(r.until) {
+			return true
+		}
+	}
+	return false
+}
+
+// parse_until parses the time for an "unlock until" request: HH:MM (the
+// next time it is that time, from 'now'), or "now", for which this
+// returns a zero time.
+func parse_until(s string, now time.Time) (time.Time, error) {
+	if strings.ToLower(s) == "now" {
+		return time.Time{}, nil
+	}
+	m, err := parse_clock(s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	y, mon, d := now.Date()
+	t := time.Date(y, mon, d, m/60, m%60, 0, 0, now.Location())
+	if !t.After(now) {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// HoldRequest is a request (received via HTTP or MQTT) to hold the door
+// unlocked until a given time.  The badge must be one that intweb
+// allows.  The behavior with 'Reply' is the same as HttpOpenRequest.
+type HoldRequest struct {
+	AsyncReply
+	Badge intweb.Badge
+	// Zero to end any hold now:
+	Until time.Time
+}
+
+// savedHold is the content of unlock_until_file:
+type savedHold struct {
+	Until time.Time `json:"until"`
+}
+
+// load_hold reads any saved "unlock until" from StateDir, and returns it
+// if it hasn't already passed.
+func (ctx *ServerCtx) load_hold() time.Time {
+	if ctx.StateDir == "" {
+		return time.Time{}
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.StateDir, unlock_until_file))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Error loading unlock-until: %s", err)
+		}
+		return time.Time{}
+	}
+	var saved savedHold
+	if err := json.Unmarshal(data, &saved); err != nil {
+		log.Printf("Error loading unlock-until: %s", err)
+		return time.Time{}
+	}
+	if !saved.Until.After(time.Now()) {
+		return time.Time{}
+	}
+	log.Printf("Resuming unlock until %s", saved.Until.Format(time.RFC3339))
+	return saved.Until
+}
+
+// save_hold saves the "unlock until" time to StateDir (or removes it, if
+// 'until' is zero).
+func (ctx *ServerCtx) save_hold(until time.Time) {
+	if ctx.StateDir == "" {
+		return
+	}
+	path := filepath.Join(ctx.StateDir, unlock_until_file)
+	if until.IsZero() {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("Error removing saved unlock-until: %s", err)
+		}
+		return
+	}
+	data, err := json.Marshal(savedHold{Until: until})
+	if err == nil {
+		err = write_file_atomic(path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Error saving unlock-until: %s", err)
+	}
+}
+
+// set_hold_until handles an allowed "unlock until" request.
+func (ctx *ServerCtx) set_hold_until(until time.Time) {
+	if until.IsZero() {
+		log.Printf("Ending unlock-until")
+	} else {
+		log.Printf("Holding door unlocked until %s", until.Format(time.RFC3339))
+	}
+	ctx.hold_until = until
+	ctx.save_hold(until)
+	ctx.update_hold(time.Now())
+}
+
+// update_hold holds the door unlocked, or stops holding it, according
+// to the schedule and any "unlock until", as of 'now'.
+func (ctx *ServerCtx) update_hold(now time.Time) {
+	if !ctx.hold_until.IsZero() && !now.Before(ctx.hold_until) {
+		log.Printf("Unlock-until %s has passed", ctx.hold_until.Format(time.RFC3339))
+		ctx.hold_until = time.Time{}
+		ctx.save_hold(ctx.hold_until)
+	}
+
+	held_by := ""
+	if !ctx.hold_until.IsZero() {
+		held_by = HeldByRequest
+	} else if ctx.schedule != nil && ctx.schedule.active(now) {
+		held_by = HeldBySchedule
+	}
+	if !ctx.door_held(held_by, ctx.hold_until) {
+		return
+	}
+
+	if held_by != "" {
+		log.Printf("Holding door unlocked (by %s)", held_by)
+		if err := ctx.Lock.Unlock(); err != nil {
+			log.Printf("Error opening lock: %s", err)
+		}
+		// The LED stays on while held (see the main loop):
+		ctx.LED.SetValue(0)
+	} else {
+		log.Printf("No longer holding door unlocked")
+		ctx.LED.SetValue(1)
+	}
+}
+
+// HTTP handler for a request to /unlock_until:
+func (ctx *ServerCtx) http_unlock_until_handler(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != "POST" {
+		log.Printf("%s: Unsupported HTTP %s", r.URL, r.Method)
+		http.Error(w, "Method is not supported.", http.StatusNotFound)
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		errstr := fmt.Sprintf("Error parsing form: %s", err)
+		log.Printf("%s: %s", r.URL, errstr)
+		http.Error(w, errstr, http.StatusBadRequest)
+		return
+	}
+
+	badge := intweb.Badge(strings.TrimSpace(r.Form.Get(open_door_key_badge)))
+	if badge == "" {
+		errstr := fmt.Sprintf("Form key '%s' is missing or empty", open_door_key_badge)
+		log.Printf("%s: %s", r.URL, errstr)
+		http.Error(w, errstr, http.StatusBadRequest)
+		return
+	}
+	until, err := parse_until(strings.TrimSpace(r.Form.Get(unlock_until_key)), time.Now())
+	if err != nil {
+		errstr := fmt.Sprintf("Form key '%s': %s", unlock_until_key, err)
+		log.Printf("%s: %s", r.URL, errstr)
+		http.Error(w, errstr, http.StatusBadRequest)
+		return
+	}
+
+	err_ch := make(chan error)
+	rq := HoldRequest{
+		AsyncReply: AsyncReply{
+			Reply: err_ch,
+		},
+		Badge: badge,
+		Until: until,
+	}
+	log.Printf("%s: Got badge %s, sending request to main loop...",
+		r.URL, badge)
+	ctx.request_to_main_loop(rq, err_ch, w, r)
+}
+
+// mqtt_command handles a message on the MQTT command topic.  (This is
+// called from the MQTT client's goroutine.)
+func (ctx *ServerCtx) mqtt_command(client MQTT.Client, msg MQTT.Message) {
+	fields := strings.Fields(string(msg.Payload()))
+	if len(fields) != 3 || fields[0] != unlock_until_cmd {
+		log.Printf("MQTT: Unknown command %q (expected %s HH:MM BADGE)",
+			msg.Payload(), unlock_until_cmd)
+		return
+	}
+	until, err := parse_until(fields[1], time.Now())
+	if err != nil {
+		log.Printf("MQTT: %s: %s", unlock_until_cmd, err)
+		return
+	}
+
+	err_ch := make(chan error)
+	rq := HoldRequest{
+		AsyncReply: AsyncReply{
+			Reply: err_ch,
+		},
+		Badge: intweb.Badge(fields[2]),
+		Until: until,
+	}
+	log.Printf("MQTT: Got %s for badge %s, sending request to main loop...",
+		unlock_until_cmd, rq.Badge)
+	go func() {
+		select {
+		case ctx.HttpReqs <- rq:
+		case <-time.After(15 * time.Second):
+			log.Printf("MQTT: Timed out waiting on main loop")
+			return
+		}
+		if err := <-err_ch; err != nil {
+			log.Printf("MQTT: %s failed: %s", unlock_until_cmd, err)
+		}
+	}()
+}
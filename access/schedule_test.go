@@ -0,0 +1,149 @@
+package access
+
+import (
+	"testing"
+	"time"
+)
+
+// at parses a local time given as "2006-01-02 15:04".  (The week of
+// 2026-10-19 runs from Monday the 19th to Sunday the 25th.)
+func at(t *testing.T, s string) time.Time {
+	t.Helper()
+	tm, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tm
+}
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		spec string
+		active []string
+		inactive []string
+	}{
+		{"mon-fri 18:00-22:00",
+			[]string{"2026-10-19 18:00", "2026-10-23 21:59"},
+			[]string{"2026-10-19 17:59", "2026-10-19 22:00", "2026-10-24 19:00", "2026-10-25 19:00"}},
+		// Past midnight, ending the next day:
+		{"tue,thu 19:00-01:00",
+			[]string{"2026-10-20 19:00", "2026-10-21 00:59", "2026-10-22 23:00", "2026-10-23 00:30"},
+			[]string{"2026-10-20 18:59", "2026-10-20 00:30", "2026-10-21 01:00", "2026-10-21 19:00"}},
+		// Wrapping around the weekend:
+		{"fri-mon 09:00-10:00",
+			[]string{"2026-10-23 09:00", "2026-10-24 09:30", "2026-10-25 09:30", "2026-10-19 09:59"},
+			[]string{"2026-10-20 09:30", "2026-10-22 09:30"}},
+		{"daily 12:00-13:00",
+			[]string{"2026-10-19 12:00", "2026-10-25 12:59"},
+			[]string{"2026-10-19 13:00", "2026-10-25 11:59"}},
+		{"* 00:00-24:00",
+			[]string{"2026-10-19 00:00", "2026-10-25 23:59"},
+			nil},
+		{"SAT 10:00-12:00",
+			[]string{"2026-10-24 10:00"},
+			[]string{"2026-10-25 10:00"}},
+		// The end date is included:
+		{"2026-12-24/2026-12-26",
+			[]string{"2026-12-24 00:00", "2026-12-26 23:59"},
+			[]string{"2026-12-23 23:59", "2026-12-27 00:00"}},
+		{"2026-10-31T18:00/2026-11-01T02:00",
+			[]string{"2026-10-31 18:00", "2026-11-01 01:59"},
+			[]string{"2026-10-31 17:59", "2026-11-01 02:00"}},
+	}
+	for _, test := range tests {
+		sched, err := parse_schedule([]string{test.spec})
+		if err != nil {
+			t.Errorf("%q: %s", test.spec, err)
+			continue
+		}
+		for _, s := range test.active {
+			if !sched.active(at(t, s)) {
+				t.Errorf("%q isn't active at %s", test.spec, s)
+			}
+		}
+		for _, s := range test.inactive {
+			if sched.active(at(t, s)) {
+				t.Errorf("%q is active at %s", test.spec, s)
+			}
+		}
+	}
+}
+
+func TestScheduleSeveral(t *testing.T) {
+	sched, err := parse_schedule([]string{"mon 10:00-11:00", "2026-10-20/2026-10-20"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"2026-10-19 10:30", "2026-10-20 15:00"} {
+		if !sched.active(at(t, s)) {
+			t.Errorf("Not active at %s", s)
+		}
+	}
+	if sched.active(at(t, "2026-10-21 10:30")) {
+		t.Errorf("Active at 2026-10-21 10:30")
+	}
+
+	if sched, err := parse_schedule(nil); err != nil || sched.active(at(t, "2026-10-19 10:30")) {
+		t.Errorf("Empty schedule: %v", err)
+	}
+}
+
+func TestScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"",
+		"mon",
+		"mon 18:00-22:00 extra",
+		"funday 18:00-22:00",
+		"mon-funday 18:00-22:00",
+		"mon 18:00",
+		"mon 18:00-18:00",
+		"mon 25:00-26:00",
+		"mon 18:60-22:00",
+		"mon 18:00-24:01",
+		"mon six-ten",
+		"2026-12-26/2026-12-24",
+		"2026-10-31T18:00/2026-10-31T18:00",
+		"2026-12-24",
+		"2026-13-01/2026-13-02",
+		"yesterday/tomorrow",
+	} {
+		if _, err := parse_schedule([]string{spec}); err == nil {
+			t.Errorf("%q parsed without an error", spec)
+		}
+	}
+}
+
+func TestParseUntil(t *testing.T) {
+	now := at(t, "2026-10-19 18:30")
+	tests := []struct {
+		s string
+		want string
+	}{
+		{"22:00", "2026-10-19 22:00"},
+		// The next time it is that time, which may be tomorrow:
+		{"18:30", "2026-10-20 18:30"},
+		{"02:00", "2026-10-20 02:00"},
+		{"24:00", "2026-10-20 00:00"},
+	}
+	for _, test := range tests {
+		got, err := parse_until(test.s, now)
+		if err != nil {
+			t.Errorf("%q: %s", test.s, err)
+			continue
+		}
+		if !got.Equal(at(t, test.want)) {
+			t.Errorf("%q is %s, not %s", test.s, got, test.want)
+		}
+	}
+
+	for _, s := range []string{"now", "NOW"} {
+		if got, err := parse_until(s, now); err != nil || !got.IsZero() {
+			t.Errorf("%q is %s, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "later", "25:00", "1800"} {
+		if _, err := parse_until(s, now); err == nil {
+			t.Errorf("%q parsed without an error", s)
+		}
+	}
+}
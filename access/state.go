@@ -0,0 +1,165 @@
+package access
+
+// State kept in Config.StateDir across restarts.
+//
+// Each kind of state is a JSON file, written atomically (see
+// write_file_atomic).  Some of it may instead be encrypted (see
+// Config.CacheEncrypt), as AES-256-GCM of that JSON: a 12-byte nonce,
+// then the ciphertext and tag.  The key is an HMAC-SHA256 of a fixed
+// label with the intweb device key, so nothing else needs to be kept
+// secret.  (This is to keep badge numbers off a stolen SD card; it's
+// no help if the device key is on the same card.)
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Label for deriving the state key from the device key:
+const state_key_label = "hive13 access state v1"
+
+// state_key derives the key for encrypted state files from the device
+// key.
+func state_key(device_key []byte) []byte {
+	mac := hmac.New(sha256.New, device_key)
+	mac.Write([]byte(state_key_label))
+	return mac.Sum(nil)
+}
+
+func state_aead(device_key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(state_key(device_key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// state_path returns the path in StateDir of state 'name' (plain or
+// encrypted), or "" if there is no StateDir.
+func (ctx *ServerCtx) state_path(name string, encrypted bool) string {
+	if ctx.StateDir == "" {
+		return ""
+	}
+	if encrypted {
+		return filepath.Join(ctx.StateDir, name+".enc")
+	}
+	return filepath.Join(ctx.StateDir, name+".json")
+}
+
+// load_state reads state 'name' into 'v'.  It returns false (and no
+// error) if there is no such state.
+func (ctx *ServerCtx) load_state(name string, v interface{}, encrypted bool) (bool, error) {
+	path := ctx.state_path(name, encrypted)
+	if path == "" {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if encrypted {
+		if data, err = ctx.decrypt_state(data); err != nil {
+			return false, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return false, fmt.Errorf("%s: %s", path, err)
+	}
+	return true, nil
+}
+
+// save_state writes 'v' as state 'name'.  (It does nothing if there is
+// no StateDir.)
+func (ctx *ServerCtx) save_state(name string, v interface{}, encrypted bool) error {
+	path := ctx.state_path(name, encrypted)
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		if data, err = ctx.encrypt_state(data); err != nil {
+			return err
+		}
+	}
+	if err := write_file_atomic(path, data, 0600); err != nil {
+		return err
+	}
+
+	// Don't leave a plain copy behind after switching to encryption
+	// (or a stale encrypted one after switching back):
+	other := ctx.state_path(name, !encrypted)
+	if err := os.Remove(other); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (ctx *ServerCtx) encrypt_state(plain []byte) ([]byte, error) {
+	aead, err := state_aead(ctx.IntwebDeviceKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (ctx *ServerCtx) decrypt_state(data []byte) ([]byte, error) {
+	aead, err := state_aead(ctx.IntwebDeviceKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted file is too short")
+	}
+	nonce, sealed := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Can't decrypt file (was the device key changed?)")
+	}
+	return plain, nil
+}
+
+// write_file_atomic writes 'data' to 'path' so that, even if this is
+// interrupted (e.g. by a power failure), the file has either its old
+// content or all of the new content.
+func write_file_atomic(path string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); e != nil && err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
@@ -0,0 +1,125 @@
+package access
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// new_state returns a ServerCtx with a temporary StateDir (encrypting
+// state with CacheEncrypt if 'encrypt' is true), and a function to
+// remove that at the end of the test.
+func new_state(t *testing.T, encrypt bool) (*ServerCtx, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &ServerCtx{Config: &Config{
+		StateDir: dir,
+		IntwebDeviceKey: test_device_key,
+		CacheEncrypt: encrypt,
+	}}
+	return ctx, func() { os.RemoveAll(dir) }
+}
+
+type testState struct {
+	Badge string `json:"badge"`
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		ctx, cleanup := new_state(t, encrypt)
+		defer cleanup()
+
+		var got testState
+		if ok, err := ctx.load_state("test", &got, encrypt); ok || err != nil {
+			t.Errorf("Encrypt %t: loaded missing state: %t, %v", encrypt, ok, err)
+		}
+		if err := ctx.save_state("test", testState{"12345678"}, encrypt); err != nil {
+			t.Fatal(err)
+		}
+		ok, err := ctx.load_state("test", &got, encrypt)
+		if !ok || err != nil || got.Badge != "12345678" {
+			t.Errorf("Encrypt %t: loaded %t, %v, %+v", encrypt, ok, err, got)
+		}
+
+		fi, err := os.Stat(ctx.state_path("test", encrypt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if perm := fi.Mode().Perm(); perm != 0600 {
+			t.Errorf("Encrypt %t: file has mode %s", encrypt, perm)
+		}
+	}
+}
+
+func TestStateEncrypted(t *testing.T) {
+	ctx, cleanup := new_state(t, true)
+	defer cleanup()
+
+	if err := ctx.save_state("test", testState{"12345678"}, true); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(ctx.StateDir, "test.enc"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("12345678")) || bytes.Contains(data, []byte("badge")) {
+		t.Errorf("Encrypted file has plaintext: %q", data)
+	}
+
+	// Another device key can't read it:
+	var got testState
+	ctx.IntwebDeviceKey = []byte("other key")
+	if _, err := ctx.load_state("test", &got, true); err == nil {
+		t.Errorf("Loaded with the wrong key: %+v", got)
+	}
+	ctx.IntwebDeviceKey = test_device_key
+
+	// Nor can anything be changed:
+	for _, idx := range []int{0, len(data) / 2, len(data) - 1} {
+		bad := append([]byte(nil), data...)
+		bad[idx] ^= 0x01
+		if _, err := ctx.decrypt_state(bad); err == nil {
+			t.Errorf("Decrypted with byte %d changed", idx)
+		}
+	}
+	if _, err := ctx.decrypt_state(data[:4]); err == nil {
+		t.Errorf("Decrypted a truncated file")
+	}
+}
+
+// Switching encryption on leaves no plain copy behind, and off again
+// leaves no stale encrypted one.
+func TestStateSwitch(t *testing.T) {
+	ctx, cleanup := new_state(t, false)
+	defer cleanup()
+
+	exists := func(encrypted bool) bool {
+		_, err := os.Stat(ctx.state_path("test", encrypted))
+		return err == nil
+	}
+	ctx.save_state("test", testState{"1"}, false)
+	ctx.save_state("test", testState{"1"}, true)
+	if exists(false) || !exists(true) {
+		t.Errorf("After encrypting: plain %t, encrypted %t", exists(false), exists(true))
+	}
+	ctx.save_state("test", testState{"1"}, false)
+	if !exists(false) || exists(true) {
+		t.Errorf("After decrypting: plain %t, encrypted %t", exists(false), exists(true))
+	}
+}
+
+func TestStateNoDir(t *testing.T) {
+	ctx := &ServerCtx{Config: &Config{}}
+	if err := ctx.save_state("test", testState{"1"}, false); err != nil {
+		t.Error(err)
+	}
+	var got testState
+	if ok, err := ctx.load_state("test", &got, false); ok || err != nil {
+		t.Errorf("Loaded %t, %v with no StateDir", ok, err)
+	}
+}
@@ -0,0 +1,186 @@
+package cardreader
+
+// The cardreader package puts the different kinds of badge readers
+// (Wiegand, OSDP, USB keyboard-wedge readers, and plain text streams)
+// behind one interface, so that one door can take badges from several
+// readers at once - e.g. an outdoor Wiegand reader, plus a USB reader
+// on a desk for enrolling new badges.
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"hive13/rfid/wiegand"
+)
+
+// Badge is a badge scan (or key press) from a CardReader.
+type Badge struct {
+	wiegand.BadgeRead
+	// Name of the reader that it came from:
+	Source string
+}
+
+// CardReader is anything that badges can be scanned on.
+type CardReader interface {
+	// Name returns the name of this reader, e.g. "outdoor" or "desk".
+	Name() string
+	// Listen returns a channel that will send every badge scanned on
+	// this reader.  When 'ctx' is cancelled, the reader is closed, and
+	// then the channel is closed.
+	Listen(ctx context.Context) <-chan Badge
+}
+
+// funcReader is a CardReader from a name and a Listen function.
+type funcReader struct {
+	name string
+	listen func(ctx context.Context) <-chan wiegand.BadgeRead
+}
+
+// New returns a CardReader named 'name', with badges from 'listen'
+// (which must behave as CardReader.Listen does).  This is how the
+// Wiegand and OSDP readers are made into CardReaders, e.g.:
+//
+//   cardreader.New("outdoor", wiegand_reader.Listen)
+func New(name string,
+	listen func(ctx context.Context) <-chan wiegand.BadgeRead) CardReader {
+
+	return &funcReader{name: name, listen: listen}
+}
+
+func (r *funcReader) Name() string {
+	return r.name
+}
+
+func (r *funcReader) Listen(ctx context.Context) <-chan Badge {
+	return named(ctx, r.name, r.listen(ctx))
+}
+
+// named labels everything from 'in' with 'name'.  The returned channel
+// is closed once 'in' is.
+func named(ctx context.Context, name string,
+	in <-chan wiegand.BadgeRead) <-chan Badge {
+
+	ch := make(chan Badge)
+	go func() {
+		defer close(ch)
+		for br := range in {
+			select {
+			case ch <- Badge{BadgeRead: br, Source: name}:
+			case <-ctx.Done():
+				// Let 'in' finish closing:
+				for range in {
+				}
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// ListenAll calls Listen on every reader in 'readers', and returns a
+// channel with the badges from all of them.  When 'ctx' is cancelled,
+// every reader is closed, and then the channel is closed.
+func ListenAll(ctx context.Context, readers []CardReader) <-chan Badge {
+	ch := make(chan Badge)
+	var wg sync.WaitGroup
+	for _, r := range readers {
+		wg.Add(1)
+		go func(in <-chan Badge) {
+			defer wg.Done()
+			for b := range in {
+				select {
+				case ch <- b:
+				case <-ctx.Done():
+					for range in {
+					}
+					return
+				}
+			}
+		}(r.Listen(ctx))
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// Spec describes one reader, as given on the commandline:
+//
+//   type[,key=value,...]
+//
+// e.g. "wiegand,d0=17,d1=18" or "evdev,name=desk,device=/dev/input/event0".
+// The option "name" gives the reader's name; if it is missing, the
+// type is used.  Which other options there are depends on the type.
+type Spec struct {
+	Type string
+	Name string
+	Options map[string]string
+}
+
+// ParseSpec parses a reader spec (see Spec).
+func ParseSpec(s string) (Spec, error) {
+	parts := strings.Split(s, ",")
+	spec := Spec{
+		Type: strings.TrimSpace(parts[0]),
+		Options: make(map[string]string),
+	}
+	if spec.Type == "" {
+		return spec, fmt.Errorf("Reader spec %q has no type", s)
+	}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return spec, fmt.Errorf("Reader spec %q: expected key=value, not %q", s, p)
+		}
+		spec.Options[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	spec.Name = spec.Options["name"]
+	delete(spec.Options, "name")
+	if spec.Name == "" {
+		spec.Name = spec.Type
+	}
+	return spec, nil
+}
+
+// Check returns an error if the spec has any option not in 'known'.
+func (s Spec) Check(known ...string) error {
+	for k := range s.Options {
+		ok := false
+		for _, k2 := range known {
+			if k == k2 {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("Reader %s: unknown option %q for type %s", s.Name, k, s.Type)
+		}
+	}
+	return nil
+}
+
+// Option returns the option 'key', or 'def' if it is not given.
+func (s Spec) Option(key string, def string) string {
+	if v, ok := s.Options[key]; ok {
+		return v
+	}
+	return def
+}
+
+// IntOption returns the option 'key' as an integer, or 'def' if it is
+// not given.
+func (s Spec) IntOption(key string, def int) (int, error) {
+	v, ok := s.Options[key]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("Reader %s: option %s must be a number, not %q", s.Name, key, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,157 @@
+package cardreader
+
+// A reader for USB "keyboard wedge" badge readers, which act as a
+// keyboard and type each badge number followed by Enter.  This reads
+// the reader's Linux input device (/dev/input/eventN) directly, and
+// grabs it, so that its keystrokes don't also go to a console.
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"hive13/rfid/wiegand"
+)
+
+const (
+	// ioctl to grab an input device (_IOW('E', 0x90, int)):
+	eviocgrab = 0x40044590
+
+	ev_key = 0x01
+
+	// Longest badge number we'll collect before giving up on it:
+	max_keyboard_digits = 20
+)
+
+// Size of struct input_event: a struct timeval (two longs), then type
+// (u16), code (u16), and value (s32).  So it's 24 bytes on 64-bit
+// systems, but 16 bytes on 32-bit ones.
+var input_event_size = 2*int(unsafe.Sizeof(uintptr(0))) + 8
+
+// Digits by key code (from linux/input-event-codes.h), both on the
+// main keyboard and on the keypad:
+var key_digits = map[uint16]rune{
+	2: '1', 3: '2', 4: '3', 5: '4', 6: '5', 7: '6', 8: '7', 9: '8', 10: '9',
+	11: '0',
+	79: '1', 80: '2', 81: '3', 75: '4', 76: '5', 77: '6', 71: '7', 72: '8',
+	73: '9', 82: '0',
+}
+
+// Enter, on the main keyboard and on the keypad:
+const (
+	key_enter   = 28
+	key_kpenter = 96
+)
+
+// Keyboard is a CardReader for a keyboard-wedge badge reader.
+type Keyboard struct {
+	name string
+	f    *os.File
+}
+
+// OpenKeyboard opens and grabs the input device at 'device', e.g.
+// /dev/input/by-id/usb-...-event-kbd, and returns a Keyboard reader
+// named 'name' for it.
+func OpenKeyboard(name string, device string) (*Keyboard, error) {
+	f, err := os.OpenFile(device, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	// (f.Fd() would put the file into blocking mode, so that Close
+	// could not interrupt a read, so go through SyscallConn instead.)
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, eviocgrab, 1)
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &Keyboard{name: name, f: f}, nil
+}
+
+func (k *Keyboard) Name() string {
+	return k.name
+}
+
+// Listen sends a badge for every number typed and followed by Enter.
+// Anything else typed is ignored.
+func (k *Keyboard) Listen(ctx context.Context) <-chan Badge {
+	ch := make(chan wiegand.BadgeRead)
+
+	// Closing the device is the only way to interrupt a read in
+	// progress (and this also releases the grab):
+	go func() {
+		<-ctx.Done()
+		k.f.Close()
+	}()
+
+	go func() {
+		defer close(ch)
+
+		buf := make([]byte, input_event_size)
+		digits := make([]byte, 0, max_keyboard_digits)
+		for {
+			if _, err := io.ReadFull(k.f, buf); err != nil {
+				if ctx.Err() == nil {
+					log.Printf("Reader %s: %s", k.name, err)
+				}
+				return
+			}
+
+			// (Every system this runs on is little-endian.)
+			off := input_event_size - 8
+			typ := binary.LittleEndian.Uint16(buf[off:])
+			code := binary.LittleEndian.Uint16(buf[off+2:])
+			value := int32(binary.LittleEndian.Uint32(buf[off+4:]))
+			// Only key presses matter (not releases or repeats):
+			if typ != ev_key || value != 1 {
+				continue
+			}
+
+			if d, ok := key_digits[code]; ok {
+				if len(digits) < max_keyboard_digits {
+					digits = append(digits, byte(d))
+				}
+				continue
+			}
+			if code != key_enter && code != key_kpenter {
+				continue
+			}
+			if len(digits) == 0 {
+				continue
+			}
+
+			n, err := strconv.ParseUint(string(digits), 10, 64)
+			digits = digits[:0]
+			br := wiegand.BadgeRead{
+				Value: n,
+				CardNumber: n,
+				NoFacilityCode: true,
+				Format: "keyboard",
+				LengthOK: err == nil,
+				ParityOK: true,
+			}
+			select {
+			case ch <- br:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return named(ctx, k.name, ch)
+}
@@ -0,0 +1,190 @@
+package cardreader
+
+// A reader that takes badges as lines of text from stdin, a FIFO, or a
+// file; mainly for testing, or for scripts to feed in badges.
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"hive13/rfid/wiegand"
+)
+
+// Stream is a CardReader that reads one badge per line of text.  Each
+// line is either a badge, as accepted by ParseBadge, or "key" and then
+// keys to press, e.g. "key 1234#".  Blank lines and lines starting
+// with '#' are ignored.
+type Stream struct {
+	name string
+	path string
+}
+
+// OpenStream returns a Stream named 'name' that reads from 'path',
+// which may be "-" for stdin.  A FIFO is read for as long as the
+// Stream listens (with any number of writers coming and going); stdin
+// or a file is read until it ends.
+func OpenStream(name string, path string) (*Stream, error) {
+	if path != "-" {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	return &Stream{name: name, path: path}, nil
+}
+
+func (s *Stream) Name() string {
+	return s.name
+}
+
+func (s *Stream) Listen(ctx context.Context) <-chan Badge {
+	ch := make(chan wiegand.BadgeRead)
+	go func() {
+		defer close(ch)
+
+		var f *os.File
+		var err error
+		if s.path == "-" {
+			f = os.Stdin
+		} else {
+			flags := os.O_RDONLY
+			if fi, err := os.Stat(s.path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+				// Opening a FIFO for writing too means that it never
+				// sees EOF (so writers can come and go), and that
+				// opening doesn't wait for a writer.
+				flags = os.O_RDWR
+			}
+			f, err = os.OpenFile(s.path, flags, 0)
+			if err != nil {
+				log.Printf("Reader %s: %s", s.name, err)
+				return
+			}
+		}
+
+		lines := make(chan string)
+		go func() {
+			defer close(lines)
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				select {
+				case lines <- scanner.Text():
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err := scanner.Err(); err != nil && ctx.Err() == nil {
+				log.Printf("Reader %s: %s", s.name, err)
+			}
+		}()
+
+		// Closing the file is the only way to interrupt a read in
+		// progress.  (This doesn't work for stdin, in which case the
+		// goroutine above is simply left behind.)
+		defer func() {
+			if f != os.Stdin {
+				f.Close()
+			}
+		}()
+
+		for {
+			var line string
+			var ok bool
+			select {
+			case line, ok = <-lines:
+				if !ok {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+
+			reads, err := ParseLine(line)
+			if err != nil {
+				log.Printf("Reader %s: %s", s.name, err)
+				continue
+			}
+			for _, br := range reads {
+				select {
+				case ch <- br:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return named(ctx, s.name, ch)
+}
+
+// ParseLine parses one line as read by Stream.
+func ParseLine(line string) ([]wiegand.BadgeRead, error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil, nil
+	}
+	if fields[0] == "key" && len(fields) == 2 {
+		return ParseKeys(fields[1])
+	}
+	if len(fields) != 1 {
+		return nil, fmt.Errorf("can't parse %q", line)
+	}
+	br, ok := ParseBadge(fields[0])
+	if !ok {
+		return nil, fmt.Errorf("can't parse badge %q", fields[0])
+	}
+	return []wiegand.BadgeRead{br}, nil
+}
+
+// ParseBadge turns a badge given as "N" or "FC:CN" to a BadgeRead
+// (packed as for H10301 in the latter case).
+func ParseBadge(s string) (wiegand.BadgeRead, bool) {
+	br := wiegand.BadgeRead{
+		Format: "text",
+		LengthOK: true,
+		ParityOK: true,
+	}
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) == 1 {
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return br, false
+		}
+		br.Value = n
+		br.CardNumber = n
+		br.NoFacilityCode = true
+		return br, true
+	}
+	fc, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return br, false
+	}
+	cn, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return br, false
+	}
+	br.FacilityCode = fc
+	br.CardNumber = cn
+	br.Value = fc<<16 | cn
+	return br, true
+}
+
+// ParseKeys turns keys given as a string (e.g. "1234#") to one
+// BadgeRead per key press.
+func ParseKeys(s string) ([]wiegand.BadgeRead, error) {
+	var reads []wiegand.BadgeRead
+	for _, k := range s {
+		if (k < '0' || k > '9') && k != wiegand.KeyStar && k != wiegand.KeyPound {
+			return nil, fmt.Errorf("can't parse key %q", k)
+		}
+		reads = append(reads, wiegand.BadgeRead{
+			Format: "text",
+			Key: k,
+			LengthOK: true,
+			ParityOK: true,
+		})
+	}
+	return reads, nil
+}
@@ -4,6 +4,6 @@ go 1.13
 
 require (
 	github.com/eclipse/paho.mqtt.golang v1.3.2
-	github.com/spf13/cobra v1.0.0 // indirect
+	github.com/spf13/cobra v1.0.0
 	github.com/warthog618/gpiod v0.6.0
 )
@@ -0,0 +1,97 @@
+package gpio
+
+// The gpio package is a small abstraction over GPIO lines, so that the
+// rest of this code can run against either real hardware (through
+// gpiod) or something else, like the in-memory lines in gpiofake.
+//
+// Edge events are still delivered as gpiod.LineEvent, as that is a
+// plain struct and there's no reason to invent another.
+
+import (
+	"github.com/warthog618/gpiod"
+)
+
+// InputLine is an input line that has been requested from a Chip.
+// *gpiod.Line satisfies this.
+type InputLine interface {
+	// Value returns the line's current value, 0 or 1.
+	Value() (int, error)
+	// Close releases the line.
+	Close() error
+}
+
+// OutputLine is an output line that has been requested from a Chip.
+// *gpiod.Line satisfies this.
+type OutputLine interface {
+	// SetValue sets the line to 0 or 1.
+	SetValue(value int) error
+	// Close releases the line.
+	Close() error
+}
+
+// Chip is a GPIO chip from which lines can be requested.
+//
+// (*gpiod.Chip cannot satisfy this directly, as its RequestLine
+// returns a concrete *gpiod.Line; see NewChip for the wrapper.)
+type Chip interface {
+	// RequestInput requests line 'offset' as an input.  If 'edge' is
+	// not gpiod.LineEdgeNone, then 'handler' is called (possibly from
+	// another goroutine) on every edge of that kind.
+	RequestInput(offset int, edge gpiod.LineEdge,
+		handler func(gpiod.LineEvent)) (InputLine, error)
+	// RequestOutput requests line 'offset' as an output, initially
+	// set to 'value'.
+	RequestOutput(offset int, value int) (OutputLine, error)
+	// Close releases the chip.  (Lines must be closed separately.)
+	Close() error
+}
+
+// gpiodChip is a Chip backed by a real GPIO chip.
+type gpiodChip struct {
+	chip *gpiod.Chip
+}
+
+// NewChip opens a real GPIO chip by name, e.g. "gpiochip0" for
+// /dev/gpiochip0.
+func NewChip(name string) (Chip, error) {
+	c, err := gpiod.NewChip(name)
+	if err != nil {
+		return nil, err
+	}
+	return &gpiodChip{chip: c}, nil
+}
+
+func (c *gpiodChip) RequestInput(offset int, edge gpiod.LineEdge,
+	handler func(gpiod.LineEvent)) (InputLine, error) {
+
+	opts := []gpiod.LineReqOption{gpiod.AsInput}
+	switch edge {
+	case gpiod.LineEdgeRising:
+		opts = append(opts, gpiod.WithRisingEdge)
+	case gpiod.LineEdgeFalling:
+		opts = append(opts, gpiod.WithFallingEdge)
+	case gpiod.LineEdgeBoth:
+		opts = append(opts, gpiod.WithBothEdges)
+	}
+	if edge != gpiod.LineEdgeNone {
+		opts = append(opts, gpiod.WithEventHandler(handler))
+	}
+	l, err := c.chip.RequestLine(offset, opts...)
+	if err != nil {
+		// (Don't return a nil *gpiod.Line as a non-nil InputLine)
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *gpiodChip) RequestOutput(offset int, value int) (OutputLine, error) {
+	l, err := c.chip.RequestLine(offset, gpiod.AsOutput(value))
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (c *gpiodChip) Close() error {
+	return c.chip.Close()
+}
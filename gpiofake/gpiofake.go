@@ -0,0 +1,307 @@
+package gpiofake
+
+// The gpiofake package is an in-memory gpio.Chip, for exercising code
+// without real hardware.  Inputs are driven from code (including
+// synthesized Wiegand frames), and outputs record every value they
+// are set to.
+//
+// Edge timestamps come from a virtual clock: it follows the real
+// clock, but SendWiegand moves it ahead so that a whole frame can be
+// synthesized at once with realistic spacing between bits.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/warthog618/gpiod"
+
+	"hive13/rfid/gpio"
+)
+
+const (
+	// Default time from the start of one Wiegand bit to the next:
+	DefaultWiegandInterval = 2 * time.Millisecond
+	// Default width of each Wiegand pulse:
+	DefaultWiegandPulse = 50 * time.Microsecond
+)
+
+// Chip is a fake gpio.Chip.  Create it with NewChip.
+type Chip struct {
+	mu      sync.Mutex
+	start   time.Time
+	skew    time.Duration
+	inputs  map[int]*Input
+	outputs map[int]*Output
+	closed  bool
+}
+
+// NewChip returns a fake chip with no lines in use.
+func NewChip() *Chip {
+	return &Chip{
+		start:   time.Now(),
+		inputs:  make(map[int]*Input),
+		outputs: make(map[int]*Output),
+	}
+}
+
+// now returns the virtual clock's time, in the same form as
+// gpiod.LineEvent.Timestamp.  c.mu must be held.
+func (c *Chip) now() time.Duration {
+	return time.Since(c.start) + c.skew
+}
+
+// Input returns the input at 'offset' so that it may be driven, e.g.
+// with Set.  It need not be requested yet.  New inputs start high.
+func (c *Chip) Input(offset int) *Input {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.input(offset)
+}
+
+// input is Input, with c.mu held.
+func (c *Chip) input(offset int) *Input {
+	in, ok := c.inputs[offset]
+	if !ok {
+		in = &Input{chip: c, offset: offset, value: 1}
+		c.inputs[offset] = in
+	}
+	return in
+}
+
+// Output returns the output at 'offset' so that its values may be
+// checked.  It need not be requested yet.
+func (c *Chip) Output(offset int) *Output {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.output(offset)
+}
+
+// output is Output, with c.mu held.
+func (c *Chip) output(offset int) *Output {
+	out, ok := c.outputs[offset]
+	if !ok {
+		out = &Output{offset: offset}
+		c.outputs[offset] = out
+	}
+	return out
+}
+
+func (c *Chip) RequestInput(offset int, edge gpiod.LineEdge,
+	handler func(gpiod.LineEvent)) (gpio.InputLine, error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("gpiofake: chip is closed")
+	}
+	if out, ok := c.outputs[offset]; ok && out.is_requested() {
+		return nil, fmt.Errorf("gpiofake: line %d is already an output", offset)
+	}
+
+	in := c.input(offset)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if in.requested {
+		return nil, fmt.Errorf("gpiofake: line %d is already requested", offset)
+	}
+	in.requested = true
+	in.edge = edge
+	in.handler = handler
+	return in, nil
+}
+
+func (c *Chip) RequestOutput(offset int, value int) (gpio.OutputLine, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, fmt.Errorf("gpiofake: chip is closed")
+	}
+	if in, ok := c.inputs[offset]; ok && in.is_requested() {
+		return nil, fmt.Errorf("gpiofake: line %d is already an input", offset)
+	}
+
+	out := c.output(offset)
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if out.requested {
+		return nil, fmt.Errorf("gpiofake: line %d is already requested", offset)
+	}
+	out.requested = true
+	out.set(value)
+	return out, nil
+}
+
+func (c *Chip) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// Input is a fake input line.  Drive it with Set.
+type Input struct {
+	chip   *Chip
+	offset int
+
+	mu        sync.Mutex
+	value     int
+	requested bool
+	edge      gpiod.LineEdge
+	handler   func(gpiod.LineEvent)
+}
+
+func (in *Input) Value() (int, error) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if !in.requested {
+		return 0, fmt.Errorf("gpiofake: line %d is not requested", in.offset)
+	}
+	return in.value, nil
+}
+
+func (in *Input) is_requested() bool {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.requested
+}
+
+func (in *Input) Close() error {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	in.requested = false
+	in.handler = nil
+	return nil
+}
+
+// Set sets the input's value.  If this is a change, and the line was
+// requested with a matching edge, its handler is called (before Set
+// returns).
+func (in *Input) Set(value int) {
+	in.chip.mu.Lock()
+	ts := in.chip.now()
+	in.chip.mu.Unlock()
+	in.set_at(value, ts)
+}
+
+// set_at is Set with a given timestamp.
+func (in *Input) set_at(value int, ts time.Duration) {
+	in.mu.Lock()
+	old := in.value
+	in.value = value
+	handler := in.handler
+	edge := in.edge
+	in.mu.Unlock()
+
+	if handler == nil || old == value {
+		return
+	}
+	evt := gpiod.LineEvent{
+		Offset:    in.offset,
+		Timestamp: ts,
+		Type:      gpiod.LineEventRisingEdge,
+	}
+	if value == 0 {
+		evt.Type = gpiod.LineEventFallingEdge
+	}
+	if edge == gpiod.LineEdgeBoth ||
+		(edge == gpiod.LineEdgeRising && value != 0) ||
+		(edge == gpiod.LineEdgeFalling && value == 0) {
+		handler(evt)
+	}
+}
+
+// Change is one value that an Output was set to.
+type Change struct {
+	Time  time.Time
+	Value int
+}
+
+// Output is a fake output line.  It records every value it is set to.
+type Output struct {
+	offset int
+
+	mu        sync.Mutex
+	requested bool
+	value     int
+	history   []Change
+}
+
+// set records a new value.  o.mu must be held.
+func (o *Output) set(value int) {
+	o.value = value
+	o.history = append(o.history, Change{Time: time.Now(), Value: value})
+}
+
+func (o *Output) SetValue(value int) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !o.requested {
+		return fmt.Errorf("gpiofake: line %d is not requested", o.offset)
+	}
+	o.set(value)
+	return nil
+}
+
+func (o *Output) is_requested() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requested
+}
+
+func (o *Output) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requested = false
+	return nil
+}
+
+// Value returns the output's current value.
+func (o *Output) Value() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.value
+}
+
+// History returns every value the output has been set to (including
+// its initial value when requested), oldest first.
+func (o *Output) History() []Change {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	h := make([]Change, len(o.history))
+	copy(h, o.history)
+	return h
+}
+
+// SendWiegand synthesizes a Wiegand frame on inputs 'd0' and 'd1',
+// using DefaultWiegandInterval and DefaultWiegandPulse.  'bits' has
+// one entry (0 or 1) per bit.
+func (c *Chip) SendWiegand(d0 int, d1 int, bits []byte) {
+	c.SendWiegandTimed(d0, d1, bits, DefaultWiegandInterval, DefaultWiegandPulse)
+}
+
+// SendWiegandTimed synthesizes a Wiegand frame on inputs 'd0' and
+// 'd1': each 0 bit is a low pulse on D0, and each 1 bit is a low pulse
+// on D1, 'pulse' long and 'interval' apart.  This returns as soon as
+// every edge has been handled; the edges are spaced out only in the
+// virtual clock (which is then moved past the end of the frame).
+func (c *Chip) SendWiegandTimed(d0 int, d1 int, bits []byte,
+	interval time.Duration, pulse time.Duration) {
+
+	c.mu.Lock()
+	in0 := c.input(d0)
+	in1 := c.input(d1)
+	ts := c.now()
+	c.skew += time.Duration(len(bits)) * interval
+	c.mu.Unlock()
+
+	for _, b := range bits {
+		in := in0
+		if b != 0 {
+			in = in1
+		}
+		in.set_at(0, ts)
+		in.set_at(1, ts+pulse)
+		ts += interval
+	}
+}
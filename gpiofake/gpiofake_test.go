@@ -0,0 +1,173 @@
+package gpiofake
+
+import (
+	"testing"
+	"time"
+
+	"github.com/warthog618/gpiod"
+)
+
+func TestOutputHistory(t *testing.T) {
+	chip := NewChip()
+	line, err := chip.RequestOutput(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line.SetValue(1)
+	line.SetValue(1)
+	line.SetValue(0)
+
+	out := chip.Output(3)
+	if out.Value() != 0 {
+		t.Errorf("Value is %d, expected 0", out.Value())
+	}
+	h := out.History()
+	want := []int{0, 1, 1, 0}
+	if len(h) != len(want) {
+		t.Fatalf("History is %v", h)
+	}
+	for i, c := range h {
+		if c.Value != want[i] {
+			t.Errorf("Change %d is %d, expected %d", i, c.Value, want[i])
+		}
+		if i > 0 && c.Time.Before(h[i - 1].Time) {
+			t.Errorf("Change %d is out of order", i)
+		}
+	}
+
+	line.Close()
+	if err := line.SetValue(1); err == nil {
+		t.Error("Set a closed output")
+	}
+}
+
+func TestInputEdges(t *testing.T) {
+	chip := NewChip()
+	in := chip.Input(5)
+	var events []gpiod.LineEvent
+	line, err := chip.RequestInput(5, gpiod.LineEdgeFalling, func(evt gpiod.LineEvent) {
+		events = append(events, evt)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Inputs start high:
+	if v, err := line.Value(); err != nil || v != 1 {
+		t.Errorf("Value is %d, %v", v, err)
+	}
+
+	in.Set(0)
+	in.Set(0)
+	in.Set(1)
+	in.Set(0)
+	if len(events) != 2 {
+		t.Fatalf("Got %d events, expected 2 falling edges", len(events))
+	}
+	for _, evt := range events {
+		if evt.Type != gpiod.LineEventFallingEdge || evt.Offset != 5 {
+			t.Errorf("Got %+v", evt)
+		}
+	}
+	if events[1].Timestamp < events[0].Timestamp {
+		t.Error("Timestamps go backwards")
+	}
+
+	line.Close()
+	in.Set(1)
+	in.Set(0)
+	if len(events) != 2 {
+		t.Error("Handler called after Close")
+	}
+	if _, err := line.Value(); err == nil {
+		t.Error("Read a closed input")
+	}
+}
+
+func TestRequestConflicts(t *testing.T) {
+	chip := NewChip()
+	if _, err := chip.RequestInput(1, gpiod.LineEdgeNone, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chip.RequestInput(1, gpiod.LineEdgeNone, nil); err == nil {
+		t.Error("Requested an input twice")
+	}
+	if _, err := chip.RequestOutput(1, 0); err == nil {
+		t.Error("Requested an input as an output")
+	}
+
+	out, err := chip.RequestOutput(2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chip.RequestOutput(2, 0); err == nil {
+		t.Error("Requested an output twice")
+	}
+	if _, err := chip.RequestInput(2, gpiod.LineEdgeNone, nil); err == nil {
+		t.Error("Requested an output as an input")
+	}
+	// Once released, it can be requested again:
+	out.Close()
+	if _, err := chip.RequestInput(2, gpiod.LineEdgeNone, nil); err != nil {
+		t.Errorf("Released output: %s", err)
+	}
+
+	chip.Close()
+	if _, err := chip.RequestOutput(3, 0); err == nil {
+		t.Error("Requested a line of a closed chip")
+	}
+}
+
+func TestSendWiegand(t *testing.T) {
+	chip := NewChip()
+	var events [2][]gpiod.LineEvent
+	for i := range events {
+		i := i
+		_, err := chip.RequestInput(i, gpiod.LineEdgeBoth, func(evt gpiod.LineEvent) {
+			events[i] = append(events[i], evt)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	const interval = 2 * time.Millisecond
+	const pulse = 100 * time.Microsecond
+	start := time.Now()
+	chip.SendWiegandTimed(0, 1, []byte{0, 1, 1}, interval, pulse)
+	// The frame is spread out only in the virtual clock:
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Sending took %s", elapsed)
+	}
+
+	if len(events[0]) != 2 || len(events[1]) != 4 {
+		t.Fatalf("Got %d D0 and %d D1 edges", len(events[0]), len(events[1]))
+	}
+	// Each bit is a low pulse on its line:
+	for _, evts := range events {
+		for i, evt := range evts {
+			want := gpiod.LineEventFallingEdge
+			if i % 2 == 1 {
+				want = gpiod.LineEventRisingEdge
+			}
+			if evt.Type != want {
+				t.Errorf("Edge %d of line %d is %v", i, evt.Offset, evt.Type)
+			}
+		}
+	}
+	d0, d1 := events[0], events[1]
+	if w := d0[1].Timestamp - d0[0].Timestamp; w != pulse {
+		t.Errorf("Pulse is %s, expected %s", w, pulse)
+	}
+	if gap := d1[0].Timestamp - d0[0].Timestamp; gap != interval {
+		t.Errorf("Bits are %s apart, expected %s", gap, interval)
+	}
+	if gap := d1[2].Timestamp - d1[0].Timestamp; gap != interval {
+		t.Errorf("Bits are %s apart, expected %s", gap, interval)
+	}
+
+	// The clock is moved past the frame, so later edges come after it:
+	chip.Input(0).Set(0)
+	if last := events[0][len(events[0]) - 1]; last.Timestamp < d1[3].Timestamp {
+		t.Error("Edge after the frame has an earlier timestamp")
+	}
+}
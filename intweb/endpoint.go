@@ -0,0 +1,184 @@
+package intweb
+
+// Failing over between intweb endpoints (Session.URLs), e.g. its public
+// hostname and its LAN address, so that losing one way to reach it
+// (e.g. DNS) doesn't lock anyone out.
+//
+// Every request goes to the first endpoint which hasn't failed lately,
+// so once one fails, the rest are used until it has had endpoint_retry
+// to recover.  If all have failed lately, they are all tried anyway.
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// How long an endpoint that failed is passed over:
+const endpoint_retry = 5 * time.Minute
+
+// endpoint is the state of one of Session.URLs.
+type endpoint struct {
+	url string
+	// When a request last reached it (even if the reply was an error),
+	// and how long that took:
+	last_ok time.Time
+	latency time.Duration
+	// When a request last failed to reach it, and why:
+	last_fail time.Time
+	last_error string
+}
+
+// healthy returns true if the last request to the endpoint reached it,
+// or if it hasn't failed lately.
+func (e *endpoint) healthy(now time.Time) bool {
+	return !e.last_fail.After(e.last_ok) || now.Sub(e.last_fail) > endpoint_retry
+}
+
+// EndpointStatus is the state of one intweb endpoint.
+type EndpointStatus struct {
+	URL string `json:"url"`
+	// False if it failed lately (so it is only tried if all others
+	// fail too):
+	Healthy bool `json:"healthy"`
+	// True if it is the endpoint the last request went to:
+	Current bool `json:"current"`
+	// When a request last reached it, and how long that took:
+	LastOK *time.Time `json:"last_ok,omitempty"`
+	LatencyMs *float64 `json:"latency_ms,omitempty"`
+	// When a request last failed to reach it, and why:
+	LastFailure *time.Time `json:"last_failure,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// init_endpoints sets up s.endpoints from s.URLs, if that hasn't been
+// done yet.  s.mu must be held.
+func (s *Session) init_endpoints() {
+	if s.endpoints != nil {
+		return
+	}
+	s.endpoints = make([]*endpoint, len(s.URLs))
+	for i, url := range s.URLs {
+		s.endpoints[i] = &endpoint{url: url}
+	}
+}
+
+// endpoint_order returns the endpoints in the order to try them: the
+// healthy ones, and then the rest, each in the order of s.URLs.
+func (s *Session) endpoint_order() []*endpoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init_endpoints()
+
+	now := time.Now()
+	order := make([]*endpoint, 0, len(s.endpoints))
+	for _, e := range s.endpoints {
+		if e.healthy(now) {
+			order = append(order, e)
+		}
+	}
+	for _, e := range s.endpoints {
+		if !e.healthy(now) {
+			order = append(order, e)
+		}
+	}
+	return order
+}
+
+// endpoint_result records the result of a request to 'e' which took
+// 'latency', and which failed to reach it with 'err' (if not nil).
+func (s *Session) endpoint_result(e *endpoint, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if err != nil {
+		e.last_fail = now
+		e.last_error = err.Error()
+		return
+	}
+	e.last_ok = now
+	e.latency = latency
+	if s.current != e && len(s.endpoints) > 1 {
+		log.Printf("Using intweb at %s", e.url)
+	}
+	s.current = e
+}
+
+// post_failover POSTs 'msg_json' to each endpoint in turn (see
+// endpoint_order) until one can be reached.  If there is a deadline,
+// each endpoint gets an equal share of the time left, so that one
+// which doesn't answer at all doesn't leave no time for the others.
+//
+// Unless 'repeatable' is true, this only moves on from an endpoint
+// that the message certainly didn't reach (see not_delivered), so that
+// e.g. an access request which timed out isn't logged twice; for one
+// that may have reached it, the error is returned as a
+// *MaybeDeliveredError.
+func (s *Session) post_failover(ctx context.Context, msg_json []byte,
+	repeatable bool) ([]byte, error) {
+
+	order := s.endpoint_order()
+	if len(order) == 0 {
+		return nil, &Error{ Msg: "No intweb URL" }
+	}
+
+	var err error
+	for i, e := range order {
+		try_ctx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(order) - 1 {
+			share := time.Until(deadline) / time.Duration(len(order) - i)
+			try_ctx, cancel = context.WithTimeout(ctx, share)
+		}
+
+		var body []byte
+		start := time.Now()
+		body, err = s.post(try_ctx, e.url, msg_json)
+		cancel()
+		if err == nil || !IsNetworkError(err) {
+			s.endpoint_result(e, time.Since(start), nil)
+			return body, err
+		}
+		s.endpoint_result(e, 0, err)
+		if !repeatable && !not_delivered(err) {
+			return nil, &MaybeDeliveredError{ Err: err }
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+		if i < len(order) - 1 {
+			log.Printf("intweb at %s failed (%s), trying %s", e.url, err, order[i + 1].url)
+		}
+	}
+	return nil, err
+}
+
+// Endpoints returns the state of each of s.URLs.
+func (s *Session) Endpoints() []EndpointStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init_endpoints()
+
+	now := time.Now()
+	st := make([]EndpointStatus, len(s.endpoints))
+	for i, e := range s.endpoints {
+		st[i] = EndpointStatus{
+			URL: e.url,
+			Healthy: e.healthy(now),
+			Current: e == s.current,
+			LastError: e.last_error,
+		}
+		if !e.last_ok.IsZero() {
+			t := e.last_ok
+			ms := float64(e.latency) / float64(time.Millisecond)
+			st[i].LastOK = &t
+			st[i].LatencyMs = &ms
+		}
+		if !e.last_fail.IsZero() {
+			t := e.last_fail
+			st[i].LastFailure = &t
+		}
+	}
+	return st
+}
@@ -3,36 +3,71 @@ package intweb
 // This package is a partial implementation of
 // https://wiki.hive13.org/view/Access_Protocol. As this protocol is
 // considered sort of legacy at this point, it does not put
-// extraordinary effort into correctness - so some things are ignored,
-// such as verifying the checksums on communications with the server.
+// extraordinary effort into correctness - but it does authenticate the
+// server's responses (see Session.Strict and AuthError), since those
+// are what open the door.
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"crypto/rand"
 	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/hex"
 	"encoding/json"
 	"io/ioutil"
-	"math/rand"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
 )
 
-// Session contains parameters for intweb communications.
+// Session contains parameters for intweb communications, and the
+// nonce to use for the next request.
 //
-// "Session" is something of a misnomer as this struct contains no
-// state, though conceivably it could present a nicer interface by
-// doing so (e.g. for things like the nonce the server uses).
+// Every reply from the server has a new nonce, so a Session keeps the
+// last one and uses it for the next request (see with_nonce), and only
+// asks for one with GetNonce when it has none, or when the server
+// rejects it.  A Session is safe for concurrent use, but must not be
+// copied after it is first used.
 type Session struct {
 	// The name of the device
 	Device string
 	// The device key
 	DeviceKey []byte
-	// The URL of the intweb server, including /api/access.
-	URL string
+	// The URLs of the intweb server, including /api/access, in order
+	// of preference (e.g. its hostname, then its LAN address); requests
+	// fail over between them (see endpoint.go).
+	URLs []string
 	// Set true for more verbose logging
 	Verbose bool
 	// The HTTP client (if a custom one is needed)
 	Client *http.Client
+	// Every successful response must be authenticated (see decode).
+	// If this is true, so must every response that reports failure;
+	// otherwise, those are accepted without a checksum.
+	Strict bool
+	// How to retry requests which fail to reach intweb (see
+	// RetryPolicy); the zero value never retries:
+	Retry RetryPolicy
+	// When to stop trying intweb for a while after failures (see
+	// BreakerPolicy); the zero value never does:
+	Breaker BreakerPolicy
+
+	// mu guards everything below:
+	mu sync.Mutex
+	// Nonce from the last reply ("" if none, or if it has been used):
+	nonce string
+	// Circuit breaker state (see retry.go):
+	failures int
+	open_until time.Time
+	// State of each of URLs, and the one last used (see endpoint.go):
+	endpoints []*endpoint
+	current *endpoint
 }
 
 // PostIntweb POSTs a message to the intweb server, returning the reply.
@@ -40,16 +75,41 @@ type Session struct {
 // Having a proper message format, including nonces and checksums, is
 // up to the caller. This call does not do it.
 func (s *Session) PostIntweb(data interface {}) ([]byte, error) {
+	return s.PostIntwebContext(context.Background(), data)
+}
+
+// PostIntwebContext is PostIntweb, giving up if 'ctx' is cancelled
+// or expires first.  This fails over between s.URLs, but (as the
+// message may not be safe to send twice) only past URLs that it
+// certainly didn't reach (see post_failover).
+func (s *Session) PostIntwebContext(ctx context.Context, data interface {}) ([]byte, error) {
+	return s.post_message(ctx, data, false)
+}
+
+// post_message is PostIntwebContext; 'repeatable' is true if the
+// message is safe to send more than once (see post_failover).
+func (s *Session) post_message(ctx context.Context, data interface {},
+	repeatable bool) ([]byte, error) {
+
 	msg_json, err := json.Marshal(data)
 	if err != nil {
 		return nil, err
 	}
+	return s.post_failover(ctx, msg_json, repeatable)
+}
 
+// post POSTs a message to one intweb URL (see PostIntwebContext).
+func (s *Session) post(ctx context.Context, url string, msg_json []byte) ([]byte, error) {
 	if s.Verbose {
-		log.Printf("Request: POST to %s: %s", s.URL, msg_json)
+		log.Printf("Request: POST to %s: %s", url, msg_json)
 	}
 
-	resp, err := s.Client.Post(s.URL, "application/json", bytes.NewBuffer(msg_json))
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(msg_json))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.Client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -62,6 +122,7 @@ func (s *Session) PostIntweb(data interface {}) ([]byte, error) {
 		return nil, &Error{
 			Msg: fmt.Sprintf("HTTP code %d", resp.StatusCode),
 			Resp: nil,
+			HTTPStatus: resp.StatusCode,
 		}
 	}
 	if err != nil {
@@ -73,12 +134,35 @@ func (s *Session) PostIntweb(data interface {}) ([]byte, error) {
 
 // GetNonce requests a new nonce from the server.
 //
-// This is a necessary first step for many other requests.
+// Requests that need a nonce get one themselves (see with_nonce), so
+// this is only needed to talk to the server directly.
 func (s *Session) GetNonce() (string, error) {
+	return s.GetNonceContext(context.Background())
+}
+
+// GetNonceContext is GetNonce, giving up if 'ctx' is cancelled or
+// expires first.  Like every request, this is retried, and may be
+// refused while the circuit breaker is open (see retry.go).
+func (s *Session) GetNonceContext(ctx context.Context) (string, error) {
+	var nonce string
+	err := s.call(ctx, func(ctx context.Context) error {
+		var err error
+		nonce, err = s.get_nonce(ctx)
+		return err
+	})
+	return nonce, err
+}
+
+// get_nonce makes a nonce request (see GetNonceContext).
+func (s *Session) get_nonce(ctx context.Context) (string, error) {
+	challenge, err := randomResponse()
+	if err != nil {
+		return "", err
+	}
 	d := MessageData{
 		Operation: "get_nonce",
 		Version: 2,
-		RandomResponse: randomResponse(),
+		RandomResponse: challenge,
 	}
 	cs, err := checksum(s.DeviceKey, d)
 	if err != nil {
@@ -91,17 +175,12 @@ func (s *Session) GetNonce() (string, error) {
 		"checksum": fmt.Sprintf("%X", cs),
 	}
 
-	resp_bytes, err := s.PostIntweb(msg)
+	resp_bytes, err := s.post_message(ctx, msg, true)
 	if err != nil {
 		return "", err
 	}
 
-	var resp Response
-	err = json.Unmarshal(resp_bytes, &resp)
-	if err != nil {
-		return "", err
-	}
-	data, err := DecodeAndCheck(&resp)
+	data, err := s.decode(resp_bytes, d.RandomResponse)
 	if err != nil {
 		return "", err
 	}
@@ -109,24 +188,138 @@ func (s *Session) GetNonce() (string, error) {
 	return data.NewNonce, nil
 }
 
+// take_nonce returns the nonce from the last reply (or "" if there is
+// none), so that no other request uses it too.
+func (s *Session) take_nonce() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nonce := s.nonce
+	s.nonce = ""
+	return nonce
+}
+
+// put_nonce keeps a nonce from a reply for the next request.
+func (s *Session) put_nonce(nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nonce = nonce
+}
+
+// with_nonce calls 'req' to make a request with a nonce: the one from
+// the last reply if there is one, or else a new one from GetNonce.  If
+// the server rejects a nonce from a previous reply (e.g. because it
+// has expired), this gets a new one and calls 'req' again.  The nonce
+// in the reply is kept for the next request.
+func (s *Session) with_nonce(ctx context.Context,
+	req func(nonce string) (*RespData, error)) (*RespData, error) {
+
+	nonce := s.take_nonce()
+	reused := nonce != ""
+	for {
+		if nonce == "" {
+			var err error
+			nonce, err = s.get_nonce(ctx)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		data, err := req(nonce)
+		if err != nil {
+			if reused && nonce_rejected(err) {
+				if s.Verbose {
+					log.Printf("Nonce from last reply was rejected, getting a new one")
+				}
+				nonce = ""
+				reused = false
+				continue
+			}
+			return nil, err
+		}
+
+		s.put_nonce(data.NewNonce)
+		return data, nil
+	}
+}
+
+// nonce_rejected returns true if 'err' is from the server rejecting the
+// nonce that was sent (see DecodeAndCheck).
+func nonce_rejected(err error) bool {
+	var intweb_err *Error
+	if !errors.As(err, &intweb_err) || intweb_err.Resp == nil {
+		return false
+	}
+	return intweb_err.Resp.Response && !intweb_err.Resp.NonceValid
+}
+
 // Access requests access to some item for some badge number.
 //
 // Item and badge number must be in exactly the same format as in the
-// intweb database.  Nonce must also be supplied, e.g. from a previous
-// GetNonce() call.
-func (s *Session) Access(nonce string, item string, badge uint64) (bool, string, error) {
+// intweb database.
+func (s *Session) Access(item string, badge Badge) (bool, string, error) {
+	return s.AccessAtContext(context.Background(), item, badge, time.Time{})
+}
+
+// AccessContext is Access, giving up if 'ctx' is cancelled or expires
+// first.  Like every request, this may be refused while the circuit
+// breaker is open, and is retried, but only if it certainly didn't
+// reach intweb (see retry.go).
+func (s *Session) AccessContext(ctx context.Context, item string, badge Badge) (bool, string, error) {
+	return s.AccessAtContext(ctx, item, badge, time.Time{})
+}
+
+// AccessAt is Access, for an access attempt made earlier at time 'at'
+// which couldn't be reported then (e.g. because intweb was down).  If
+// 'at' is zero, this is the same as Access.
+//
+// The time is sent as "timestamp" (in Unix seconds), which is an
+// extension to the Access Protocol; a server which doesn't support it
+// will just log the access at the time it receives it.
+func (s *Session) AccessAt(item string, badge Badge, at time.Time) (bool, string, error) {
+	return s.AccessAtContext(context.Background(), item, badge, at)
+}
+
+// AccessAtContext is AccessAt, giving up if 'ctx' is cancelled or
+// expires first (as for AccessContext).
+func (s *Session) AccessAtContext(ctx context.Context, item string, badge Badge,
+	at time.Time) (bool, string, error) {
 
+	var data *RespData
+	err := s.call(ctx, func(ctx context.Context) error {
+		var err error
+		data, err = s.with_nonce(ctx, func(nonce string) (*RespData, error) {
+			return s.access(ctx, nonce, item, badge, at)
+		})
+		return err
+	})
+	if err != nil {
+		return false, "", err
+	}
+	return data.Access, data.Error, nil
+}
+
+// access makes an access request with 'nonce' (see AccessAt).
+func (s *Session) access(ctx context.Context, nonce string, item string, badge Badge,
+	at time.Time) (*RespData, error) {
+
+	challenge, err := randomResponse()
+	if err != nil {
+		return nil, err
+	}
 	d := AccessReqData{
 		Operation: "access",
 		Version: 2,
-		RandomResponse: randomResponse(),
+		RandomResponse: challenge,
 		Nonce: nonce,
 		Item: item,
 		Badge: badge,
 	}
+	if !at.IsZero() {
+		d.Timestamp = at.Unix()
+	}
 	cs, err := checksum(s.DeviceKey, d)
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
 	
 	msg := map[string](interface {}){
@@ -135,46 +328,162 @@ func (s *Session) Access(nonce string, item string, badge uint64) (bool, string,
 		"checksum": fmt.Sprintf("%X", cs),
 	}
 
-	resp_bytes, err := s.PostIntweb(msg)
+	resp_bytes, err := s.PostIntwebContext(ctx, msg)
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
 
-	var resp Response
-	err = json.Unmarshal(resp_bytes, &resp)
+	return s.decode(resp_bytes, d.RandomResponse)
+}
+
+// BadgeList requests the full list of badges which are allowed access
+// to some item.
+//
+// This is the "badge_list" operation, which is an extension to the
+// Access Protocol; the server must support it.
+func (s *Session) BadgeList(item string) ([]Badge, error) {
+	return s.BadgeListContext(context.Background(), item)
+}
+
+// BadgeListContext is BadgeList, giving up if 'ctx' is cancelled or
+// expires first (as for AccessContext).
+func (s *Session) BadgeListContext(ctx context.Context, item string) ([]Badge, error) {
+	var data *RespData
+	err := s.call(ctx, func(ctx context.Context) error {
+		var err error
+		data, err = s.with_nonce(ctx, func(nonce string) (*RespData, error) {
+			return s.badge_list(ctx, nonce, item)
+		})
+		return err
+	})
 	if err != nil {
-		return false, "", err
+		return nil, err
 	}
-	data, err := DecodeAndCheck(&resp)
+	if data.Badges == nil {
+		return nil, &Error{ Msg: "No badge list in reply", Resp: data }
+	}
+
+	return data.Badges, nil
+}
+
+// badge_list makes a badge list request with 'nonce' (see BadgeList).
+func (s *Session) badge_list(ctx context.Context, nonce string, item string) (*RespData, error) {
+
+	challenge, err := randomResponse()
 	if err != nil {
-		return false, "", err
+		return nil, err
+	}
+	d := BadgeListReqData{
+		Item: item,
+		Nonce: nonce,
+		Operation: "badge_list",
+		RandomResponse: challenge,
+		Version: 2,
+	}
+	cs, err := checksum(s.DeviceKey, d)
+	if err != nil {
+		return nil, err
 	}
 
-	return data.Access, data.Error, nil
+	msg := map[string](interface {}){
+		"data": d,
+		"device": s.Device,
+		"checksum": fmt.Sprintf("%X", cs),
+	}
+
+	resp_bytes, err := s.post_message(ctx, msg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.decode(resp_bytes, d.RandomResponse)
+}
+
+// IsNetworkError returns true if 'err' (from a Session call) is from
+// not being able to reach intweb (as opposed to intweb replying with
+// an error), including when the circuit breaker is open, and an HTTP
+// server error (e.g. from a proxy whose backend is down).  These are
+// the failures which are retried, which count towards the breaker,
+// and which move on to the next of Session.URLs, and callers should
+// treat them as intweb being down.
+func IsNetworkError(err error) bool {
+	var net_err net.Error
+	var open_err *BreakerOpenError
+	var intweb_err *Error
+	return errors.As(err, &net_err) || errors.As(err, &open_err) ||
+		(errors.As(err, &intweb_err) && intweb_err.HTTPStatus >= 500)
 }
 
 // MessageData contains the data for a generic message that is sent to
 // intweb, e.g. to request a new nonce.
 type MessageData struct {
 	Operation      string `json:"operation"`
+	// The challenge (from randomResponse), which the server's reply
+	// must echo (see Session.decode); likewise in every request type:
 	RandomResponse []int  `json:"random_response"`
 	Version        int    `json:"version"`
 	// These fields must remain in sorted order for the checksum.
 }
 
+// Badge is a badge identifier in the form that intweb stores it.
+//
+// Most badges are plain numbers and are sent as a JSON number.
+// Anything else (e.g. "FC:CN" style badges) is sent as a JSON string.
+type Badge string
+
+// BadgeNumber returns the Badge for a plain badge number.
+func BadgeNumber(n uint64) Badge {
+	return Badge(strconv.FormatUint(n, 10))
+}
+
+func (b Badge) MarshalJSON() ([]byte, error) {
+	if n, err := strconv.ParseUint(string(b), 10, 64); err == nil {
+		return []byte(strconv.FormatUint(n, 10)), nil
+	}
+	return json.Marshal(string(b))
+}
+
+// UnmarshalJSON accepts a badge as either a JSON number or a string.
+func (b *Badge) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		*b = Badge(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*b = Badge(n.String())
+	return nil
+}
+
 // AccessReqData contains the data for an access request message that
 // is sent to intweb.
 type AccessReqData struct {
-	Badge          uint64 `json:"badge"` 
+	Badge          Badge  `json:"badge"`
 	Item           string `json:"item"`
 	Nonce          string `json:"nonce"`
 	Operation      string `json:"operation"`
 	RandomResponse []int  `json:"random_response"`
+	// Only for AccessAt:
+	Timestamp      int64  `json:"timestamp,omitempty"`
 	Version        int    `json:"version"`
 	// These fields must remain in sorted order for the checksum.
 	// Ordinarily I would have just embedded MessageData.
 }
 
+// BadgeListReqData contains the data for a badge list request message
+// that is sent to intweb.
+type BadgeListReqData struct {
+	Item           string `json:"item"`
+	Nonce          string `json:"nonce"`
+	Operation      string `json:"operation"`
+	RandomResponse []int  `json:"random_response"`
+	Version        int    `json:"version"`
+	// These fields must remain in sorted order for the checksum.
+}
+
 // Response is a catch-all structure for a response from intweb.
 //
 // In theory, we could parse this in different ways depending on which
@@ -182,6 +491,7 @@ type AccessReqData struct {
 // the server-side implementation is even hairier, so I really don't
 // care.
 type Response struct {
+	Checksum string          `json:"checksum"`
 	Data     json.RawMessage `json:"data"`
 	Response *bool           `json:"response"`
 	Version  string          `json:"version"`
@@ -206,6 +516,8 @@ type RespData struct {
 	Data           string `json:"data"`
 	Access         bool   `json:"access"`
 	Error          string `json:"error"`
+	// Only from a badge list request:
+	Badges         []Badge `json:"badges"`
 }
 
 // An error reported by the intweb server.
@@ -215,16 +527,135 @@ type Error struct {
 	Msg string
 	// The actual response that produced this error:
 	Resp *RespData
+	// The HTTP status code, if that was the error (otherwise 0):
+	HTTPStatus int
 }
 
 func (err *Error) Error() string {
 	return fmt.Sprintf("intweb reported error: %s", err.Msg)
 }
 
+// An error from a response which failed authentication, i.e. which
+// may not be from the intweb server at all.
+type AuthError struct {
+	Msg string
+}
+
+func (err *AuthError) Error() string {
+	return fmt.Sprintf("intweb response failed authentication: %s", err.Msg)
+}
+
+// IsAuthError returns true if 'err' (from a Session call) is an
+// AuthError.
+func IsAuthError(err error) bool {
+	var auth_err *AuthError
+	return errors.As(err, &auth_err)
+}
+
+// decode parses and checks a response (see DecodeAndCheck), and
+// authenticates it: its checksum must be right for s.DeviceKey, and it
+// must echo 'challenge' (the random_response that was sent) in its
+// own random_response.
+//
+// Unless s.Strict is set, a response that only reports failure (which
+// can only refuse something, and which the server may not sign) may
+// have no checksum, but one that it does have must still be right.
+func (s *Session) decode(resp_bytes []byte, challenge []int) (*RespData, error) {
+	var resp Response
+	err := json.Unmarshal(resp_bytes, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.Checksum != "" {
+		if !verify_checksum(s.DeviceKey, resp.Data, resp.Checksum) {
+			return nil, &AuthError{ Msg: "Checksum is wrong" }
+		}
+	}
+
+	data, err := DecodeAndCheck(&resp)
+	if err != nil {
+		if resp.Checksum == "" && s.Strict {
+			return nil, &AuthError{ Msg: "No checksum on failure reply" }
+		}
+		return nil, err
+	}
+
+	// This is a successful response, so it must be authenticated:
+	if resp.Checksum == "" {
+		return nil, &AuthError{ Msg: "No checksum" }
+	}
+	if !same_ints(data.RandomResponse, challenge) {
+		return nil, &AuthError{ Msg: "random_response doesn't match the one sent" }
+	}
+
+	return data, nil
+}
+
+// verify_checksum returns true if 'cs' (in hex) is the checksum of
+// 'data' for 'key'.  The server computes it over its own encoding of
+// the data, so this tries both the data exactly as received (less any
+// whitespace) and a canonical encoding (with sorted keys, as requests
+// use).
+func verify_checksum(key []byte, data json.RawMessage, cs string) bool {
+	want, err := hex.DecodeString(cs)
+	if err != nil {
+		return false
+	}
+
+	var candidates [][]byte
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err == nil {
+		candidates = append(candidates, compact.Bytes())
+	}
+	if canonical, err := canonical_json(data); err == nil {
+		candidates = append(candidates, canonical)
+	}
+
+	for _, c := range candidates {
+		if subtle.ConstantTimeCompare(checksumRaw(key, c), want) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// canonical_json re-encodes JSON with sorted keys and no whitespace.
+func canonical_json(data json.RawMessage) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// same_ints returns true if 'a' and 'b' have the same values.
+func same_ints(a []int, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // DecodeAndCheck attempts to parse a Response into RespData.
 //
 // Returns an error if this fails. Errors may be from JSON
-// unmarshaling, or may be an intweb.Error.
+// unmarshaling, or may be an intweb.Error.  This does not authenticate
+// the response (Session calls do that as well; see Session.decode).
 func DecodeAndCheck(r *Response) (*RespData, error) {
 
 	if r.Response != nil && !(*r.Response) {
@@ -249,18 +680,23 @@ func DecodeAndCheck(r *Response) (*RespData, error) {
 		return nil, &Error{ Msg: "Nonce invalid", Resp: &data }
 	}
 
-	// TODO: Check checksums and random response?
-
 	return &data, nil
 }
 
-// randomResponse returns an array with 16 random values (0-255).
-func randomResponse() []int {
-	resp := make([]int, 16)
-	for i, _ := range resp {
-		resp[i] = rand.Intn(256)
+// randomResponse returns an array with 16 random values (0-255), for
+// a request's challenge.  These come from crypto/rand, since a
+// challenge that can be predicted (as math/rand's unseeded sequence
+// can) would let a reply be forged ahead of time.
+func randomResponse() ([]int, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	resp := make([]int, len(buf))
+	for i, b := range buf {
+		resp[i] = int(b)
 	}
-	return resp
+	return resp, nil
 }
 
 // checksumRaw returns the SHA-512 checksum for a given device key and data.
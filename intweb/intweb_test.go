@@ -0,0 +1,143 @@
+package intweb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+var (
+	test_key = []byte("device key")
+	test_challenge = []int{3, 1, 4, 1, 5, 9, 2, 6}
+)
+
+// reply returns a reply with 'data' (as JSON), signed with 'key' unless
+// it is nil.
+func reply(key []byte, response bool, data string) []byte {
+	msg := fmt.Sprintf(`{"response": %t, "data": %s`, response, data)
+	if key != nil {
+		msg += fmt.Sprintf(`, "checksum": "%X"`, checksumRaw(key, []byte(data)))
+	}
+	return []byte(msg + "}")
+}
+
+// access_data returns the data for an access reply which echoes
+// 'challenge'.
+func access_data(access bool, challenge []int) string {
+	echo, _ := json.Marshal(challenge)
+	return fmt.Sprintf(`{"access":%t,"error":"","new_nonce":"n2","nonce_valid":true,"random_response":%s,"response":true}`,
+		access, echo)
+}
+
+func TestDecodeSigned(t *testing.T) {
+	s := &Session{DeviceKey: test_key}
+	data, err := s.decode(reply(test_key, true, access_data(true, test_challenge)), test_challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !data.Access || data.NewNonce != "n2" {
+		t.Errorf("Decoded as access %t, new nonce %q", data.Access, data.NewNonce)
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	other := []int{2, 7, 1, 8, 2, 8, 1, 8}
+	tampered := reply(test_key, true, access_data(false, test_challenge))
+	tampered = []byte(string(tampered[:len(`{"response": true, "data": {"access":`)]) + "true " +
+		string(tampered[len(`{"response": true, "data": {"access":false`):]))
+
+	tests := []struct {
+		name string
+		resp []byte
+	}{
+		{"unsigned", reply(nil, true, access_data(true, test_challenge))},
+		{"unsigned denial", reply(nil, true, access_data(false, test_challenge))},
+		{"wrong key", reply([]byte("other key"), true, access_data(true, test_challenge))},
+		{"tampered", tampered},
+		{"no echo", reply(test_key, true, `{"access":true,"nonce_valid":true,"response":true}`)},
+		{"wrong echo", reply(test_key, true, access_data(true, other))},
+		{"short echo", reply(test_key, true, access_data(true, test_challenge[:4]))},
+		{"bad checksum", []byte(`{"response": true, "checksum": "not hex", "data": ` +
+			access_data(true, test_challenge) + `}`)},
+	}
+	for _, strict := range []bool{false, true} {
+		s := &Session{DeviceKey: test_key, Strict: strict}
+		for _, test := range tests {
+			data, err := s.decode(test.resp, test_challenge)
+			if !IsAuthError(err) {
+				t.Errorf("%s (strict %t): got %+v, %v; expected an AuthError",
+					test.name, strict, data, err)
+			}
+		}
+	}
+}
+
+// Failure replies needn't be signed, except with Session.Strict, but a
+// bad checksum on one is still refused.
+func TestDecodeFailure(t *testing.T) {
+	unsigned := reply(nil, false, `"Unknown device"`)
+	s := &Session{DeviceKey: test_key}
+	_, err := s.decode(unsigned, test_challenge)
+	var intweb_err *Error
+	if !errors.As(err, &intweb_err) || intweb_err.Msg != "Unknown device" {
+		t.Errorf("Unsigned failure reply: got %v", err)
+	}
+
+	s.Strict = true
+	if _, err := s.decode(unsigned, test_challenge); !IsAuthError(err) {
+		t.Errorf("Unsigned failure reply, strict: got %v", err)
+	}
+	_, err = s.decode(reply(test_key, false, `"Unknown device"`), test_challenge)
+	if !errors.As(err, &intweb_err) || IsAuthError(err) {
+		t.Errorf("Signed failure reply, strict: got %v", err)
+	}
+
+	s.Strict = false
+	if _, err := s.decode(reply([]byte("other key"), false, `"x"`), test_challenge); !IsAuthError(err) {
+		t.Errorf("Wrongly signed failure reply: got %v", err)
+	}
+}
+
+// The server may encode its data with other key order or spacing than
+// this does, so the checksum is checked against both the data as sent
+// and a canonical encoding.
+func TestVerifyChecksum(t *testing.T) {
+	canonical := `{"a":1,"b":[1,2],"c":{"d":"e","f":true}}`
+	cs := fmt.Sprintf("%X", checksumRaw(test_key, []byte(canonical)))
+	for _, data := range []string{
+		canonical,
+		`{"c": {"f": true, "d": "e"}, "b": [1, 2], "a": 1}`,
+		"{\n  \"a\": 1,\n  \"b\": [1, 2],\n  \"c\": {\"d\": \"e\", \"f\": true}\n}",
+	} {
+		if !verify_checksum(test_key, json.RawMessage(data), cs) {
+			t.Errorf("Checksum doesn't verify for %s", data)
+		}
+	}
+	// As sent, even if not canonical:
+	sent := `{"b":2,"a":1}`
+	if !verify_checksum(test_key, json.RawMessage(sent),
+		fmt.Sprintf("%x", checksumRaw(test_key, []byte(sent)))) {
+		t.Errorf("Checksum doesn't verify for data as sent")
+	}
+	for _, data := range []string{`{"a":2,"b":[1,2],"c":{"d":"e","f":true}}`, `{"a":1}`} {
+		if verify_checksum(test_key, json.RawMessage(data), cs) {
+			t.Errorf("Checksum verifies for the wrong data %s", data)
+		}
+	}
+	if verify_checksum([]byte("other key"), json.RawMessage(canonical), cs) {
+		t.Errorf("Checksum verifies with the wrong key")
+	}
+}
+
+func TestRequestChecksum(t *testing.T) {
+	d := MessageData{Operation: "get_nonce", RandomResponse: []int{1, 2}, Version: 2}
+	cs, err := checksum(test_key, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := checksumRaw(test_key, []byte(`{"operation":"get_nonce","random_response":[1,2],"version":2}`))
+	if fmt.Sprintf("%X", cs) != fmt.Sprintf("%X", want) {
+		t.Errorf("Checksum is over something other than the sorted JSON")
+	}
+}
@@ -0,0 +1,164 @@
+package intweb
+
+// Retrying requests that fail to reach intweb, and the circuit breaker
+// which stops trying intweb for a while once enough requests in a row
+// have failed to reach it - so that, while it is down, a badge goes
+// straight to whatever the caller falls back on (e.g. the cache)
+// rather than waiting out a timeout every time.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// RetryPolicy says how to retry a request which fails to reach intweb
+// (see IsNetworkError).  A request which intweb replied to with an
+// error is never retried, and nor is an access request which may have
+// reached intweb (see MaybeDeliveredError).
+type RetryPolicy struct {
+	// Times to try a request in all (0 or 1 for no retries):
+	Attempts int
+	// Time to wait before the first retry, which doubles for each
+	// retry after that:
+	Delay time.Duration
+}
+
+// BreakerPolicy says when to stop trying intweb.
+type BreakerPolicy struct {
+	// Number of requests in a row which fail to reach intweb (after
+	// all of their retries) before the breaker opens; 0 for never:
+	Failures int
+	// Time the breaker stays open.  After this, requests try intweb
+	// again, but the first failure opens it again.
+	Cooldown time.Duration
+}
+
+// BreakerOpenError is returned instead of trying intweb while the
+// circuit breaker is open.
+type BreakerOpenError struct {
+	// When the breaker closes again:
+	Until time.Time
+}
+
+func (err *BreakerOpenError) Error() string {
+	return fmt.Sprintf("intweb unreachable, not trying it again until %s",
+		err.Until.Format("15:04:05"))
+}
+
+// MaybeDeliveredError is returned when a request which isn't safe to
+// send twice (e.g. an access request, which intweb logs) failed in a
+// way that it may still have reached intweb, e.g. a timeout waiting
+// for the reply or an HTTP server error.  It isn't retried, but still
+// counts as intweb being down (see IsNetworkError).
+type MaybeDeliveredError struct {
+	Err error
+}
+
+func (err *MaybeDeliveredError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *MaybeDeliveredError) Unwrap() error {
+	return err.Err
+}
+
+// IsMaybeDelivered returns true if 'err' is (or wraps) a
+// MaybeDeliveredError, i.e. the request may have reached intweb even
+// though it failed.
+func IsMaybeDelivered(err error) bool {
+	var maybe_err *MaybeDeliveredError
+	return errors.As(err, &maybe_err)
+}
+
+// not_delivered returns true if 'err', from a request, means that it
+// certainly never reached intweb: the breaker was open, or connecting
+// failed (including looking up its name).
+func not_delivered(err error) bool {
+	var open_err *BreakerOpenError
+	var dns_err *net.DNSError
+	var op_err *net.OpError
+	return errors.As(err, &open_err) || errors.As(err, &dns_err) ||
+		(errors.As(err, &op_err) && op_err.Op == "dial")
+}
+
+// call makes a request with 'req' (unless the breaker is open),
+// retrying it according to s.Retry, and updates the breaker.
+func (s *Session) call(ctx context.Context, req func(ctx context.Context) error) error {
+	if until, open := s.breaker_open(); open {
+		return &BreakerOpenError{ Until: until }
+	}
+
+	attempts := s.Retry.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := s.Retry.Delay
+	var err error
+	for i := 0; i < attempts; i += 1 {
+		if i > 0 {
+			if s.Verbose {
+				log.Printf("Retrying intweb request in %s, after: %s", delay, err)
+			}
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				break
+			}
+			delay *= 2
+		}
+		err = req(ctx)
+		var maybe_err *MaybeDeliveredError
+		if err == nil || !IsNetworkError(err) || errors.As(err, &maybe_err) ||
+			ctx.Err() != nil {
+			break
+		}
+	}
+
+	s.breaker_result(ctx, err)
+	return err
+}
+
+// breaker_open returns true (and when it closes) if the breaker is
+// open.
+func (s *Session) breaker_open() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Now().Before(s.open_until) {
+		return s.open_until, true
+	}
+	return time.Time{}, false
+}
+
+// breaker_result updates the breaker after a request which returned
+// 'err'.
+func (s *Session) breaker_result(ctx context.Context, err error) {
+	// A request that was cancelled (rather than timing out) says
+	// nothing about intweb:
+	if ctx.Err() == context.Canceled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil || !IsNetworkError(err) {
+		if s.Breaker.Failures > 0 && s.failures >= s.Breaker.Failures {
+			log.Printf("intweb is reachable again, closing circuit breaker")
+		}
+		s.failures = 0
+		s.open_until = time.Time{}
+		return
+	}
+
+	s.failures += 1
+	if s.Breaker.Failures > 0 && s.failures >= s.Breaker.Failures {
+		s.open_until = time.Now().Add(s.Breaker.Cooldown)
+		log.Printf("intweb failed %d times in a row, not trying it for %s",
+			s.failures, s.Breaker.Cooldown)
+	}
+}
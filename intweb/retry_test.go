@@ -0,0 +1,182 @@
+package intweb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+var test_refused = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func TestIsNetworkError(t *testing.T) {
+	read := &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset")}
+	tests := []struct {
+		err error
+		network bool
+		not_delivered bool
+		maybe bool
+	}{
+		{nil, false, false, false},
+		{test_refused, true, true, false},
+		{read, true, false, false},
+		{&net.DNSError{Err: "no such host", Name: "intweb"}, true, true, false},
+		{&BreakerOpenError{}, true, true, false},
+		{&Error{Msg: "HTTP code 502", HTTPStatus: 502}, true, false, false},
+		{&Error{Msg: "HTTP code 404", HTTPStatus: 404}, false, false, false},
+		{&Error{Msg: "Unknown device"}, false, false, false},
+		{&AuthError{Msg: "No checksum"}, false, false, false},
+		{&MaybeDeliveredError{Err: read}, true, false, true},
+		{fmt.Errorf("wrapped: %w", test_refused), true, true, false},
+		{fmt.Errorf("wrapped: %w", &MaybeDeliveredError{Err: read}), true, false, true},
+	}
+	for _, test := range tests {
+		if IsNetworkError(test.err) != test.network {
+			t.Errorf("IsNetworkError(%v) is %t", test.err, !test.network)
+		}
+		if not_delivered(test.err) != test.not_delivered {
+			t.Errorf("not_delivered(%v) is %t", test.err, !test.not_delivered)
+		}
+		if IsMaybeDelivered(test.err) != test.maybe {
+			t.Errorf("IsMaybeDelivered(%v) is %t", test.err, !test.maybe)
+		}
+	}
+}
+
+// failing returns a request for Session.call which fails with each of
+// 'errs' in turn (and then succeeds), and counts how many times it was
+// made.
+func failing(errs ...error) (func(ctx context.Context) error, *int) {
+	n := 0
+	return func(ctx context.Context) error {
+		n += 1
+		if n <= len(errs) {
+			return errs[n - 1]
+		}
+		return nil
+	}, &n
+}
+
+func TestCallRetries(t *testing.T) {
+	s := &Session{Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond}}
+
+	req, n := failing(test_refused, test_refused)
+	if err := s.call(context.Background(), req); err != nil || *n != 3 {
+		t.Errorf("Two failures: %v after %d tries", err, *n)
+	}
+	req, n = failing(test_refused, test_refused, test_refused)
+	if err := s.call(context.Background(), req); err != test_refused || *n != 3 {
+		t.Errorf("Three failures: %v after %d tries", err, *n)
+	}
+
+	// Not retried: an error from intweb, or a request that may have
+	// reached it.
+	for _, e := range []error{
+		&Error{Msg: "Unknown device"},
+		&MaybeDeliveredError{Err: &Error{HTTPStatus: 500}},
+	} {
+		req, n = failing(e)
+		if err := s.call(context.Background(), req); err != e || *n != 1 {
+			t.Errorf("%v: %v after %d tries", e, err, *n)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	const cooldown = 50 * time.Millisecond
+	s := &Session{Breaker: BreakerPolicy{Failures: 2, Cooldown: cooldown}}
+
+	// An error reply from intweb means it's up:
+	req, _ := failing(test_refused, &Error{Msg: "Unknown device"}, test_refused)
+	for i := 0; i < 4; i++ {
+		s.call(context.Background(), req)
+	}
+	if _, open := s.breaker_open(); open {
+		t.Fatal("Breaker opened without failures in a row")
+	}
+
+	req, n := failing(test_refused, test_refused)
+	s.call(context.Background(), req)
+	s.call(context.Background(), req)
+	var open_err *BreakerOpenError
+	if err := s.call(context.Background(), req); !errors.As(err, &open_err) || *n != 2 {
+		t.Fatalf("After two failures: %v after %d tries", err, *n)
+	}
+	if !IsNetworkError(open_err) {
+		t.Error("BreakerOpenError isn't a network error")
+	}
+
+	// After the cooldown, intweb is tried again, and closes the
+	// breaker if it answers:
+	time.Sleep(2 * cooldown)
+	if err := s.call(context.Background(), req); err != nil || *n != 3 {
+		t.Fatalf("After cooldown: %v after %d tries", err, *n)
+	}
+	if _, open := s.breaker_open(); open {
+		t.Error("Breaker still open after success")
+	}
+}
+
+// A cancelled request (e.g. on shutdown) doesn't count against intweb.
+func TestBreakerCancelled(t *testing.T) {
+	s := &Session{Breaker: BreakerPolicy{Failures: 1, Cooldown: time.Hour}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req, _ := failing(test_refused)
+	s.call(ctx, req)
+	if _, open := s.breaker_open(); open {
+		t.Error("Breaker opened by a cancelled request")
+	}
+}
+
+// An access request that gets an HTTP server error may have been
+// logged, so it isn't retried, and the error says so; a nonce request
+// is safe to retry.
+func TestAccessNotRetried(t *testing.T) {
+	var mu sync.Mutex
+	counts := map[string]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Data struct {
+				Operation string `json:"operation"`
+				RandomResponse []int `json:"random_response"`
+			} `json:"data"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		counts[req.Data.Operation] += 1
+		n := counts[req.Data.Operation]
+		mu.Unlock()
+
+		if req.Data.Operation == "access" || n == 1 {
+			http.Error(w, "down", http.StatusInternalServerError)
+			return
+		}
+		echo, _ := json.Marshal(req.Data.RandomResponse)
+		data := fmt.Sprintf(`{"error":"","new_nonce":"n1","nonce_valid":true,"random_response":%s,"response":true}`, echo)
+		w.Write(reply(test_key, true, data))
+	}))
+	defer srv.Close()
+
+	s := &Session{
+		DeviceKey: test_key,
+		URLs: []string{srv.URL},
+		Client: srv.Client(),
+		Retry: RetryPolicy{Attempts: 3, Delay: time.Millisecond},
+	}
+	_, _, err := s.AccessContext(context.Background(), "door", "1234")
+	if !IsMaybeDelivered(err) {
+		t.Errorf("Got %v, expected a MaybeDeliveredError", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if counts["get_nonce"] != 2 || counts["access"] != 1 {
+		t.Errorf("Requests made: %v", counts)
+	}
+}
@@ -0,0 +1,327 @@
+package lock
+
+// The lock package drives a door lock's output line, so that the rest
+// of this code only has to say "unlock" or "lock".  It takes care of
+// which level energises the lock (the relay may be active-low), what
+// energising does (an electric strike unlocks when energised, but a
+// maglock locks), whether unlocking holds the line or only pulses it,
+// and how long the lock may be energised at once.
+//
+// The kernel reports an output line as whatever was last written to
+// it, whatever the lock actually does, so reading the output back
+// can't show that the lock is wired or configured the wrong way
+// round.  That takes a separate lock-sense input (e.g. a strike's
+// latch monitor contact); see New.
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"hive13/rfid/gpio"
+)
+
+// Lock modes (see Config.Mode):
+const (
+	// Energised to unlock, for as long as it is unlocked (e.g. an
+	// electric strike); this stays locked if power fails:
+	ModeFailSecure = "fail-secure"
+	// Energised to lock, and so unlocked by de-energising; this
+	// unlocks if power fails:
+	ModeFailSafe = "fail-safe"
+	// A maglock, which is always fail-safe:
+	ModeMaglock = "maglock"
+	// Energised only briefly (see Config.PulseTime) to unlock, e.g. a
+	// strike that stays released until the door opens:
+	ModePulse = "pulse"
+)
+
+// Default for Config.PulseTime:
+const DefaultPulseTime = 500 * time.Millisecond
+
+type Config struct {
+	// One of the Mode* constants; if empty, ModeFailSecure:
+	Mode string
+	// If true, the line is low to energise the lock (e.g. for an
+	// active-low relay board):
+	ActiveLow bool
+	// In ModePulse, how long to energise the lock to unlock it (0
+	// for DefaultPulseTime):
+	PulseTime time.Duration
+	// If nonzero, the lock is never energised to unlock it for longer
+	// than this, even if it is still meant to be unlocked (e.g. for a
+	// strike which isn't rated for continuous duty).  This does not
+	// apply to fail-safe locks, which are energised while locked.
+	MaxEnergise time.Duration
+	// With a lock-sense input, its value when the door is locked:
+	SenseLocked int
+	// With a lock-sense input, how long to let the lock settle after
+	// setting the line before checking it (0 for DefaultSenseSettle):
+	SenseSettle time.Duration
+}
+
+// Default for Config.SenseSettle:
+const DefaultSenseSettle = 200 * time.Millisecond
+
+// Check returns an error if the configuration is not valid.
+func (c Config) Check() error {
+	switch c.Mode {
+	case "", ModeFailSecure, ModePulse:
+	case ModeFailSafe, ModeMaglock:
+		if c.MaxEnergise > 0 {
+			return fmt.Errorf("Maximum energise time can't apply to lock mode %s, which is energised while locked", c.Mode)
+		}
+	default:
+		return fmt.Errorf("Unknown lock mode %q", c.Mode)
+	}
+	if c.SenseLocked != 0 && c.SenseLocked != 1 {
+		return fmt.Errorf("Lock-sense value must be 0 or 1")
+	}
+	if c.PulseTime < 0 || c.MaxEnergise < 0 || c.SenseSettle < 0 {
+		return fmt.Errorf("Lock times can't be negative")
+	}
+	return nil
+}
+
+// fail_safe returns true if the lock is energised to lock it.
+func (c Config) fail_safe() bool {
+	return c.Mode == ModeFailSafe || c.Mode == ModeMaglock
+}
+
+// level returns the line value that energises the lock (if 'energise'
+// is true) or de-energises it.
+func (c Config) level(energise bool) int {
+	if energise != c.ActiveLow {
+		return 1
+	}
+	return 0
+}
+
+// LockedLevel returns the line value that keeps the door locked (e.g.
+// for requesting the line).
+func (c Config) LockedLevel() int {
+	return c.level(c.fail_safe())
+}
+
+// UnlockedLevel returns the line value that unlocks the door (in
+// ModePulse, only for the pulse).
+func (c Config) UnlockedLevel() int {
+	return c.level(!c.fail_safe())
+}
+
+// Describe returns the configuration in words, for the log.
+func (c Config) Describe() string {
+	mode := c.Mode
+	if mode == "" {
+		mode = ModeFailSecure
+	}
+	s := fmt.Sprintf("%s, line %d = locked, %d = unlocked",
+		mode, c.LockedLevel(), c.UnlockedLevel())
+	if mode == ModePulse {
+		s += fmt.Sprintf(" (for %s)", c.pulse_time())
+	}
+	if c.MaxEnergise > 0 {
+		s += fmt.Sprintf(", energised at most %s", c.MaxEnergise)
+	}
+	return s
+}
+
+func (c Config) pulse_time() time.Duration {
+	if c.PulseTime <= 0 {
+		return DefaultPulseTime
+	}
+	return c.PulseTime
+}
+
+func (c Config) sense_settle() time.Duration {
+	if c.SenseSettle <= 0 {
+		return DefaultSenseSettle
+	}
+	return c.SenseSettle
+}
+
+// Lock is a door lock on an output line.
+type Lock struct {
+	cfg Config
+	line gpio.OutputLine
+	// Lock-sense input, or nil:
+	sense gpio.InputLine
+
+	// mu guards everything below, which off_timer also changes:
+	mu sync.Mutex
+	// True if the door is meant to be unlocked:
+	unlocked bool
+	// Line value last set:
+	value int
+	// De-energises the lock at the end of a pulse or of MaxEnergise:
+	off_timer *time.Timer
+	closed bool
+}
+
+// New returns a Lock on 'line', which should already be set to
+// cfg.LockedLevel().  It is set to that again, and then checked (see
+// Verify).  'sense' is an input which reads cfg.SenseLocked while the
+// door is locked, or nil if there is none.  Either way, the Lock
+// closes it along with 'line'.
+func New(line gpio.OutputLine, sense gpio.InputLine, cfg Config) (*Lock, error) {
+	if err := cfg.Check(); err != nil {
+		return nil, err
+	}
+	l := &Lock{cfg: cfg, line: line, sense: sense}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.set(cfg.LockedLevel()); err != nil {
+		return nil, err
+	}
+	if err := l.verify(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// set sets the line.  l.mu must be held.
+func (l *Lock) set(value int) error {
+	l.value = value
+	return l.line.SetValue(value)
+}
+
+// Unlock unlocks the door (until Lock is called, except as limited by
+// ModePulse or MaxEnergise).
+func (l *Lock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return fmt.Errorf("Lock is closed")
+	}
+
+	l.unlocked = true
+	l.stop_timer()
+	if err := l.set(l.cfg.UnlockedLevel()); err != nil {
+		return err
+	}
+
+	// A fail-safe lock is unlocked by de-energising, which can go on
+	// for as long as it likes:
+	if l.cfg.fail_safe() {
+		return nil
+	}
+	limit := l.cfg.MaxEnergise
+	if l.cfg.Mode == ModePulse && (limit <= 0 || l.cfg.pulse_time() < limit) {
+		limit = l.cfg.pulse_time()
+	}
+	if limit > 0 {
+		var timer *time.Timer
+		timer = time.AfterFunc(limit, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			// Make sure this timer wasn't stopped or replaced while it
+			// was waiting on the lock:
+			if l.off_timer != timer {
+				return
+			}
+			l.off_timer = nil
+			if l.cfg.Mode != ModePulse {
+				log.Printf("Lock was energised for %s, de-energising it", limit)
+			}
+			if err := l.set(l.cfg.LockedLevel()); err != nil {
+				log.Printf("Error de-energising lock: %s", err)
+			}
+		})
+		l.off_timer = timer
+	}
+	return nil
+}
+
+// Lock locks the door.
+func (l *Lock) Lock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+
+	l.unlocked = false
+	l.stop_timer()
+	return l.set(l.cfg.LockedLevel())
+}
+
+// stop_timer stops any off_timer.  l.mu must be held.
+func (l *Lock) stop_timer() {
+	if l.off_timer != nil {
+		l.off_timer.Stop()
+		l.off_timer = nil
+	}
+}
+
+// Unlocked returns true if the door is meant to be unlocked (even if
+// a pulse or MaxEnergise has since ended).
+func (l *Lock) Unlocked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.unlocked
+}
+
+// Verify returns an error if the door is meant to be locked but the
+// lock-sense input (after Config.SenseSettle) doesn't show it locked.
+// Without a lock-sense input, this checks nothing; only errors setting
+// the line (returned from New, Lock, and so on) can show a fault.
+func (l *Lock) Verify() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.verify()
+}
+
+// verify is Verify with l.mu held.
+func (l *Lock) verify() error {
+	if l.sense == nil || l.unlocked {
+		return nil
+	}
+	time.Sleep(l.cfg.sense_settle())
+	value, err := l.sense.Value()
+	if err != nil {
+		return fmt.Errorf("Can't read lock-sense input: %s", err)
+	}
+	if value != l.cfg.SenseLocked {
+		return fmt.Errorf("Lock-sense input reads %d, not %d (locked), with lock line at %d; is the lock wired or configured the wrong way round?",
+			value, l.cfg.SenseLocked, l.value)
+	}
+	return nil
+}
+
+// Close locks the door, checks that it is locked (see Verify), and
+// releases the line and any lock-sense input.  Any error from checking
+// is returned, but the lines are released regardless.  Calling it more
+// than once has no further effect.
+//
+// A fail-safe lock is only locked while the line energises it, and a
+// released line may not, so in those modes the line is not released
+// here (it stays locked until the process exits), and a warning is
+// logged that the door will unlock then, unless the hardware keeps the
+// lock energised without this.
+func (l *Lock) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+
+	l.unlocked = false
+	l.stop_timer()
+	err := l.set(l.cfg.LockedLevel())
+	if err == nil {
+		err = l.verify()
+	}
+	l.closed = true
+	if l.cfg.fail_safe() {
+		log.Printf("WARNING: Lock mode %s is energised to lock, so the door will unlock when this exits and the lock line is released",
+			l.cfg.Mode)
+	} else if e := l.line.Close(); e != nil && err == nil {
+		err = e
+	}
+	if l.sense != nil {
+		l.sense.Close()
+	}
+	return err
+}
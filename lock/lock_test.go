@@ -0,0 +1,239 @@
+package lock_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/warthog618/gpiod"
+
+	"hive13/rfid/gpio"
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/lock"
+)
+
+const (
+	pin_lock = 24
+	pin_sense = 25
+)
+
+// open returns a Lock with 'cfg' on a fake chip (and its output), with
+// a lock-sense input reading 'sense', or none if that is -1.
+func open(t *testing.T, cfg lock.Config, sense int) (*gpiofake.Chip, *gpiofake.Output, *lock.Lock, error) {
+	t.Helper()
+	chip := gpiofake.NewChip()
+	line, err := chip.RequestOutput(pin_lock, cfg.LockedLevel())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sense_line gpio.InputLine
+	if sense >= 0 {
+		chip.Input(pin_sense).Set(sense)
+		sense_line, err = chip.RequestInput(pin_sense, gpiod.LineEdgeNone, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := lock.New(line, sense_line, cfg)
+	return chip, chip.Output(pin_lock), l, err
+}
+
+// check_line fails the test if 'out' isn't at 'want'.
+func check_line(t *testing.T, out *gpiofake.Output, want int, when string) {
+	t.Helper()
+	if got := out.Value(); got != want {
+		t.Errorf("%s: lock line is %d, expected %d", when, got, want)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	tests := []struct {
+		mode string
+		active_low bool
+		locked int
+	}{
+		{"", false, 0},
+		{lock.ModeFailSecure, false, 0},
+		{lock.ModeFailSecure, true, 1},
+		{lock.ModePulse, false, 0},
+		{lock.ModeFailSafe, false, 1},
+		{lock.ModeFailSafe, true, 0},
+		{lock.ModeMaglock, false, 1},
+		{lock.ModeMaglock, true, 0},
+	}
+	for _, test := range tests {
+		cfg := lock.Config{Mode: test.mode, ActiveLow: test.active_low}
+		if l, u := cfg.LockedLevel(), cfg.UnlockedLevel(); l != test.locked || u != 1 - test.locked {
+			t.Errorf("%q (active low %t): locked %d, unlocked %d",
+				test.mode, test.active_low, l, u)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	bad := []lock.Config{
+		{Mode: "strike"},
+		{Mode: lock.ModeFailSafe, MaxEnergise: time.Second},
+		{Mode: lock.ModeMaglock, MaxEnergise: time.Second},
+		{SenseLocked: 2},
+		{PulseTime: -time.Second},
+	}
+	for _, cfg := range bad {
+		if err := cfg.Check(); err == nil {
+			t.Errorf("%+v was allowed", cfg)
+		}
+	}
+	good := []lock.Config{
+		{},
+		{Mode: lock.ModeFailSecure, MaxEnergise: time.Second},
+		{Mode: lock.ModePulse, PulseTime: time.Second},
+		{Mode: lock.ModeMaglock, ActiveLow: true},
+	}
+	for _, cfg := range good {
+		if err := cfg.Check(); err != nil {
+			t.Errorf("%+v: %s", cfg, err)
+		}
+	}
+}
+
+func TestUnlockLock(t *testing.T) {
+	for _, mode := range []string{lock.ModeFailSecure, lock.ModeFailSafe} {
+		cfg := lock.Config{Mode: mode}
+		_, out, l, err := open(t, cfg, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check_line(t, out, cfg.LockedLevel(), mode + " at start")
+		if err := l.Unlock(); err != nil {
+			t.Fatal(err)
+		}
+		check_line(t, out, cfg.UnlockedLevel(), mode + " unlocked")
+		if !l.Unlocked() {
+			t.Errorf("%s: not unlocked", mode)
+		}
+		if err := l.Lock(); err != nil {
+			t.Fatal(err)
+		}
+		check_line(t, out, cfg.LockedLevel(), mode + " locked")
+		if l.Unlocked() {
+			t.Errorf("%s: still unlocked", mode)
+		}
+		l.Close()
+	}
+}
+
+func TestPulse(t *testing.T) {
+	cfg := lock.Config{Mode: lock.ModePulse, PulseTime: 20 * time.Millisecond}
+	_, out, l, err := open(t, cfg, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Unlock()
+	check_line(t, out, 1, "pulse")
+	time.Sleep(60 * time.Millisecond)
+	check_line(t, out, 0, "after pulse")
+	// (It is still meant to be unlocked, until Lock.)
+	if !l.Unlocked() {
+		t.Errorf("Not unlocked after pulse")
+	}
+}
+
+func TestMaxEnergise(t *testing.T) {
+	cfg := lock.Config{MaxEnergise: 20 * time.Millisecond}
+	_, out, l, err := open(t, cfg, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	// Unlocking again restarts the limit:
+	l.Unlock()
+	time.Sleep(15 * time.Millisecond)
+	check_line(t, out, 1, "before limit")
+	time.Sleep(40 * time.Millisecond)
+	check_line(t, out, 0, "after limit")
+
+	// Locking stops the timer, so a new unlock isn't cut short by it:
+	l.Unlock()
+	l.Lock()
+	l.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	check_line(t, out, 1, "after relocking")
+}
+
+func TestSense(t *testing.T) {
+	cfg := lock.Config{SenseLocked: 1, SenseSettle: time.Millisecond}
+	_, _, l, err := open(t, cfg, 1)
+	if err != nil {
+		t.Fatalf("Lock-sense showing locked: %s", err)
+	}
+	if err := l.Verify(); err != nil {
+		t.Error(err)
+	}
+	l.Close()
+
+	// e.g. the lock is wired the wrong way round:
+	_, _, _, err = open(t, cfg, 0)
+	if err == nil {
+		t.Fatal("Lock-sense showing unlocked was allowed")
+	}
+}
+
+func TestSenseClose(t *testing.T) {
+	cfg := lock.Config{SenseLocked: 1, SenseSettle: time.Millisecond}
+	chip, _, l, err := open(t, cfg, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Unlocked, the lock-sense input isn't checked:
+	l.Unlock()
+	chip.Input(pin_sense).Set(0)
+	if err := l.Verify(); err != nil {
+		t.Errorf("Checked lock-sense while unlocked: %s", err)
+	}
+	// But it is on closing, which locks the door:
+	if err := l.Close(); err == nil {
+		t.Error("Close didn't report lock-sense showing unlocked")
+	}
+}
+
+func TestClose(t *testing.T) {
+	tests := []struct {
+		mode string
+		released bool
+	}{
+		{lock.ModeFailSecure, true},
+		{lock.ModePulse, true},
+		// Released, these would unlock:
+		{lock.ModeFailSafe, false},
+		{lock.ModeMaglock, false},
+	}
+	for _, test := range tests {
+		cfg := lock.Config{Mode: test.mode}
+		chip, out, l, err := open(t, cfg, -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Unlock()
+		if err := l.Close(); err != nil {
+			t.Errorf("%s: %s", test.mode, err)
+		}
+		check_line(t, out, cfg.LockedLevel(), test.mode + " closed")
+
+		_, err = chip.RequestOutput(pin_lock, 0)
+		if released := err == nil; released != test.released {
+			t.Errorf("%s: line released %t, expected %t", test.mode, released, test.released)
+		}
+		// Once closed, it stays locked:
+		if err := l.Unlock(); err == nil {
+			t.Errorf("%s: unlocked after Close", test.mode)
+		}
+		if test.released {
+			continue
+		}
+		check_line(t, out, cfg.LockedLevel(), test.mode + " after Close")
+	}
+}
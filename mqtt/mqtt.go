@@ -19,6 +19,21 @@ type Config struct {
 	TopicSensor string
 	// MQTT topic to which we'll publish badge scans
 	TopicBadge string
+	// MQTT topic to which we'll publish badge reader tamper reports
+	// ("tamper" or "normal"; only OSDP readers report this)
+	TopicTamper string
+	// MQTT topic to which we'll publish door alarms (e.g. "held_open")
+	// and "cleared" when they end
+	TopicAlarm string
+	// MQTT topic to which we'll publish request-to-exit presses
+	// ("pressed")
+	TopicRex string
+	// MQTT topic to which we'll subscribe for commands (ignored if
+	// empty)
+	TopicCommand string
+	// Called (from the MQTT client's goroutine) for every message on
+	// TopicCommand
+	OnCommand MQTT.MessageHandler
 }
 
 func NewClient(c Config) MQTT.Client {
@@ -35,6 +50,17 @@ func NewClient(c Config) MQTT.Client {
 	opts.SetOnConnectHandler(
 		func(client MQTT.Client) {
 			log.Printf("MQTT: connected")
+			// (This is on every connect, as subscriptions don't last
+			// across reconnects.)
+			if c.TopicCommand != "" && c.OnCommand != nil {
+				token := client.Subscribe(c.TopicCommand, 0, c.OnCommand)
+				go func() {
+					if token.Wait() && token.Error() != nil {
+						log.Printf("MQTT: unable to subscribe to %s, %s",
+							c.TopicCommand, token.Error())
+					}
+				}()
+			}
 		})
 	opts.SetConnectionLostHandler(
 		func(client MQTT.Client, err error) {
@@ -0,0 +1,285 @@
+package osdp
+
+// OSDP packet framing: building, reading, and parsing packets, with
+// or without the secure channel.
+//
+// A packet is: SOM, address, length (2 bytes, LSB first), control,
+// optional security control block (SCB), command or reply code, data,
+// optional MAC (4 bytes), and a CRC-16 (LSB first) or 8-bit checksum.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"io"
+)
+
+const (
+	// Start of message:
+	som = 0x53
+	// Set in the address of every reply:
+	reply_flag = 0x80
+	// Broadcast address:
+	AddressBroadcast = 0x7F
+
+	// Bits in the control byte:
+	ctrl_sqn = 0x03
+	ctrl_crc = 0x04
+	ctrl_scb = 0x08
+
+	// Length of SOM, address, length, and control:
+	header_len = 5
+	mac_len    = 4
+	// Longest packet we'll accept:
+	max_packet_len = 1440
+)
+
+// Commands (from the control panel, i.e. us):
+const (
+	cmd_poll   = 0x60
+	cmd_id     = 0x61
+	cmd_cap    = 0x62
+	cmd_lstat  = 0x64
+	cmd_led    = 0x69
+	cmd_buz    = 0x6A
+	cmd_chlng  = 0x76
+	cmd_scrypt = 0x77
+)
+
+// Replies (from the peripheral device, i.e. the reader):
+const (
+	reply_ack    = 0x40
+	reply_nak    = 0x41
+	reply_pdid   = 0x45
+	reply_pdcap  = 0x46
+	reply_lstatr = 0x48
+	reply_raw    = 0x50
+	reply_fmt    = 0x51
+	reply_keypad = 0x53
+	reply_ccrypt = 0x76
+	reply_rmac_i = 0x78
+	reply_busy   = 0x79
+)
+
+// NAK reasons:
+const (
+	nak_checksum = 0x01
+	nak_cmd_len  = 0x02
+	nak_unknown  = 0x03
+	nak_sqn      = 0x04
+	nak_sc_unsup = 0x05
+	nak_sc_cond  = 0x06
+)
+
+// Security control block types:
+const (
+	scs_11 = 0x11 // CP->PD osdp_CHLNG
+	scs_12 = 0x12 // PD->CP osdp_CCRYPT
+	scs_13 = 0x13 // CP->PD osdp_SCRYPT
+	scs_14 = 0x14 // PD->CP osdp_RMAC_I
+	scs_15 = 0x15 // CP->PD, MAC, no data
+	scs_16 = 0x16 // PD->CP, MAC, no data
+	scs_17 = 0x17 // CP->PD, MAC, encrypted data
+	scs_18 = 0x18 // PD->CP, MAC, encrypted data
+)
+
+// packet is a parsed packet, with any encryption removed.
+type packet struct {
+	addr byte
+	sqn  byte
+	// Security control block, including its length byte (or nil):
+	scb  []byte
+	code byte
+	data []byte
+}
+
+// crc16 is the CRC-16 used by OSDP (CCITT polynomial, initial value
+// 0x1D0F, not reflected).
+func crc16(data []byte) uint16 {
+	crc := uint16(0x1D0F)
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// checksum8 is the 8-bit checksum used by OSDP when CRC is not.
+func checksum8(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// build_packet encodes a packet.  If 'sc' has an active secure
+// session, the data is encrypted, a MAC is added, and 'scb' is
+// ignored; otherwise, 'scb' (if not nil) is sent as-is.  'is_cmd'
+// tells whether this is a command (from the CP) or a reply.
+func build_packet(addr byte, sqn byte, scb []byte, code byte, data []byte,
+	sc *session, is_cmd bool) []byte {
+
+	secure := sc != nil && sc.active
+	if secure {
+		if len(data) > 0 {
+			data = sc.encrypt(is_cmd, data)
+			scb = []byte{2, scs_17}
+			if !is_cmd {
+				scb[1] = scs_18
+			}
+		} else {
+			scb = []byte{2, scs_15}
+			if !is_cmd {
+				scb[1] = scs_16
+			}
+		}
+	}
+
+	length := header_len + len(scb) + 1 + len(data) + 2
+	if secure {
+		length += mac_len
+	}
+
+	ctrl := (sqn & ctrl_sqn) | ctrl_crc
+	if scb != nil {
+		ctrl |= ctrl_scb
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte(som)
+	buf.WriteByte(addr)
+	buf.WriteByte(byte(length))
+	buf.WriteByte(byte(length >> 8))
+	buf.WriteByte(ctrl)
+	buf.Write(scb)
+	buf.WriteByte(code)
+	buf.Write(data)
+	if secure {
+		mac := sc.compute_mac(is_cmd, buf.Bytes())
+		sc.record_mac(is_cmd, mac)
+		buf.Write(mac[:mac_len])
+	}
+	crc := crc16(buf.Bytes())
+	buf.WriteByte(byte(crc))
+	buf.WriteByte(byte(crc >> 8))
+	return buf.Bytes()
+}
+
+// read_packet reads one raw packet from 'r', skipping anything before
+// a SOM byte, and checks its CRC or checksum.
+func read_packet(r *bufio.Reader) ([]byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if b == som {
+			break
+		}
+	}
+
+	hdr := make([]byte, header_len)
+	hdr[0] = som
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return nil, err
+	}
+	length := int(hdr[2]) | int(hdr[3])<<8
+	if length < header_len+2 || length > max_packet_len {
+		return nil, fmt.Errorf("osdp: bad packet length %d", length)
+	}
+
+	raw := make([]byte, length)
+	copy(raw, hdr)
+	if _, err := io.ReadFull(r, raw[header_len:]); err != nil {
+		return nil, err
+	}
+
+	if raw[4]&ctrl_crc != 0 {
+		crc := uint16(raw[length-2]) | uint16(raw[length-1])<<8
+		if crc16(raw[:length-2]) != crc {
+			return nil, fmt.Errorf("osdp: CRC mismatch")
+		}
+	} else if checksum8(raw[:length-1]) != raw[length-1] {
+		return nil, fmt.Errorf("osdp: checksum mismatch")
+	}
+	return raw, nil
+}
+
+// parse_packet parses a raw packet (from read_packet).  If it has a
+// MAC, this checks it against 'sc' and decrypts any data.  'is_cmd'
+// tells whether this is a command (from the CP) or a reply.
+func parse_packet(raw []byte, sc *session, is_cmd bool) (*packet, error) {
+	p := &packet{
+		addr: raw[1],
+		sqn:  raw[4] & ctrl_sqn,
+	}
+
+	end := len(raw) - 1
+	if raw[4]&ctrl_crc != 0 {
+		end = len(raw) - 2
+	}
+
+	idx := header_len
+	if raw[4]&ctrl_scb != 0 {
+		if idx >= end || int(raw[idx]) < 2 || idx+int(raw[idx]) >= end {
+			return nil, fmt.Errorf("osdp: bad security control block")
+		}
+		p.scb = raw[idx : idx+int(raw[idx])]
+		idx += len(p.scb)
+	}
+	if idx >= end {
+		return nil, fmt.Errorf("osdp: packet has no command or reply code")
+	}
+	p.code = raw[idx]
+	p.data = raw[idx+1 : end]
+
+	// Once the secure channel is up, everything must come through it
+	// (or else anyone on the bus could send plaintext, e.g. a badge):
+	secure_types := []byte{scs_16, scs_18}
+	if is_cmd {
+		secure_types = []byte{scs_15, scs_17}
+	}
+	if sc != nil && sc.active {
+		if p.scb == nil || !bytes.Contains(secure_types, p.scb[1:2]) {
+			return nil, fmt.Errorf("osdp: message outside the secure channel")
+		}
+	} else if p.scb == nil || p.scb[1] < scs_15 || p.scb[1] > scs_18 {
+		return p, nil
+	} else {
+		return nil, fmt.Errorf("osdp: secure message, but no secure session")
+	}
+
+	// This is a secure message, so it must have a good MAC:
+	if len(p.data) < mac_len {
+		return nil, fmt.Errorf("osdp: secure message too short for MAC")
+	}
+	mac := sc.compute_mac(is_cmd, raw[:end-mac_len])
+	if subtle.ConstantTimeCompare(mac[:mac_len], raw[end-mac_len:end]) != 1 {
+		return nil, fmt.Errorf("osdp: MAC mismatch")
+	}
+	sc.record_mac(is_cmd, mac)
+	p.data = p.data[:len(p.data)-mac_len]
+
+	if p.scb[1] == scs_17 || p.scb[1] == scs_18 {
+		data, err := sc.decrypt(is_cmd, p.data)
+		if err != nil {
+			return nil, err
+		}
+		p.data = data
+	}
+	return p, nil
+}
+
+// next_sqn returns the sequence number after 'sqn'.  (0 is only used
+// to start over, so this goes 1, 2, 3, 1, ...)
+func next_sqn(sqn byte) byte {
+	return sqn%3 + 1
+}
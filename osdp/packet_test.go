@@ -0,0 +1,92 @@
+package osdp
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	// The standard check value for this CRC (CRC-16/AUG-CCITT):
+	if crc := crc16([]byte("123456789")); crc != 0xE5CC {
+		t.Errorf("CRC is %04X, expected E5CC", crc)
+	}
+}
+
+func TestChecksum8(t *testing.T) {
+	data := []byte{som, 0x01, 0x08, 0x00, 0x00, cmd_poll}
+	var sum byte
+	for _, b := range append(data, checksum8(data)) {
+		sum += b
+	}
+	if sum != 0 {
+		t.Errorf("Sum with checksum is %02X, not 0", sum)
+	}
+}
+
+func TestPacketRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		addr byte
+		sqn byte
+		scb []byte
+		code byte
+		data []byte
+	}{
+		{"poll", 1, 1, nil, cmd_poll, nil},
+		{"reply", 1 | reply_flag, 3, nil, reply_raw, []byte{0, 1, 26, 0, 1, 2, 3, 4}},
+		{"handshake", 0x7E, 0, []byte{3, scs_11, 1}, cmd_chlng, []byte{1, 2, 3, 4, 5, 6, 7, 8}},
+	}
+	for _, test := range tests {
+		raw := build_packet(test.addr, test.sqn, test.scb, test.code, test.data, nil, true)
+		// Read it back from amid some line noise:
+		stream := append([]byte{0xFF, 0x00}, raw...)
+		got, err := read_packet(bufio.NewReader(bytes.NewReader(stream)))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if !bytes.Equal(got, raw) {
+			t.Fatalf("%s: read % X, expected % X", test.name, got, raw)
+		}
+
+		p, err := parse_packet(got, nil, true)
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if p.addr != test.addr || p.sqn != test.sqn || p.code != test.code ||
+			!bytes.Equal(p.scb, test.scb) || !bytes.Equal(p.data, test.data) {
+			t.Errorf("%s: parsed as %+v", test.name, p)
+		}
+	}
+}
+
+func TestReadPacketBad(t *testing.T) {
+	raw := build_packet(1, 1, nil, cmd_poll, nil, nil, true)
+
+	corrupt := append([]byte(nil), raw...)
+	corrupt[5] ^= 0x01
+	long := append([]byte(nil), raw...)
+	long[2], long[3] = 0xFF, 0xFF
+
+	for name, stream := range map[string][]byte{
+		"bad CRC": corrupt,
+		"bad length": long,
+		"truncated": raw[:len(raw) - 1],
+	} {
+		if _, err := read_packet(bufio.NewReader(bytes.NewReader(stream))); err == nil {
+			t.Errorf("%s: read without error", name)
+		}
+	}
+}
+
+func TestNextSqn(t *testing.T) {
+	sqn := byte(0)
+	var got []byte
+	for i := 0; i < 5; i++ {
+		sqn = next_sqn(sqn)
+		got = append(got, sqn)
+	}
+	if !bytes.Equal(got, []byte{1, 2, 3, 1, 2}) {
+		t.Errorf("Sequence numbers go %v", got)
+	}
+}
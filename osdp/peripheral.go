@@ -0,0 +1,218 @@
+package osdp
+
+// A simulated OSDP reader (peripheral device, or PD), for testing the
+// control panel side without hardware; see test/osdp.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+	"log"
+	"sync"
+)
+
+// Peripheral is a simulated OSDP reader.  It answers commands sent to
+// its address, and reports badges, key presses, and tamper changes
+// given to it by Swipe, Keys, and SetTamper.
+type Peripheral struct {
+	// The reader's OSDP address:
+	Address byte
+	// Secure channel base key; if nil, the secure channel is not
+	// supported.
+	SCBK []byte
+	// If not nil, these are called when the control panel sets the
+	// LED or the buzzer:
+	OnLED    func(color LedColor)
+	OnBuzzer func(on bool)
+
+	sc *session
+
+	// mu guards everything below, which Swipe, Keys, and SetTamper
+	// write from other goroutines:
+	mu sync.Mutex
+	// Replies waiting to be sent in answer to polls:
+	events []command
+	tamper bool
+	// Last tamper state reported to the control panel:
+	tamper_sent bool
+}
+
+// Swipe simulates a card with the given bits (each 0 or 1) being read.
+func (pd *Peripheral) Swipe(bits []byte) {
+	data := make([]byte, 4+(len(bits)+7)/8)
+	data[1] = 1 // Wiegand
+	data[2] = byte(len(bits))
+	data[3] = byte(len(bits) >> 8)
+	for i, b := range bits {
+		data[4+i/8] |= (b & 1) << uint(7-i%8)
+	}
+	pd.add_event(command{reply_raw, data})
+}
+
+// Keys simulates keys being pressed on the keypad: '0' through '9',
+// '*', and '#'.
+func (pd *Peripheral) Keys(keys string) {
+	data := []byte{0, 0}
+	for _, k := range keys {
+		switch k {
+		case '*':
+			data = append(data, 0x7F)
+		case '#':
+			data = append(data, 0x0D)
+		default:
+			data = append(data, byte(k))
+		}
+	}
+	data[1] = byte(len(data) - 2)
+	pd.add_event(command{reply_keypad, data})
+}
+
+// SetTamper simulates the reader's tamper switch.
+func (pd *Peripheral) SetTamper(tamper bool) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.tamper = tamper
+}
+
+func (pd *Peripheral) add_event(c command) {
+	pd.mu.Lock()
+	defer pd.mu.Unlock()
+	pd.events = append(pd.events, c)
+}
+
+// Serve answers commands from 'port' until 'ctx' is cancelled (in
+// which case 'port' is closed and nil is returned) or reading fails.
+func (pd *Peripheral) Serve(ctx context.Context, port io.ReadWriteCloser) error {
+	go func() {
+		<-ctx.Done()
+		port.Close()
+	}()
+
+	rd := bufio.NewReader(port)
+	for {
+		raw, err := read_packet(rd)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return err
+			}
+			log.Printf("osdp peripheral: %s", err)
+			continue
+		}
+		if raw[1] != pd.Address && raw[1] != AddressBroadcast {
+			continue
+		}
+
+		sqn := raw[4] & ctrl_sqn
+		if sqn == 0 {
+			// The control panel is starting over:
+			pd.sc = nil
+		}
+		code, data, scb := pd.handle(raw)
+		out := build_packet(pd.Address|reply_flag, sqn, scb, code, data, pd.sc, false)
+		if _, err := port.Write(out); err != nil {
+			return err
+		}
+		if code == reply_rmac_i {
+			// The session starts only after this reply goes out:
+			pd.sc.start(data)
+		}
+	}
+}
+
+// handle handles one command, and returns the reply.
+func (pd *Peripheral) handle(raw []byte) (code byte, data []byte, scb []byte) {
+	p, err := parse_packet(raw, pd.sc, true)
+	if err != nil {
+		log.Printf("osdp peripheral: %s", err)
+		pd.sc = nil
+		return reply_nak, []byte{nak_sc_cond}, nil
+	}
+
+	nak := func(reason byte) (byte, []byte, []byte) {
+		return reply_nak, []byte{reason}, nil
+	}
+
+	switch p.code {
+	case cmd_poll:
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		if len(pd.events) > 0 {
+			c := pd.events[0]
+			pd.events = pd.events[1:]
+			return c.code, c.data, nil
+		}
+		if pd.tamper != pd.tamper_sent {
+			pd.tamper_sent = pd.tamper
+			return reply_lstatr, pd.lstatr(), nil
+		}
+		return reply_ack, nil, nil
+	case cmd_lstat:
+		pd.mu.Lock()
+		defer pd.mu.Unlock()
+		pd.tamper_sent = pd.tamper
+		return reply_lstatr, pd.lstatr(), nil
+	case cmd_id:
+		// Vendor, model, version, serial number, firmware:
+		return reply_pdid, make([]byte, 12), nil
+	case cmd_cap:
+		return reply_pdcap, nil, nil
+	case cmd_led:
+		if len(p.data) < 14 {
+			return nak(nak_cmd_len)
+		}
+		if p.data[9] != 0 && pd.OnLED != nil {
+			pd.OnLED(LedColor(p.data[12]))
+		}
+		return reply_ack, nil, nil
+	case cmd_buz:
+		if len(p.data) < 5 {
+			return nak(nak_cmd_len)
+		}
+		if pd.OnBuzzer != nil {
+			pd.OnBuzzer(p.data[1] == 2)
+		}
+		return reply_ack, nil, nil
+	case cmd_chlng:
+		if pd.SCBK == nil {
+			return nak(nak_sc_unsup)
+		}
+		if len(p.data) != 8 {
+			return nak(nak_cmd_len)
+		}
+		pd.sc = new_session(pd.SCBK)
+		pd.sc.derive(p.data)
+		pd.sc.pd_random = make([]byte, 8)
+		if _, err := rand.Read(pd.sc.pd_random); err != nil {
+			pd.sc = nil
+			return nak(nak_sc_cond)
+		}
+		var reply []byte
+		reply = append(reply, make([]byte, 8)...) // cUID
+		reply = append(reply, pd.sc.pd_random...)
+		reply = append(reply, pd.sc.client_cryptogram()...)
+		return reply_ccrypt, reply, []byte{3, scs_12, pd.sc.key_select()}
+	case cmd_scrypt:
+		if pd.sc == nil || pd.sc.pd_random == nil || len(p.data) != 16 ||
+			subtle.ConstantTimeCompare(p.data, pd.sc.server_cryptogram()) != 1 {
+			pd.sc = nil
+			return nak(nak_sc_cond)
+		}
+		return reply_rmac_i, pd.sc.initial_rmac(), []byte{3, scs_14, 1}
+	default:
+		return nak(nak_unknown)
+	}
+}
+
+// lstatr returns the data for an LSTATR reply.  pd.mu must be held.
+func (pd *Peripheral) lstatr() []byte {
+	tamper := byte(0)
+	if pd.tamper {
+		tamper = 1
+	}
+	return []byte{tamper, 0}
+}
@@ -0,0 +1,567 @@
+package osdp
+
+// The osdp package is a control panel (CP) for OSDP v2 badge readers
+// on a serial line (usually RS-485).  Unlike Wiegand, OSDP goes both
+// ways: we poll the reader for badges and key presses, and can also
+// drive its LED and buzzer, see its tamper switch, and (optionally)
+// encrypt all of it with the secure channel.
+//
+// Only one reader per serial line is supported for now.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"hive13/rfid/wiegand"
+)
+
+const (
+	// Default for Config.Baud:
+	DefaultBaud = 9600
+	// Default for Config.PollInterval:
+	DefaultPollInterval = 50 * time.Millisecond
+	// Default for Config.ReplyTimeout (the spec allows a reader 200
+	// msec to reply):
+	DefaultReplyTimeout = 200 * time.Millisecond
+	// How long to wait before trying again to reach a reader that is
+	// offline:
+	retry_interval = 1 * time.Second
+)
+
+// LedColor is a color for the reader's LED.
+type LedColor byte
+
+const (
+	LedOff   LedColor = 0
+	LedRed   LedColor = 1
+	LedGreen LedColor = 2
+	LedAmber LedColor = 3
+	LedBlue  LedColor = 4
+)
+
+// Port is a serial port, or anything else that acts like one (e.g. one
+// end of a pty).  *os.File satisfies this.
+type Port interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+}
+
+// Config gives the serial port and settings for one OSDP reader.
+type Config struct {
+	// Serial device, e.g. /dev/ttyUSB0 (only used by Open):
+	Device string
+	// Baud rate (only used by Open); if zero, DefaultBaud is used:
+	Baud int
+	// The reader's OSDP address, 0 to 126:
+	Address byte
+	// Formats to decode raw card data with (see wiegand.Decode); if
+	// empty, wiegand.DefaultFormats() is used:
+	Formats []wiegand.Format
+	// Secure channel base key (16 bytes).  If nil, the secure channel
+	// is not used.  DefaultSCBK works with readers that have not had a
+	// key set, but offers no real security.
+	SCBK []byte
+	// How often to poll the reader; if zero, DefaultPollInterval is
+	// used:
+	PollInterval time.Duration
+	// How long to wait for each reply; if zero, DefaultReplyTimeout is
+	// used:
+	ReplyTimeout time.Duration
+	// If not nil, this is called (from Listen's goroutine) when the
+	// reader reports its tamper switch changing: true for tampered,
+	// false for normal.
+	OnTamper func(tamper bool)
+}
+
+// command is one command waiting to be sent to the reader.
+type command struct {
+	code byte
+	data []byte
+}
+
+// Reader talks to one OSDP reader.
+type Reader struct {
+	cfg  Config
+	port Port
+	rd   *bufio.Reader
+
+	// Secure channel session (nil if not used):
+	sc *session
+	// Sequence number for the next command:
+	sqn byte
+	// True if the reader is answering polls:
+	online bool
+	tamper bool
+
+	// mu guards everything below, which SetLED and SetBuzzer write
+	// from other goroutines:
+	mu sync.Mutex
+	queue []command
+	closed bool
+}
+
+// Open opens the serial device given in 'cfg' and returns a Reader on
+// it.
+func Open(cfg Config) (*Reader, error) {
+	if cfg.Baud == 0 {
+		cfg.Baud = DefaultBaud
+	}
+	f, err := open_serial(cfg.Device, cfg.Baud)
+	if err != nil {
+		return nil, err
+	}
+	r, err := NewReader(f, cfg)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// NewReader returns a Reader that talks over 'port'.  Call Listen to
+// start polling.  Close closes 'port' (Listen also does this when its
+// context is cancelled).
+func NewReader(port Port, cfg Config) (*Reader, error) {
+	if cfg.Address >= AddressBroadcast {
+		return nil, fmt.Errorf("osdp: bad reader address %d", cfg.Address)
+	}
+	if cfg.SCBK != nil && len(cfg.SCBK) != 16 {
+		return nil, fmt.Errorf("osdp: secure channel key must be 16 bytes, not %d", len(cfg.SCBK))
+	}
+	if len(cfg.Formats) == 0 {
+		cfg.Formats = wiegand.DefaultFormats()
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = DefaultPollInterval
+	}
+	if cfg.ReplyTimeout <= 0 {
+		cfg.ReplyTimeout = DefaultReplyTimeout
+	}
+	r := &Reader{
+		cfg:  cfg,
+		port: port,
+		rd:   bufio.NewReader(port),
+	}
+	if cfg.SCBK != nil {
+		r.sc = new_session(cfg.SCBK)
+	}
+	return r, nil
+}
+
+// Close closes the reader's serial port.  Calling it more than once
+// has no further effect.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	closed := r.closed
+	r.closed = true
+	r.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	return r.port.Close()
+}
+
+// SetLED sets the reader's LED to a steady color.  (This is sent with
+// the next poll, so it may take up to PollInterval.)
+func (r *Reader) SetLED(color LedColor) {
+	c := byte(color)
+	r.enqueue(cmd_led, []byte{
+		0,    // reader number
+		0,    // LED number
+		0,    // temporary settings: no change
+		0, 0, 0, 0, 0, 0,
+		1,    // permanent settings: set
+		1, 0, // on time, off time (100 msec units)
+		c, c, // on color, off color
+	})
+}
+
+// SetBuzzer turns the reader's buzzer on (until turned off) or off.
+func (r *Reader) SetBuzzer(on bool) {
+	if on {
+		// Default tone, on 1 sec, off 0, repeat until stopped:
+		r.enqueue(cmd_buz, []byte{0, 2, 10, 0, 0})
+	} else {
+		r.enqueue(cmd_buz, []byte{0, 1, 0, 0, 0})
+	}
+}
+
+func (r *Reader) enqueue(code byte, data []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A newer command of the same kind supersedes an older one that
+	// hasn't gone out yet:
+	for i, c := range r.queue {
+		if c.code == code {
+			r.queue[i].data = data
+			return
+		}
+	}
+	r.queue = append(r.queue, command{code, data})
+}
+
+// next_command returns the next command to send: a queued one if there
+// is one, or else a poll.
+func (r *Reader) next_command() command {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.queue) == 0 {
+		return command{cmd_poll, nil}
+	}
+	c := r.queue[0]
+	r.queue = r.queue[1:]
+	return c
+}
+
+// Beeper returns the reader's buzzer as a gpio.OutputLine, so that it
+// can stand in for a beeper on a GPIO pin.  As with the GPIO beeper,
+// it is active-low: 0 is on, and 1 is off.
+func (r *Reader) Beeper() *ReaderLine {
+	return &ReaderLine{set: func(value int) {
+		r.SetBuzzer(value == 0)
+	}}
+}
+
+// LED returns the reader's LED as a gpio.OutputLine, so that it can
+// stand in for an LED on a GPIO pin.  It is active-low: 0 is green,
+// and 1 is red.
+func (r *Reader) LED() *ReaderLine {
+	return &ReaderLine{set: func(value int) {
+		if value == 0 {
+			r.SetLED(LedGreen)
+		} else {
+			r.SetLED(LedRed)
+		}
+	}}
+}
+
+// ReaderLine is a reader's LED or buzzer as a gpio.OutputLine (see
+// Reader.Beeper and Reader.LED).  It only sends a command when its
+// value changes.
+type ReaderLine struct {
+	set func(value int)
+
+	mu    sync.Mutex
+	value int
+	valid bool
+}
+
+func (l *ReaderLine) SetValue(value int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.valid && l.value == value {
+		return nil
+	}
+	l.value = value
+	l.valid = true
+	l.set(value)
+	return nil
+}
+
+func (l *ReaderLine) Close() error {
+	return nil
+}
+
+// errNak is returned by transact when the reader NAKs a command.
+type errNak byte
+
+func (e errNak) Error() string {
+	return fmt.Sprintf("osdp: reader sent NAK (reason %d)", byte(e))
+}
+
+// transact sends one command and returns the reader's reply.  The
+// sequence number moves on only once the reader has answered (other
+// than with BUSY, which means to send the same command again).
+func (r *Reader) transact(scb []byte, code byte, data []byte) (*packet, error) {
+	sqn := r.sqn
+	out := build_packet(r.cfg.Address, sqn, scb, code, data, r.sc, true)
+	if _, err := r.port.Write(out); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(r.cfg.ReplyTimeout)
+	if err := r.port.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		raw, err := read_packet(r.rd)
+		if err != nil {
+			return nil, err
+		}
+		// Skip anything not from our reader (including, on a
+		// half-duplex line, our own command):
+		if raw[1] != r.cfg.Address|reply_flag {
+			continue
+		}
+		if raw[4]&ctrl_sqn != sqn {
+			return nil, fmt.Errorf("osdp: reply has sequence number %d, not %d",
+				raw[4]&ctrl_sqn, sqn)
+		}
+		p, err := parse_packet(raw, r.sc, false)
+		if err != nil {
+			return nil, err
+		}
+		if p.code == reply_busy {
+			return p, nil
+		}
+		r.sqn = next_sqn(sqn)
+		if p.code == reply_nak {
+			reason := byte(0)
+			if len(p.data) > 0 {
+				reason = p.data[0]
+			}
+			return p, errNak(reason)
+		}
+		return p, nil
+	}
+}
+
+// connect starts over with the reader: it resets the sequence number,
+// sets up the secure channel (if configured), and asks for the
+// reader's status.
+func (r *Reader) connect() error {
+	r.sqn = 0
+	if r.sc != nil {
+		if err := r.handshake(); err != nil {
+			return err
+		}
+	}
+	p, err := r.transact(nil, cmd_lstat, nil)
+	if err != nil {
+		return err
+	}
+	r.handle_reply(p)
+	return nil
+}
+
+// handshake sets up a secure channel session with the reader.
+func (r *Reader) handshake() error {
+	cp_random := make([]byte, 8)
+	if _, err := rand.Read(cp_random); err != nil {
+		return err
+	}
+	r.sc.derive(cp_random)
+	key_sel := r.sc.key_select()
+
+	p, err := r.transact([]byte{3, scs_11, key_sel}, cmd_chlng, cp_random)
+	if err != nil {
+		return err
+	}
+	if p.code != reply_ccrypt || len(p.data) != 32 {
+		return fmt.Errorf("osdp: unexpected reply 0x%02X to secure channel challenge", p.code)
+	}
+	r.sc.pd_random = append([]byte(nil), p.data[8:16]...)
+	if subtle.ConstantTimeCompare(p.data[16:32], r.sc.client_cryptogram()) != 1 {
+		return errors.New("osdp: reader's cryptogram does not match (wrong secure channel key?)")
+	}
+
+	p, err = r.transact([]byte{3, scs_13, key_sel}, cmd_scrypt, r.sc.server_cryptogram())
+	if err != nil {
+		return err
+	}
+	if p.code != reply_rmac_i || len(p.data) != 16 {
+		return fmt.Errorf("osdp: unexpected reply 0x%02X to secure channel cryptogram", p.code)
+	}
+	if subtle.ConstantTimeCompare(p.data, r.sc.initial_rmac()) != 1 {
+		return errors.New("osdp: reader's initial R-MAC does not match")
+	}
+	r.sc.start(p.data)
+	return nil
+}
+
+// handle_reply handles a reply to a poll (or other command), and
+// returns any badges or key presses in it.
+func (r *Reader) handle_reply(p *packet) []wiegand.BadgeRead {
+	switch p.code {
+	case reply_ack, reply_pdid, reply_pdcap:
+		return nil
+	case reply_raw:
+		// Reader number, format code, bit count (2 bytes), and then
+		// the bits, packed MSB first:
+		if len(p.data) < 4 {
+			break
+		}
+		count := int(p.data[2]) | int(p.data[3])<<8
+		if count > 8*(len(p.data)-4) {
+			break
+		}
+		bits := make([]byte, count)
+		for i := range bits {
+			bits[i] = (p.data[4+i/8] >> uint(7-i%8)) & 1
+		}
+		return []wiegand.BadgeRead{wiegand.Decode(bits, r.cfg.Formats)}
+	case reply_fmt:
+		// Reader number, read direction, length, and then the card
+		// number in ASCII:
+		if len(p.data) < 3 || len(p.data) < 3+int(p.data[2]) {
+			break
+		}
+		n, err := strconv.ParseUint(string(p.data[3:3+int(p.data[2])]), 10, 64)
+		return []wiegand.BadgeRead{{
+			Value: n,
+			CardNumber: n,
+			NoFacilityCode: true,
+			Format: "OSDP-FMT",
+			LengthOK: err == nil,
+			ParityOK: true,
+		}}
+	case reply_keypad:
+		// Reader number, count, and then the keys in ASCII (with
+		// 0x7F for '*' and 0x0D for '#'):
+		if len(p.data) < 2 || len(p.data) < 2+int(p.data[1]) {
+			break
+		}
+		var reads []wiegand.BadgeRead
+		for _, k := range p.data[2 : 2+int(p.data[1])] {
+			key := rune(k)
+			switch {
+			case k == 0x7F:
+				key = wiegand.KeyStar
+			case k == 0x0D:
+				key = wiegand.KeyPound
+			case k < '0' || k > '9':
+				log.Printf("osdp: Ignoring unknown key 0x%02X", k)
+				continue
+			}
+			reads = append(reads, wiegand.BadgeRead{
+				Format: "OSDP-KEY",
+				Key: key,
+				LengthOK: true,
+				ParityOK: true,
+			})
+		}
+		return reads
+	case reply_lstatr:
+		if len(p.data) < 2 {
+			break
+		}
+		tamper := p.data[0] != 0
+		if tamper != r.tamper {
+			r.tamper = tamper
+			if tamper {
+				log.Printf("osdp: Reader %d reports tamper!", r.cfg.Address)
+			} else {
+				log.Printf("osdp: Reader %d tamper cleared", r.cfg.Address)
+			}
+			if r.cfg.OnTamper != nil {
+				r.cfg.OnTamper(tamper)
+			}
+		}
+		return nil
+	default:
+		log.Printf("osdp: Ignoring unexpected reply 0x%02X", p.code)
+		return nil
+	}
+	log.Printf("osdp: Ignoring malformed reply 0x%02X (%d bytes)", p.code, len(p.data))
+	return nil
+}
+
+// Listen returns a channel that will send every badge scanned and key
+// pressed on the reader, in the same form as wiegand.Reader.Listen.
+//
+// When 'ctx' is cancelled, the reader is closed (see Close), and then
+// the channel is closed.
+//
+// Raw card data is decoded with the first of the reader's formats
+// that has the same number of bits.  If the reader is offline, this
+// keeps trying to reach it.
+func (r *Reader) Listen(ctx context.Context) <-chan wiegand.BadgeRead {
+	ch := make(chan wiegand.BadgeRead)
+
+	// Closing the port is the only way to interrupt a read in
+	// progress:
+	go func() {
+		<-ctx.Done()
+		r.Close()
+	}()
+
+	go func(chan<- wiegand.BadgeRead) {
+		defer close(ch)
+		defer r.Close()
+
+		// Wait for 'd', or return false if cancelled first:
+		wait := func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for ctx.Err() == nil {
+			if !r.online {
+				if err := r.connect(); err != nil {
+					if ctx.Err() != nil {
+						return
+					}
+					if !os.IsTimeout(err) {
+						log.Printf("osdp: Reader %d: %s", r.cfg.Address, err)
+					}
+					if !wait(retry_interval) {
+						return
+					}
+					continue
+				}
+				r.online = true
+				log.Printf("osdp: Reader %d online", r.cfg.Address)
+			}
+
+			c := r.next_command()
+			p, err := r.transact(nil, c.code, c.data)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				if nak, ok := err.(errNak); ok &&
+					nak != nak_sqn && nak != nak_sc_cond {
+					// The reader just doesn't like this command:
+					log.Printf("osdp: Reader %d: %s to command 0x%02X",
+						r.cfg.Address, err, c.code)
+					continue
+				}
+				log.Printf("osdp: Reader %d offline: %s", r.cfg.Address, err)
+				r.online = false
+				continue
+			}
+			if p.code == reply_busy {
+				r.requeue(c)
+			} else {
+				for _, br := range r.handle_reply(p) {
+					select {
+					case ch <- br:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+
+			if c.code == cmd_poll && !wait(r.cfg.PollInterval) {
+				return
+			}
+		}
+	}(ch)
+
+	return ch
+}
+
+// requeue puts a command back at the front of the queue.
+func (r *Reader) requeue(c command) {
+	if c.code == cmd_poll {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.queue = append([]command{c}, r.queue...)
+}
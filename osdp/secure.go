@@ -0,0 +1,200 @@
+package osdp
+
+// OSDP secure channel (SCS).  The handshake goes:
+//
+//   CP -> PD  osdp_CHLNG   (SCS_11): RND.A
+//   PD -> CP  osdp_CCRYPT  (SCS_12): cUID, RND.B, client cryptogram
+//   CP -> PD  osdp_SCRYPT  (SCS_13): server cryptogram
+//   PD -> CP  osdp_RMAC_I  (SCS_14): initial R-MAC
+//
+// after which every packet carries a MAC, and any data is encrypted
+// (SCS_15 through SCS_18).  Both sides derive the same session keys
+// from the secure channel base key (SCBK) and RND.A.
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+)
+
+// DefaultSCBK is the well-known default key (SCBK-D) that readers use
+// when no key has been set on them.  It provides no real security.
+var DefaultSCBK = []byte{
+	0x30, 0x31, 0x32, 0x33, 0x34, 0x35, 0x36, 0x37,
+	0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D, 0x3E, 0x3F,
+}
+
+// session is the state of one secure channel session.
+type session struct {
+	scbk []byte
+
+	s_enc  []byte
+	s_mac1 []byte
+	s_mac2 []byte
+	// Last full MAC of a command (C-MAC) and of a reply (R-MAC):
+	c_mac []byte
+	r_mac []byte
+
+	cp_random []byte
+	pd_random []byte
+
+	// True once the handshake is done:
+	active bool
+}
+
+func new_session(scbk []byte) *session {
+	return &session{scbk: scbk}
+}
+
+// key_select returns the key selector to send in handshake SCBs: 0 for
+// DefaultSCBK, 1 for any other key.
+func (s *session) key_select() byte {
+	if bytes.Equal(s.scbk, DefaultSCBK) {
+		return 0
+	}
+	return 1
+}
+
+// aes_ecb encrypts one 16-byte block.
+func aes_ecb(key []byte, block []byte) []byte {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		// Only possible with a bad key length, which is checked
+		// earlier.
+		panic(err)
+	}
+	out := make([]byte, aes.BlockSize)
+	c.Encrypt(out, block)
+	return out
+}
+
+// aes_cbc encrypts 'data' (a multiple of 16 bytes) in CBC mode.
+func aes_cbc(key []byte, iv []byte, data []byte) []byte {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCEncrypter(c, iv).CryptBlocks(out, data)
+	return out
+}
+
+// derive sets up the session keys, given the CP's random number.
+func (s *session) derive(cp_random []byte) {
+	s.cp_random = append([]byte(nil), cp_random...)
+	key := func(b0 byte, b1 byte) []byte {
+		block := make([]byte, aes.BlockSize)
+		block[0] = b0
+		block[1] = b1
+		copy(block[2:8], cp_random[:6])
+		return aes_ecb(s.scbk, block)
+	}
+	s.s_enc = key(0x01, 0x82)
+	s.s_mac1 = key(0x01, 0x01)
+	s.s_mac2 = key(0x01, 0x02)
+	s.active = false
+}
+
+// client_cryptogram is what the PD sends to prove it has the key.
+func (s *session) client_cryptogram() []byte {
+	return aes_ecb(s.s_enc, append(append([]byte(nil), s.cp_random...), s.pd_random...))
+}
+
+// server_cryptogram is what the CP sends to prove it has the key.
+func (s *session) server_cryptogram() []byte {
+	return aes_ecb(s.s_enc, append(append([]byte(nil), s.pd_random...), s.cp_random...))
+}
+
+// initial_rmac returns the R-MAC that starts the session.
+func (s *session) initial_rmac() []byte {
+	return aes_ecb(s.s_mac2, aes_ecb(s.s_mac1, s.server_cryptogram()))
+}
+
+// start marks the handshake done, with 'rmac_i' as the first R-MAC.
+func (s *session) start(rmac_i []byte) {
+	s.r_mac = append([]byte(nil), rmac_i...)
+	s.c_mac = make([]byte, aes.BlockSize)
+	s.active = true
+}
+
+// compute_mac returns the full (16-byte) MAC of 'msg'.  Every block
+// but the last is chained with S-MAC1 and the last with S-MAC2,
+// starting from the last MAC in the other direction.  This doesn't
+// record the MAC (see record_mac), since a received MAC must be
+// checked first.
+func (s *session) compute_mac(is_cmd bool, msg []byte) []byte {
+	buf := append([]byte(nil), msg...)
+	if len(buf)%aes.BlockSize != 0 {
+		buf = append(buf, 0x80)
+		for len(buf)%aes.BlockSize != 0 {
+			buf = append(buf, 0)
+		}
+	}
+
+	iv := s.c_mac
+	if is_cmd {
+		iv = s.r_mac
+	}
+	n := len(buf)
+	if n > aes.BlockSize {
+		enc := aes_cbc(s.s_mac1, iv, buf[:n-aes.BlockSize])
+		iv = enc[len(enc)-aes.BlockSize:]
+	}
+	return aes_cbc(s.s_mac2, iv, buf[n-aes.BlockSize:])
+}
+
+// record_mac records 'mac' as the latest C-MAC or R-MAC.
+func (s *session) record_mac(is_cmd bool, mac []byte) {
+	if is_cmd {
+		s.c_mac = mac
+	} else {
+		s.r_mac = mac
+	}
+}
+
+// data_iv returns the IV for encrypting data: the complement of the
+// last MAC in the other direction.
+func (s *session) data_iv(is_cmd bool) []byte {
+	mac := s.c_mac
+	if is_cmd {
+		mac = s.r_mac
+	}
+	iv := make([]byte, aes.BlockSize)
+	for i := range iv {
+		iv[i] = ^mac[i]
+	}
+	return iv
+}
+
+// encrypt pads and encrypts the data of a packet.
+func (s *session) encrypt(is_cmd bool, data []byte) []byte {
+	buf := append(append([]byte(nil), data...), 0x80)
+	for len(buf)%aes.BlockSize != 0 {
+		buf = append(buf, 0)
+	}
+	return aes_cbc(s.s_enc, s.data_iv(is_cmd), buf)
+}
+
+// decrypt decrypts and unpads the data of a packet.
+func (s *session) decrypt(is_cmd bool, data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("osdp: encrypted data has bad length %d", len(data))
+	}
+	c, err := aes.NewCipher(s.s_enc)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(c, s.data_iv(is_cmd)).CryptBlocks(out, data)
+
+	// Strip the padding: zeros, then 0x80.
+	i := len(out) - 1
+	for i >= 0 && out[i] == 0 {
+		i--
+	}
+	if i < 0 || out[i] != 0x80 {
+		return nil, fmt.Errorf("osdp: bad padding on encrypted data")
+	}
+	return out[:i], nil
+}
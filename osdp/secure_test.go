@@ -0,0 +1,172 @@
+package osdp
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	test_key = []byte{
+		0x10, 0x21, 0x32, 0x43, 0x54, 0x65, 0x76, 0x87,
+		0x98, 0xA9, 0xBA, 0xCB, 0xDC, 0xED, 0xFE, 0x0F,
+	}
+	test_cp_random = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	test_pd_random = []byte{8, 7, 6, 5, 4, 3, 2, 1}
+)
+
+// handshake returns the control panel's and the reader's sessions
+// after the secure channel handshake, with keys 'cp_key' and 'pd_key'.
+// It fails the test if the handshake does.
+func handshake(t *testing.T, cp_key []byte, pd_key []byte) (*session, *session) {
+	t.Helper()
+	cp := new_session(cp_key)
+	pd := new_session(pd_key)
+
+	// osdp_CHLNG:
+	cp.derive(test_cp_random)
+	pd.derive(test_cp_random)
+	// osdp_CCRYPT:
+	cp.pd_random = test_pd_random
+	pd.pd_random = test_pd_random
+	if !bytes.Equal(cp.client_cryptogram(), pd.client_cryptogram()) {
+		t.Fatal("Client cryptograms differ")
+	}
+	// osdp_SCRYPT, osdp_RMAC_I:
+	if !bytes.Equal(cp.server_cryptogram(), pd.server_cryptogram()) {
+		t.Fatal("Server cryptograms differ")
+	}
+	rmac_i := pd.initial_rmac()
+	if !bytes.Equal(cp.initial_rmac(), rmac_i) {
+		t.Fatal("Initial R-MACs differ")
+	}
+	cp.start(rmac_i)
+	pd.start(rmac_i)
+	return cp, pd
+}
+
+func TestHandshakeKeys(t *testing.T) {
+	handshake(t, test_key, test_key)
+	handshake(t, DefaultSCBK, DefaultSCBK)
+
+	// A reader with another key can't make the client cryptogram:
+	cp := new_session(test_key)
+	pd := new_session(DefaultSCBK)
+	cp.derive(test_cp_random)
+	pd.derive(test_cp_random)
+	cp.pd_random = test_pd_random
+	pd.pd_random = test_pd_random
+	if bytes.Equal(cp.client_cryptogram(), pd.client_cryptogram()) {
+		t.Error("Client cryptograms match with different keys")
+	}
+
+	if new_session(DefaultSCBK).key_select() != 0 || new_session(test_key).key_select() != 1 {
+		t.Error("Wrong key selector")
+	}
+}
+
+func TestSecureRoundTrip(t *testing.T) {
+	cp, pd := handshake(t, test_key, test_key)
+
+	// Several packets each way, so that the MAC chaining and IVs are
+	// checked too:
+	for i := 0; i < 3; i++ {
+		sqn := next_sqn(byte(i))
+		led := []byte{0, 0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+		raw := build_packet(1, sqn, nil, cmd_led, led, cp, true)
+		if bytes.Contains(raw, led) {
+			t.Errorf("Command data wasn't encrypted")
+		}
+		p, err := parse_packet(raw, pd, true)
+		if err != nil {
+			t.Fatalf("Command %d: %s", i, err)
+		}
+		if p.code != cmd_led || !bytes.Equal(p.data, led) || p.scb[1] != scs_17 {
+			t.Errorf("Command %d parsed as %+v", i, p)
+		}
+
+		// A reply with no data only has a MAC:
+		raw = build_packet(1 | reply_flag, sqn, nil, reply_ack, nil, pd, false)
+		p, err = parse_packet(raw, cp, false)
+		if err != nil {
+			t.Fatalf("Reply %d: %s", i, err)
+		}
+		if p.code != reply_ack || len(p.data) != 0 || p.scb[1] != scs_16 {
+			t.Errorf("Reply %d parsed as %+v", i, p)
+		}
+
+		card := []byte{0, 1, 26, 0, 0x40, 0x3F, 0x12, 0x80}
+		raw = build_packet(1 | reply_flag, sqn, nil, reply_raw, card, pd, false)
+		p, err = parse_packet(raw, cp, false)
+		if err != nil {
+			t.Fatalf("Card reply %d: %s", i, err)
+		}
+		if !bytes.Equal(p.data, card) || p.scb[1] != scs_18 {
+			t.Errorf("Card reply %d parsed as %+v", i, p)
+		}
+	}
+}
+
+// A reply with a bad MAC is refused, and doesn't change the R-MAC, so
+// the next genuine reply is still accepted.
+func TestSecureBadMAC(t *testing.T) {
+	cp, pd := handshake(t, test_key, test_key)
+
+	card := []byte{0, 1, 26, 0, 0x40, 0x3F, 0x12, 0x80}
+	good := build_packet(1 | reply_flag, 1, nil, reply_raw, card, pd, false)
+	// Flip a bit of the MAC, and of the encrypted data:
+	for _, idx := range []int{len(good) - 3, header_len + 3} {
+		bad := append([]byte(nil), good...)
+		bad[idx] ^= 0x01
+		r_mac := append([]byte(nil), cp.r_mac...)
+		if _, err := parse_packet(bad, cp, false); err == nil {
+			t.Errorf("Tampered reply (byte %d) accepted", idx)
+		}
+		if !bytes.Equal(cp.r_mac, r_mac) {
+			t.Errorf("R-MAC changed by a refused reply")
+		}
+	}
+	if _, err := parse_packet(good, cp, false); err != nil {
+		t.Errorf("Genuine reply refused after tampered ones: %s", err)
+	}
+}
+
+// Once the secure channel is up, a plaintext reply (e.g. a badge
+// injected by something else on the bus) is refused.
+func TestSecurePlaintextRefused(t *testing.T) {
+	cp, _ := handshake(t, test_key, test_key)
+	card := []byte{0, 1, 26, 0, 0x40, 0x3F, 0x12, 0x80}
+	raw := build_packet(1 | reply_flag, 1, nil, reply_raw, card, nil, false)
+	if _, err := parse_packet(raw, cp, false); err == nil {
+		t.Error("Plaintext reply accepted in the secure channel")
+	}
+}
+
+// A reader with the wrong key can't produce replies that verify.
+func TestSecureWrongKey(t *testing.T) {
+	cp, _ := handshake(t, test_key, test_key)
+	_, pd := handshake(t, DefaultSCBK, DefaultSCBK)
+	raw := build_packet(1 | reply_flag, 1, nil, reply_ack, nil, pd, false)
+	if _, err := parse_packet(raw, cp, false); err == nil {
+		t.Error("Reply MACed with the wrong key accepted")
+	}
+}
+
+// A secure message with no secure session is refused.
+func TestSecureWithoutSession(t *testing.T) {
+	_, pd := handshake(t, test_key, test_key)
+	raw := build_packet(1 | reply_flag, 1, nil, reply_ack, nil, pd, false)
+	if _, err := parse_packet(raw, nil, false); err == nil {
+		t.Error("Secure reply accepted without a session")
+	}
+}
+
+func TestDecryptBad(t *testing.T) {
+	cp, _ := handshake(t, test_key, test_key)
+	if _, err := cp.decrypt(false, []byte{1, 2, 3}); err == nil {
+		t.Error("Decrypted data of a bad length")
+	}
+	// Good length, but garbage, so the padding is wrong:
+	if _, err := cp.decrypt(false, make([]byte, 16)); err == nil {
+		t.Error("Decrypted data with bad padding")
+	}
+}
@@ -0,0 +1,79 @@
+package osdp
+
+// Serial port setup (Linux only, through termios ioctls).
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Mask of the baud rate bits in Termios.Cflag (not in package
+// syscall):
+const cbaud = 0x100F
+
+var baud_rates = map[int]uint32{
+	9600:   syscall.B9600,
+	19200:  syscall.B19200,
+	38400:  syscall.B38400,
+	57600:  syscall.B57600,
+	115200: syscall.B115200,
+}
+
+// open_serial opens a serial device in raw mode, 8N1, at 'baud'.
+func open_serial(device string, baud int) (*os.File, error) {
+	speed, ok := baud_rates[baud]
+	if !ok {
+		return nil, fmt.Errorf("osdp: unsupported baud rate %d", baud)
+	}
+
+	f, err := os.OpenFile(device, os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// (f.Fd() would put the file into blocking mode, which breaks read
+	// deadlines, so go through SyscallConn instead.)
+	conn, err := f.SyscallConn()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	var ioctl_err error
+	err = conn.Control(func(fd uintptr) {
+		var t syscall.Termios
+		if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd,
+			syscall.TCGETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+			ioctl_err = e
+			return
+		}
+
+		// Equivalent of cfmakeraw(), plus 8N1 at the given speed:
+		t.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK |
+			syscall.ISTRIP | syscall.INLCR | syscall.IGNCR |
+			syscall.ICRNL | syscall.IXON
+		t.Oflag &^= syscall.OPOST
+		t.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON |
+			syscall.ISIG | syscall.IEXTEN
+		t.Cflag &^= syscall.CSIZE | syscall.PARENB | syscall.CSTOPB | cbaud
+		t.Cflag |= syscall.CS8 | syscall.CREAD | syscall.CLOCAL | speed
+		t.Ispeed = speed
+		t.Ospeed = speed
+		t.Cc[syscall.VMIN] = 1
+		t.Cc[syscall.VTIME] = 0
+
+		if _, _, e := syscall.Syscall(syscall.SYS_IOCTL, fd,
+			syscall.TCSETS, uintptr(unsafe.Pointer(&t))); e != 0 {
+			ioctl_err = e
+		}
+	})
+	if err == nil {
+		err = ioctl_err
+	}
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("osdp: setting up %s: %s", device, err)
+	}
+	return f, nil
+}
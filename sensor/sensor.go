@@ -1,46 +1,208 @@
 package sensor
 
+// The sensor package watches a potentially noisy input (like a door
+// sensor) and reports its state once it has settled.
+//
+// This is driven by edge events rather than by polling: every edge
+// restarts a settle timer, and only once the input has gone 'settle'
+// with no edges is it read and its new state reported.  While nothing
+// changes, nothing runs.
+
 import (
-	"time"
+	"context"
 	"log"
+	"sync"
+	"time"
+
 	"github.com/warthog618/gpiod"
+
+	"hive13/rfid/gpio"
 )
 
-// Listen on pin 'p' for state-changes, allowing the given amount of
-// time for the pin's state to settle.  Returns a channel which will
-// send a 'true' every time it transitions (after this settling) to a
-// high value, and a 'false' every time it transitions to a low value.
-func ListenSensor(pin *gpiod.Line, settle time.Duration) (<-chan bool, error) {
+// Default for the settle time:
+const DefaultSettle = 300 * time.Millisecond
+
+// Sensor is one debounced input.
+type Sensor struct {
+	offset int
+	settle time.Duration
+	pin gpio.InputLine
+
+	// Signalled (without blocking) whenever 'state' changes:
+	changed chan struct{}
+
+	// mu guards everything below, which is written by the edge
+	// handler and by settle_timer:
+	mu sync.Mutex
+	// Debounced state (true for high), and whether it is known yet:
+	state bool
+	valid bool
+	// Incremented on every edge, so that a stale settle_timer can tell
+	// that it is stale:
+	edge_gen uint64
+	settle_timer *time.Timer
+	closed bool
+}
+
+// New requests line 'offset' from 'chip' as an input, and starts
+// watching it.  Its state is known (see State) once it has first been
+// stable for 'settle' (or DefaultSettle, if 'settle' is zero).
+func New(chip gpio.Chip, offset int, settle time.Duration) (*Sensor, error) {
+	if settle <= 0 {
+		settle = DefaultSettle
+	}
+	s := &Sensor{
+		offset: offset,
+		settle: settle,
+		changed: make(chan struct{}, 1),
+	}
+
+	pin, err := chip.RequestInput(offset, gpiod.LineEdgeBoth, s.edge)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pin = pin
+	// The first state is whatever it settles to from here:
+	s.start_settle()
+	return s, nil
+}
+
+// edge handles an edge event on the input.
+func (s *Sensor) edge(evt gpiod.LineEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.start_settle()
+}
+
+// start_settle (re)starts the settle timer.  s.mu must be held.
+func (s *Sensor) start_settle() {
+	s.edge_gen += 1
+	if s.settle_timer != nil {
+		s.settle_timer.Stop()
+	}
+	gen := s.edge_gen
+	s.settle_timer = time.AfterFunc(s.settle, func() {
+		s.settled(gen)
+	})
+}
 
+// settled is called when the input has had no edges for the settle
+// time.  It reads the input (rather than trusting the last edge, in
+// case any edge was missed), and updates the state.
+func (s *Sensor) settled(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed || s.edge_gen != gen || s.pin == nil {
+		return
+	}
+
+	val, err := s.pin.Value()
+	if err != nil {
+		log.Printf("Error reading GPIO pin %d for sensor: %s", s.offset, err)
+		// Try again later:
+		s.start_settle()
+		return
+	}
+
+	state := val == 1
+	if s.valid && s.state == state {
+		return
+	}
+	s.state = state
+	s.valid = true
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// State returns the input's current debounced state (true for high),
+// and whether that state is known yet.
+func (s *Sensor) State() (state bool, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state, s.valid
+}
+
+// Close releases the input.  Calling it more than once has no further
+// effect.
+func (s *Sensor) Close() error {
+	s.mu.Lock()
+	if s.settle_timer != nil {
+		s.settle_timer.Stop()
+	}
+	closed := s.closed
+	s.closed = true
+	s.mu.Unlock()
+
+	if closed {
+		return nil
+	}
+	return s.pin.Close()
+}
+
+// Listen returns a channel which will send the state once it is first
+// known, and then a 'true' every time the input transitions (after
+// settling) to high, and a 'false' every time it transitions to low.
+// If the state flips more than once before the receiver is ready,
+// only the latest state is sent.
+//
+// When 'ctx' is cancelled, the sensor is closed (see Close), and then
+// the channel is closed.  Only one Listen should be running at a time.
+func (s *Sensor) Listen(ctx context.Context) <-chan bool {
 	ch := make(chan bool)
 
-	go func(pin *gpiod.Line) {
-		last_state := false
-		state := false
-		state_sent := false
-		val := 0
-		var err error
-		
+	go func() {
+		defer close(ch)
+		defer s.Close()
+
+		sent := false
+		last := false
 		for {
-			last_state = state
-			val, err = pin.Value()
-			if err != nil {
-				log.Printf("Error reading GPIO pin %d for sensor: %s", err)
-			} else {
-				state = val == 1
-
-				if state != last_state {
-					<-time.After(settle)
-				} else {
-					if state != state_sent {
-						ch <- state
-						state_sent = state
-					}
-					<-time.After(10 * time.Millisecond)
-				}
+			select {
+			case <-s.changed:
+			case <-ctx.Done():
+				return
+			}
+
+			state, ok := s.State()
+			if !ok || (sent && state == last) {
+				continue
+			}
+			select {
+			case ch <- state:
+				sent = true
+				last = state
+			case <-ctx.Done():
+				return
 			}
 		}
-	}(pin)
+	}()
+
+	return ch
+}
+
+// ListenSensor is a shortcut for New followed by Listen.
+//
+// Listen on pin 'offset' for state-changes, allowing the given amount
+// of time for the pin's state to settle.  Returns a channel which will
+// send a 'true' every time it transitions (after this settling) to a
+// high value, and a 'false' every time it transitions to a low value.
+//
+// When 'ctx' is cancelled, the pin is released, and then the channel
+// is closed.
+func ListenSensor(ctx context.Context, chip gpio.Chip, offset int,
+	settle time.Duration) (<-chan bool, error) {
 
-	return ch, nil
+	s, err := New(chip, offset, settle)
+	if err != nil {
+		return nil, err
+	}
+	return s.Listen(ctx), nil
 }
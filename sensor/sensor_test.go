@@ -0,0 +1,137 @@
+package sensor_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/sensor"
+)
+
+const (
+	pin = 4
+	settle = 30 * time.Millisecond
+)
+
+// start returns a sensor on a fake input that starts at 'value', its
+// Listen channel, and a function to stop it (which the test must call).
+func start(t *testing.T, value int) (*gpiofake.Input, *sensor.Sensor, <-chan bool, func()) {
+	t.Helper()
+	chip := gpiofake.NewChip()
+	in := chip.Input(pin)
+	in.Set(value)
+	s, err := sensor.New(chip, pin, settle)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.Listen(ctx)
+	return in, s, ch, func() {
+		cancel()
+		for range ch {
+		}
+	}
+}
+
+// next returns the next state from 'ch', failing the test if there is
+// none within a second.
+func next(t *testing.T, ch <-chan bool) bool {
+	t.Helper()
+	select {
+	case state := <-ch:
+		return state
+	case <-time.After(time.Second):
+		t.Fatal("No state sent")
+	}
+	return false
+}
+
+// none fails the test if 'ch' sends anything for a few settle times.
+func none(t *testing.T, ch <-chan bool) {
+	t.Helper()
+	select {
+	case state := <-ch:
+		t.Fatalf("Unexpected state %t", state)
+	case <-time.After(4 * settle):
+	}
+}
+
+func TestInitialState(t *testing.T) {
+	for _, value := range []int{0, 1} {
+		_, s, ch, stop := start(t, value)
+		if _, ok := s.State(); ok {
+			t.Errorf("State known before settling")
+		}
+		if state := next(t, ch); state != (value == 1) {
+			t.Errorf("Initial state %t for value %d", state, value)
+		}
+		if state, ok := s.State(); !ok || state != (value == 1) {
+			t.Errorf("State() is %t, %t for value %d", state, ok, value)
+		}
+		stop()
+	}
+}
+
+func TestChange(t *testing.T) {
+	in, _, ch, stop := start(t, 0)
+	defer stop()
+	next(t, ch)
+	in.Set(1)
+	if !next(t, ch) {
+		t.Errorf("Change to high sent as low")
+	}
+	in.Set(0)
+	if next(t, ch) {
+		t.Errorf("Change to low sent as high")
+	}
+	none(t, ch)
+}
+
+// Bouncing is only reported once it settles, and not at all if it
+// settles back where it started.
+func TestDebounce(t *testing.T) {
+	in, _, ch, stop := start(t, 0)
+	defer stop()
+	next(t, ch)
+
+	for i := 0; i < 5; i++ {
+		in.Set(1)
+		in.Set(0)
+	}
+	none(t, ch)
+
+	for i := 0; i < 5; i++ {
+		in.Set(1)
+		in.Set(0)
+	}
+	in.Set(1)
+	if !next(t, ch) {
+		t.Errorf("Bounce ending high sent as low")
+	}
+	none(t, ch)
+}
+
+// An input that keeps changing faster than the settle time is never
+// reported until it stops.
+func TestNoReportWhileBouncing(t *testing.T) {
+	in, _, ch, stop := start(t, 0)
+	defer stop()
+	next(t, ch)
+
+	value := 0
+	until := time.Now().Add(5 * settle)
+	for time.Now().Before(until) {
+		value ^= 1
+		in.Set(value)
+		select {
+		case state := <-ch:
+			t.Fatalf("State %t sent while still bouncing", state)
+		case <-time.After(settle / 5):
+		}
+	}
+	if value == 1 {
+		in.Set(0)
+	}
+	none(t, ch)
+}
@@ -0,0 +1,75 @@
+package main
+
+// Utility which runs the Wiegand reader against gpiofake (so no
+// hardware is needed), sends it a few synthesized frames, and prints
+// what it decodes.
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/wiegand"
+)
+
+// bits returns 'n' bits of 'v', MSB first.
+func bits(v uint64, n int) []byte {
+	b := make([]byte, n)
+	for i := 0; i < n; i++ {
+		b[n-1-i] = byte((v >> uint(i)) & 1)
+	}
+	return b
+}
+
+// h10301 returns a 26-bit H10301 frame, with parity.
+func h10301(fc uint64, cn uint64) []byte {
+	data := bits(fc<<16|cn, 24)
+	frame := append([]byte{0}, data...)
+	frame = append(frame, 1)
+	for _, b := range data[:12] {
+		frame[0] ^= b
+	}
+	for _, b := range data[12:] {
+		frame[25] ^= b
+	}
+	return frame
+}
+
+func main() {
+	d0 := 17
+	d1 := 18
+	chip := gpiofake.NewChip()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reader, err := wiegand.NewReader(chip, wiegand.Config{
+		PinD0: d0,
+		PinD1: d1,
+		Formats: []wiegand.Format{wiegand.H10301, wiegand.Keypad4},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	badges := reader.Listen(ctx)
+
+	go func() {
+		chip.SendWiegand(d0, d1, h10301(123, 45678))
+		time.Sleep(100 * time.Millisecond)
+		// Bad parity:
+		frame := h10301(1, 1)
+		frame[0] ^= 1
+		chip.SendWiegand(d0, d1, frame)
+		time.Sleep(100 * time.Millisecond)
+		// Keypad '4', '2', '#':
+		for _, k := range []uint64{4, 2, 11} {
+			chip.SendWiegand(d0, d1, bits(k, 4))
+			time.Sleep(100 * time.Millisecond)
+		}
+		cancel()
+	}()
+
+	for b := range badges {
+		log.Printf("Scanned badge: %+v", b)
+	}
+	log.Printf("Channel closed")
+}
@@ -0,0 +1,147 @@
+package main
+
+// Utility which runs the OSDP control panel against a simulated reader
+// (osdp.Peripheral) over a pty pair, so no hardware is needed.  It
+// sends a badge, some key presses, a tamper event, and LED and buzzer
+// commands, and prints what comes through.
+//
+// Run with -secure to use the secure channel.
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"hive13/rfid/osdp"
+)
+
+// open_pty opens a new pty pair, returning the master and the path of
+// the slave.
+func open_pty() (*os.File, string, error) {
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, err := master.SyscallConn()
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	var n uint32
+	var errno syscall.Errno
+	err = conn.Control(func(fd uintptr) {
+		var unlock int32
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+			syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock)))
+		if errno != 0 {
+			return
+		}
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd,
+			syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	})
+	if err == nil && errno != 0 {
+		err = errno
+	}
+	if err != nil {
+		master.Close()
+		return nil, "", err
+	}
+	return master, fmt.Sprintf("/dev/pts/%d", n), nil
+}
+
+// bits returns 'n' bits of 'v', MSB first.
+func bits(v uint64, n int) []byte {
+	b := make([]byte, n)
+	for i := 0; i < n; i++ {
+		b[n-1-i] = byte((v >> uint(i)) & 1)
+	}
+	return b
+}
+
+// h10301 returns a 26-bit H10301 frame, with parity.
+func h10301(fc uint64, cn uint64) []byte {
+	data := bits(fc<<16|cn, 24)
+	frame := append([]byte{0}, data...)
+	frame = append(frame, 1)
+	for _, b := range data[:12] {
+		frame[0] ^= b
+	}
+	for _, b := range data[12:] {
+		frame[25] ^= b
+	}
+	return frame
+}
+
+func main() {
+	secure := flag.Bool("secure", false, "Use the secure channel (with the default key)")
+	flag.Parse()
+
+	master, slave, err := open_pty()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var scbk []byte
+	if *secure {
+		scbk = osdp.DefaultSCBK
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pd := &osdp.Peripheral{
+		Address: 1,
+		SCBK: scbk,
+		OnLED: func(c osdp.LedColor) {
+			log.Printf("Peripheral: LED color %d", c)
+		},
+		OnBuzzer: func(on bool) {
+			log.Printf("Peripheral: buzzer on=%v", on)
+		},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := pd.Serve(ctx, master); err != nil {
+			log.Printf("Peripheral: %s", err)
+		}
+	}()
+
+	reader, err := osdp.Open(osdp.Config{
+		Device: slave,
+		Address: 1,
+		SCBK: scbk,
+		OnTamper: func(tamper bool) {
+			log.Printf("Tamper: %v", tamper)
+		},
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	badges := reader.Listen(ctx)
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		pd.Swipe(h10301(123, 45678))
+		pd.Keys("42#")
+		reader.LED().SetValue(0)
+		reader.Beeper().SetValue(0)
+		time.Sleep(200 * time.Millisecond)
+		reader.Beeper().SetValue(1)
+		pd.SetTamper(true)
+		time.Sleep(200 * time.Millisecond)
+		pd.SetTamper(false)
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+
+	for b := range badges {
+		log.Printf("Scanned badge: %+v", b)
+	}
+	<-done
+	log.Printf("Channel closed")
+}
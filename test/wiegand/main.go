@@ -1,16 +1,16 @@
 package main
 
 import (
+	"context"
 	"log"
 
-	"github.com/warthog618/gpiod"
-
+	"hive13/rfid/gpio"
 	"hive13/rfid/wiegand"
 )
 
 
 func main() {
-	chip, err := gpiod.NewChip("gpiochip0")
+	chip, err := gpio.NewChip("gpiochip0")
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -19,7 +19,7 @@ func main() {
 	d0 := 17
 	d1 := 18
 	log.Printf("D0=%d D1=%d...", d0, d1)
-	badges, err := wiegand.ListenBadges(chip, d0, d1)
+	badges, err := wiegand.ListenBadges(context.Background(), chip, d0, d1)
 	if err != nil {
 		log.Fatal(err)
 	}
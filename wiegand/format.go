@@ -0,0 +1,236 @@
+package wiegand
+
+// Wiegand card formats. Each Format knows its own frame length,
+// parity layout, and how to pull the value out of the frame.
+//
+// Bit positions below are 0-based, counting from the first bit
+// received.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Format decodes Wiegand frames of one particular card format.
+type Format interface {
+	// Name returns the short name used to select this format,
+	// e.g. "H10301".
+	Name() string
+	// Length returns the number of bits in a frame of this format.
+	Length() int
+	// Decode fills in the value, facility code, card number, and
+	// parity of 'br' from 'bits', which has one entry (0 or 1) per bit
+	// and is exactly Length() long.
+	Decode(bits []byte, br *BadgeRead)
+}
+
+// All built-in and registered formats, by name:
+var formats = make(map[string]Format)
+
+// Register adds a Format to the registry so that it may be found by
+// LookupFormat. It panics if a format of the same name is already
+// registered.
+func Register(f Format) {
+	if _, ok := formats[f.Name()]; ok {
+		panic(fmt.Sprintf("wiegand: format %s registered twice", f.Name()))
+	}
+	formats[f.Name()] = f
+}
+
+// LookupFormat returns the registered format with the given name.
+func LookupFormat(name string) (Format, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown Wiegand format %q (known formats: %v)",
+			name, FormatNames())
+	}
+	return f, nil
+}
+
+// FormatNames returns the names of all registered formats, sorted.
+func FormatNames() []string {
+	names := make([]string, 0, len(formats))
+	for name, _ := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DefaultFormats returns the formats used when none are given, which
+// is just 26-bit H10301.
+func DefaultFormats() []Format {
+	return []Format{H10301}
+}
+
+// bitRange is a range of bit positions, [start, start+len).
+type bitRange struct {
+	start int
+	len   int
+}
+
+// field returns the bits in 'r' as an integer, first bit as MSB.
+func field(bits []byte, r bitRange) uint64 {
+	var val uint64 = 0
+	for _, b := range bits[r.start : r.start+r.len] {
+		val = (val << 1) | uint64(b&1)
+	}
+	return val
+}
+
+// parity returns the XOR of all bits in the given positions.
+func parity(bits []byte, positions []int) byte {
+	var p byte = 0
+	for _, i := range positions {
+		p ^= bits[i] & 1
+	}
+	return p
+}
+
+// span returns the positions in [start, start+len).
+func span(start, len int) []int {
+	pos := make([]int, len)
+	for i := range pos {
+		pos[i] = start + i
+	}
+	return pos
+}
+
+// parityCheck is one parity bit, and the bits that it covers
+// (including itself).
+type parityCheck struct {
+	covers []int
+	// True for odd parity, false for even:
+	odd bool
+}
+
+func (p parityCheck) ok(bits []byte) bool {
+	return (parity(bits, p.covers) == 1) == p.odd
+}
+
+// simpleFormat handles the common layout of one leading even parity
+// bit, one trailing odd parity bit, and data bits in between (e.g.
+// H10301, H10304, H10306).
+type simpleFormat struct {
+	name   string
+	length int
+	// Data bits covered by the first (even) and last (odd) parity
+	// bits. (These may overlap, as in H10304.)
+	even bitRange
+	odd  bitRange
+	// Facility code and card number:
+	fc bitRange
+	cn bitRange
+}
+
+func (f simpleFormat) Name() string { return f.name }
+func (f simpleFormat) Length() int  { return f.length }
+
+func (f simpleFormat) Decode(bits []byte, br *BadgeRead) {
+	checks := []parityCheck{
+		{covers: append([]int{0}, span(f.even.start, f.even.len)...), odd: false},
+		{covers: append(span(f.odd.start, f.odd.len), f.length-1), odd: true},
+	}
+	br.ParityOK = checks[0].ok(bits) && checks[1].ok(bits)
+	br.Value = field(bits, bitRange{1, f.length - 2})
+	br.FacilityCode = field(bits, f.fc)
+	br.CardNumber = field(bits, f.cn)
+}
+
+// corporate1000 handles HID Corporate 1000 formats, which have three
+// parity bits: bit 1 is even parity over every data bit not at a
+// position of the form 3n+1, the last bit is odd parity over every
+// bit not at a position of the form 3n, and bit 0 is odd parity over
+// the whole frame.  The company ID (which is treated as the facility
+// code) starts at bit 2, and the card number takes up the rest.
+type corporate1000 struct {
+	name   string
+	length int
+	// Number of bits in the company ID:
+	companyLen int
+}
+
+func (f corporate1000) Name() string { return f.name }
+func (f corporate1000) Length() int  { return f.length }
+
+func (f corporate1000) Decode(bits []byte, br *BadgeRead) {
+	last := f.length - 1
+	even := []int{1}
+	odd := []int{last}
+	for i := 1; i < last; i++ {
+		if i >= 2 && i%3 != 1 {
+			even = append(even, i)
+		}
+		if i%3 != 0 {
+			odd = append(odd, i)
+		}
+	}
+	checks := []parityCheck{
+		{covers: span(0, f.length), odd: true},
+		{covers: even, odd: false},
+		{covers: odd, odd: true},
+	}
+	br.ParityOK = true
+	for _, c := range checks {
+		br.ParityOK = br.ParityOK && c.ok(bits)
+	}
+	br.Value = field(bits, bitRange{2, f.length - 3})
+	br.FacilityCode = field(bits, bitRange{2, f.companyLen})
+	br.CardNumber = field(bits, bitRange{2 + f.companyLen, f.length - 3 - f.companyLen})
+}
+
+// Built-in formats:
+var (
+	// H10301 is the standard 26-bit format: 8-bit facility code,
+	// 16-bit card number.
+	H10301 Format = simpleFormat{name: "H10301", length: 26,
+		even: bitRange{1, 12}, odd: bitRange{13, 12},
+		fc: bitRange{1, 8}, cn: bitRange{9, 16}}
+	// H10306 is a 34-bit format: 16-bit facility code, 16-bit card
+	// number.
+	H10306 Format = simpleFormat{name: "H10306", length: 34,
+		even: bitRange{1, 16}, odd: bitRange{17, 16},
+		fc: bitRange{1, 16}, cn: bitRange{17, 16}}
+	// H10304 is a 37-bit format: 16-bit facility code, 19-bit card
+	// number.
+	H10304 Format = simpleFormat{name: "H10304", length: 37,
+		even: bitRange{1, 18}, odd: bitRange{18, 18},
+		fc: bitRange{1, 16}, cn: bitRange{17, 19}}
+	// Corporate1000_35 is HID's 35-bit Corporate 1000: 12-bit company
+	// ID, 20-bit card number.
+	Corporate1000_35 Format = corporate1000{name: "C1K35", length: 35,
+		companyLen: 12}
+	// Corporate1000_48 is HID's 48-bit Corporate 1000: 22-bit company
+	// ID, 23-bit card number.
+	Corporate1000_48 Format = corporate1000{name: "C1K48", length: 48,
+		companyLen: 22}
+)
+
+func init() {
+	Register(H10301)
+	Register(H10306)
+	Register(H10304)
+	Register(Corporate1000_35)
+	Register(Corporate1000_48)
+}
+
+// Decode decodes a raw frame (one byte, 0 or 1, per bit) using the
+// first of 'fmts' whose length matches. If none match, the returned
+// BadgeRead has LengthOK false.
+func Decode(bits []byte, fmts []Format) BadgeRead {
+	br := BadgeRead{
+		RawBits: make([]byte, len(bits)),
+	}
+	copy(br.RawBits, bits)
+
+	for _, f := range fmts {
+		if f.Length() != len(bits) {
+			continue
+		}
+		br.LengthOK = true
+		br.Format = f.Name()
+		f.Decode(br.RawBits, &br)
+		break
+	}
+	return br
+}
@@ -0,0 +1,137 @@
+package wiegand
+
+import (
+	"testing"
+)
+
+// put sets the bits in 'r' to 'val', first bit as MSB (the reverse of
+// field).
+func put(bits []byte, r bitRange, val uint64) {
+	for i := r.len - 1; i >= 0; i-- {
+		bits[r.start+i] = byte(val & 1)
+		val >>= 1
+	}
+}
+
+// card_formats are the built-in card formats, with where each puts the
+// facility code and card number, and its parity bits:
+var card_formats = []struct {
+	format Format
+	fc     bitRange
+	cn     bitRange
+	parity []int
+}{
+	{H10301, bitRange{1, 8}, bitRange{9, 16}, []int{0, 25}},
+	{H10306, bitRange{1, 16}, bitRange{17, 16}, []int{0, 33}},
+	{H10304, bitRange{1, 16}, bitRange{17, 19}, []int{0, 36}},
+	{Corporate1000_35, bitRange{2, 12}, bitRange{14, 20}, []int{0, 1, 34}},
+	{Corporate1000_48, bitRange{2, 22}, bitRange{24, 23}, []int{0, 1, 47}},
+}
+
+// encode returns a frame in format 'i' of card_formats with the given
+// facility code and card number.  Its parity bits are found by trying
+// every combination until Decode accepts one; it fails the test unless
+// exactly one combination is accepted.
+func encode(t *testing.T, i int, fc uint64, cn uint64) []byte {
+	t.Helper()
+	cf := card_formats[i]
+	bits := make([]byte, cf.format.Length())
+	put(bits, cf.fc, fc)
+	put(bits, cf.cn, cn)
+
+	var found []byte
+	for combo := 0; combo < 1<<uint(len(cf.parity)); combo++ {
+		for j, pos := range cf.parity {
+			bits[pos] = byte(combo>>uint(j)) & 1
+		}
+		if Decode(bits, []Format{cf.format}).ParityOK {
+			if found != nil {
+				t.Fatalf("%s: more than one set of parity bits is accepted", cf.format.Name())
+			}
+			found = append([]byte(nil), bits...)
+		}
+	}
+	if found == nil {
+		t.Fatalf("%s: no set of parity bits is accepted", cf.format.Name())
+	}
+	return found
+}
+
+func TestDecodeCardFormats(t *testing.T) {
+	var all []Format
+	for _, cf := range card_formats {
+		all = append(all, cf.format)
+	}
+	for i, cf := range card_formats {
+		fc := uint64(1)<<uint(cf.fc.len) - 2
+		cn := uint64(1)<<uint(cf.cn.len) - 3
+		for _, v := range []struct{ fc, cn uint64 }{{0, 0}, {1, 1}, {fc, cn}, {123, 4567}} {
+			bits := encode(t, i, v.fc, v.cn)
+			br := Decode(bits, all)
+			if !br.LengthOK || !br.ParityOK || br.Format != cf.format.Name() {
+				t.Errorf("%s %d:%d: decoded as format %q, length OK %t, parity OK %t",
+					cf.format.Name(), v.fc, v.cn, br.Format, br.LengthOK, br.ParityOK)
+			}
+			if br.FacilityCode != v.fc || br.CardNumber != v.cn {
+				t.Errorf("%s %d:%d: decoded as %d:%d",
+					cf.format.Name(), v.fc, v.cn, br.FacilityCode, br.CardNumber)
+			}
+		}
+	}
+}
+
+func TestDecodeParityErrors(t *testing.T) {
+	for i, cf := range card_formats {
+		bits := encode(t, i, 123, 4567)
+		// Every bit is covered by some parity bit, so flipping any one
+		// of them must be caught:
+		for pos := range bits {
+			bits[pos] ^= 1
+			if Decode(bits, []Format{cf.format}).ParityOK {
+				t.Errorf("%s: flipping bit %d isn't caught", cf.format.Name(), pos)
+			}
+			bits[pos] ^= 1
+		}
+	}
+}
+
+// H10301's parity is well known: the first bit is even parity over the
+// next 12, and the last bit is odd parity over the 12 before it.
+func TestH10301Parity(t *testing.T) {
+	bits := encode(t, 0, 18, 25000)
+	ones := func(from, to int) int {
+		n := 0
+		for _, b := range bits[from:to] {
+			n += int(b)
+		}
+		return n
+	}
+	if int(bits[0]) != ones(1, 13)%2 {
+		t.Errorf("Leading parity bit is %d, for %d ones", bits[0], ones(1, 13))
+	}
+	if int(bits[25]) != 1-ones(13, 25)%2 {
+		t.Errorf("Trailing parity bit is %d, for %d ones", bits[25], ones(13, 25))
+	}
+	if v := Decode(bits, DefaultFormats()).Value; v != 18<<16|25000 {
+		t.Errorf("Value is %d, not %d", v, 18<<16|25000)
+	}
+}
+
+func TestDecodeLength(t *testing.T) {
+	bits := encode(t, 0, 1, 2)
+	br := Decode(bits, []Format{H10306})
+	if br.LengthOK || br.Format != "" {
+		t.Errorf("26 bits decoded as %q with only H10306", br.Format)
+	}
+	if len(br.RawBits) != len(bits) {
+		t.Errorf("RawBits has %d bits, not %d", len(br.RawBits), len(bits))
+	}
+
+	// The first format of the right length wins:
+	other := simpleFormat{name: "OTHER", length: 26,
+		even: bitRange{1, 12}, odd: bitRange{13, 12},
+		fc: bitRange{1, 4}, cn: bitRange{5, 20}}
+	if br := Decode(bits, []Format{other, H10301}); br.Format != "OTHER" {
+		t.Errorf("Decoded as %q, not OTHER", br.Format)
+	}
+}
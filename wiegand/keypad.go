@@ -0,0 +1,116 @@
+package wiegand
+
+// Keypad support. Many readers with keypads send each key press as
+// its own short Wiegand burst, either 4 bits (just the key), or 8 bits
+// (the key, preceded by its complement).
+
+// Keys as they are given in BadgeRead.Key:
+const (
+	KeyStar  = '*'
+	KeyPound = '#'
+)
+
+// Key values (as sent over Wiegand) for '*' and '#'; 0-9 are sent as
+// themselves:
+const (
+	key_code_star  = 10
+	key_code_pound = 11
+)
+
+// key_rune turns a 4-bit key code to a key, or returns 0 if it is not
+// a valid key.
+func key_rune(code uint64) rune {
+	switch {
+	case code <= 9:
+		return rune('0' + code)
+	case code == key_code_star:
+		return KeyStar
+	case code == key_code_pound:
+		return KeyPound
+	}
+	return 0
+}
+
+// keypadFormat decodes a single key press, in either 4 or 8 bits.
+type keypadFormat struct {
+	name   string
+	length int
+}
+
+func (f keypadFormat) Name() string { return f.name }
+func (f keypadFormat) Length() int  { return f.length }
+
+func (f keypadFormat) Decode(bits []byte, br *BadgeRead) {
+	code := field(bits, bitRange{f.length - 4, 4})
+	br.Value = code
+	br.Key = key_rune(code)
+	br.ParityOK = br.Key != 0
+	if f.length == 8 {
+		// The upper 4 bits must be the complement of the lower 4:
+		check := field(bits, bitRange{0, 4})
+		br.ParityOK = br.ParityOK && (check^code) == 0xF
+	}
+}
+
+// Built-in keypad formats:
+var (
+	// Keypad4 is a key press sent as 4 bits.
+	Keypad4 Format = keypadFormat{name: "KEY4", length: 4}
+	// Keypad8 is a key press sent as 8 bits: the complement of the
+	// key, then the key.
+	Keypad8 Format = keypadFormat{name: "KEY8", length: 8}
+)
+
+func init() {
+	Register(Keypad4)
+	Register(Keypad8)
+}
+
+// Default for PinEntry.MaxLen:
+const DefaultPinMaxLen = 12
+
+// PinEntry assembles key presses into a PIN. Digits are collected, '*'
+// clears them, and '#' submits them.
+//
+// The zero value is ready to use.
+type PinEntry struct {
+	// Maximum number of digits to collect; any more are ignored. If
+	// zero, DefaultPinMaxLen is used.
+	MaxLen int
+
+	digits []rune
+}
+
+// Key handles one key press.  When the key is '#', this returns the
+// PIN that was entered and true (and then starts over).  Otherwise,
+// it returns "" and false.
+func (p *PinEntry) Key(k rune) (string, bool) {
+	max_len := p.MaxLen
+	if max_len <= 0 {
+		max_len = DefaultPinMaxLen
+	}
+
+	switch {
+	case k >= '0' && k <= '9':
+		if len(p.digits) < max_len {
+			p.digits = append(p.digits, k)
+		}
+	case k == KeyStar:
+		p.Clear()
+	case k == KeyPound:
+		pin := string(p.digits)
+		p.Clear()
+		return pin, true
+	}
+	return "", false
+}
+
+// Clear discards any digits entered so far.
+func (p *PinEntry) Clear() {
+	p.digits = p.digits[:0]
+}
+
+// Len returns the number of digits entered so far.
+func (p *PinEntry) Len() int {
+	return len(p.digits)
+}
@@ -0,0 +1,71 @@
+package wiegand
+
+import (
+	"testing"
+)
+
+func TestDecodeKeypad(t *testing.T) {
+	keys := []struct {
+		code uint64
+		key  rune
+	}{{0, '0'}, {9, '9'}, {key_code_star, KeyStar}, {key_code_pound, KeyPound}}
+	for _, k := range keys {
+		bits := make([]byte, 8)
+		put(bits, bitRange{0, 4}, k.code^0xF)
+		put(bits, bitRange{4, 4}, k.code)
+		br := Decode(bits, []Format{Keypad8})
+		if !br.ParityOK || br.Key != k.key {
+			t.Errorf("KEY8 %d: decoded as %q, parity OK %t", k.code, br.Key, br.ParityOK)
+		}
+		// The complement must match:
+		bits[0] ^= 1
+		if Decode(bits, []Format{Keypad8}).ParityOK {
+			t.Errorf("KEY8 %d: bad complement isn't caught", k.code)
+		}
+
+		br = Decode(bits[4:], []Format{Keypad4})
+		if !br.ParityOK || br.Key != k.key {
+			t.Errorf("KEY4 %d: decoded as %q, parity OK %t", k.code, br.Key, br.ParityOK)
+		}
+	}
+
+	// Codes 12 to 15 aren't keys:
+	bits := make([]byte, 4)
+	put(bits, bitRange{0, 4}, 12)
+	if br := Decode(bits, []Format{Keypad4}); br.ParityOK || br.Key != 0 {
+		t.Errorf("KEY4 12: decoded as %q, parity OK %t", br.Key, br.ParityOK)
+	}
+}
+
+func TestPinEntry(t *testing.T) {
+	var p PinEntry
+	for _, k := range "12" {
+		if _, done := p.Key(k); done {
+			t.Fatalf("Submitted after %q", k)
+		}
+	}
+	// '*' starts over:
+	p.Key(KeyStar)
+	if p.Len() != 0 {
+		t.Errorf("%d digits after *", p.Len())
+	}
+	for _, k := range "4321" {
+		p.Key(k)
+	}
+	pin, done := p.Key(KeyPound)
+	if !done || pin != "4321" {
+		t.Errorf("Submitted %q, %t", pin, done)
+	}
+	if p.Len() != 0 {
+		t.Errorf("%d digits left after submitting", p.Len())
+	}
+
+	// Digits past MaxLen are ignored:
+	p = PinEntry{MaxLen: 3}
+	for _, k := range "12345" {
+		p.Key(k)
+	}
+	if pin, _ := p.Key(KeyPound); pin != "123" {
+		t.Errorf("Submitted %q with MaxLen 3", pin)
+	}
+}
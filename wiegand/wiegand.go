@@ -8,167 +8,269 @@ package wiegand
 // to use gpiod.
 
 import (
+	"context"
+	"log"
+	"sync"
 	"time"
 
 	"github.com/warthog618/gpiod"
+
+	"hive13/rfid/gpio"
 )
 
-const data_len = 100
-const max_wiegand_bits = 32
-const reader_timeout = 3000000
+const max_wiegand_bits = 64
+
+// Number of complete frames that may wait for Listen's goroutine
+// before further frames are dropped:
+const frame_queue_len = 16
 
-var _isr_data [max_wiegand_bits]bool
-var _isr_bit_count uint64
-var _isr_bit_time time.Time
+const (
+	// Default for Config.BitGap:
+	DefaultBitGap = 10 * time.Millisecond
+	// Default for Config.FrameTimeout:
+	DefaultFrameTimeout = 25 * time.Millisecond
+)
 
 type BadgeRead struct {
 	RawBits []byte
+	// The data bits of the frame (i.e. without parity), as decoded by
+	// its Format.  For most formats, this is the facility code and
+	// card number packed together.
 	Value uint64
+	// The facility code (or company ID) and card number, as printed
+	// on the card:
+	FacilityCode uint64
+	CardNumber uint64
+	// True if the reader gives no facility code at all (e.g. a
+	// keyboard-wedge reader, which only types the card number), so
+	// FacilityCode is just 0:
+	NoFacilityCode bool
+	// Name of the Format that decoded this frame (empty if no Format
+	// matched its length):
+	Format string
+	// For a key press from a keypad (see keypad.go), the key: '0'
+	// through '9', KeyStar, or KeyPound.  For anything else, 0.
+	Key rune
 	LengthOK bool
 	ParityOK bool
 }
 
-func d0_fall_isr(evt gpiod.LineEvent) {
-	if evt.Type == gpiod.LineEventFallingEdge {
-		if _isr_bit_count < max_wiegand_bits {
-			_isr_bit_count += 1
-		}
-		_isr_bit_time = time.Now()
-	}
+// Config gives the pins and formats for one Wiegand badge reader.
+type Config struct {
+	// Pin numbers (as BCM/GPIO pin numbers) for Wiegand D0 and D1:
+	PinD0 int
+	PinD1 int
+	// Formats to decode frames with (see Decode); if empty,
+	// DefaultFormats() is used:
+	Formats []Format
+	// Longest gap between two bits of the same frame, as measured by
+	// the kernel's timestamps on each edge.  A longer gap starts a new
+	// frame.  If zero, DefaultBitGap is used.
+	BitGap time.Duration
+	// How long after the last bit to wait before delivering a frame.
+	// This is wall-clock time, so it only controls how soon a frame is
+	// delivered; where frames split is up to BitGap.  If zero,
+	// DefaultFrameTimeout is used.  It is never less than BitGap.
+	FrameTimeout time.Duration
 }
 
-func d1_fall_isr(evt gpiod.LineEvent) {
-	if evt.Type == gpiod.LineEventFallingEdge {
-		if _isr_bit_count < max_wiegand_bits {
-			_isr_data[_isr_bit_count] = true
-			_isr_bit_count += 1
-		}
-		_isr_bit_time = time.Now()
-	}
+// Reader reads frames from one Wiegand badge reader.  Each Reader
+// owns its own GPIO lines and state, so several may run at once
+// (e.g. an inside and an outside reader).
+type Reader struct {
+	cfg Config
+	d0 gpio.InputLine
+	d1 gpio.InputLine
+
+	// Complete frames, sent by flush and received in Listen:
+	frames chan []byte
+
+	// mu guards everything below, which is written by the gpiod event
+	// handlers and by frame_timer:
+	mu sync.Mutex
+	data [max_wiegand_bits]byte
+	bit_count int
+	// Kernel timestamp of the last edge:
+	bit_ts time.Duration
+	// Incremented on every bit, so that a stale frame_timer can tell
+	// that it is stale:
+	bit_gen uint64
+	frame_timer *time.Timer
+	// True once Close is called:
+	closed bool
 }
 
-func reset() {
-	for i,_ := range _isr_data {
-		_isr_data[i] = false
+// NewReader requests the D0 and D1 lines given in 'cfg' from 'chip',
+// and starts collecting bits from them.  Call Listen to receive
+// badges.  Close releases the lines (Listen also does this when its
+// context is cancelled).
+func NewReader(chip gpio.Chip, cfg Config) (*Reader, error) {
+	if len(cfg.Formats) == 0 {
+		cfg.Formats = DefaultFormats()
+	}
+	if cfg.BitGap <= 0 {
+		cfg.BitGap = DefaultBitGap
+	}
+	if cfg.FrameTimeout <= 0 {
+		cfg.FrameTimeout = DefaultFrameTimeout
+	}
+	if cfg.FrameTimeout < cfg.BitGap {
+		cfg.FrameTimeout = cfg.BitGap
+	}
+	r := &Reader{
+		cfg: cfg,
+		frames: make(chan []byte, frame_queue_len),
+	}
+
+	d0, err := chip.RequestInput(cfg.PinD0, gpiod.LineEdgeFalling, r.d0_fall_isr)
+	if err != nil {
+		return nil, err
 	}
-	_isr_bit_count = 0
+
+	d1, err := chip.RequestInput(cfg.PinD1, gpiod.LineEdgeFalling, r.d1_fall_isr)
+	if err != nil {
+		d0.Close()
+		return nil, err
+	}
+
+	r.d0 = d0
+	r.d1 = d1
+	return r, nil
 }
 
-func pending_bit_count() uint64 {
-	delta := time.Now().Sub(_isr_bit_time)
-	if delta.Nanoseconds() > reader_timeout {
-		return _isr_bit_count
+// Close releases the reader's GPIO lines.  Calling it more than once
+// has no further effect.
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	if r.frame_timer != nil {
+		r.frame_timer.Stop()
+	}
+	closed := r.closed
+	r.closed = true
+	r.mu.Unlock()
+
+	if closed {
+		return nil
 	}
-	return 0
+
+	err0 := r.d0.Close()
+	err1 := r.d1.Close()
+	if err0 != nil {
+		return err0
+	}
+	return err1
+}
+
+func (r *Reader) d0_fall_isr(evt gpiod.LineEvent) {
+	r.add_bit(evt, 0)
 }
 
-func badgeCheckRaw(data *[data_len]byte) (uint64, bool) {
-	if pending_bit_count() == 0 {
-		return 0, false
+func (r *Reader) d1_fall_isr(evt gpiod.LineEvent) {
+	r.add_bit(evt, 1)
+}
+
+// add_bit handles one edge on D0 or D1.  Frames are split purely on
+// the kernel timestamps of the edges, so a handler that runs late
+// (e.g. on a busy system) does not change where a frame ends.
+func (r *Reader) add_bit(evt gpiod.LineEvent, bit byte) {
+	if evt.Type != gpiod.LineEventFallingEdge {
+		return
 	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-	count := _isr_bit_count
-	if count > data_len {
-		count = data_len
+	if r.bit_count > 0 && evt.Timestamp-r.bit_ts > r.cfg.BitGap {
+		// This bit is too late to belong to the pending frame, so that
+		// frame is complete (even if frame_timer has not fired yet):
+		r.flush()
 	}
-	for i := uint64(0); i < count; i += 1 {
-		if _isr_data[i] {
-			data[i] = 1
-		} else {
-			data[i] = 0
-		}
+
+	if r.bit_count < max_wiegand_bits {
+		r.data[r.bit_count] = bit
+		r.bit_count += 1
 	}
-	reset()
-	return count, true
+	r.bit_ts = evt.Timestamp
+	r.bit_gen += 1
+
+	// Deliver this frame once FrameTimeout passes with no more bits:
+	if r.frame_timer != nil {
+		r.frame_timer.Stop()
+	}
+	gen := r.bit_gen
+	r.frame_timer = time.AfterFunc(r.cfg.FrameTimeout, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.bit_gen == gen {
+			r.flush()
+		}
+	})
 }
 
-// ListenBadges returns a channel that will send every badge scanned.
-//
-// Currently, this channel is never closed and its goroutine never
-// ends.
-//
-// The pins d0_pin and d1_pin should be given as BCM/GPIO pin numbers.
-//
-// As this relies on an initial C call, it may simply exit the program
-// if it fails to initialize - see wiegand_c.go and its initWiegand()
-// call.
-func ListenBadges(chip *gpiod.Chip, d0_pin int, d1_pin int) (<-chan BadgeRead, error) {
-
-	d0, err := chip.RequestLine(d0_pin,
-		gpiod.WithFallingEdge,
-		gpiod.WithEventHandler(d0_fall_isr))
-	if err != nil {
-		return nil, err
+// flush sends the pending frame (if any) to Listen's goroutine, and
+// resets it.  r.mu must be held.
+func (r *Reader) flush() {
+	if r.bit_count == 0 {
+		return
 	}
 
-	d1, err := chip.RequestLine(d1_pin,
-		gpiod.WithFallingEdge,
-		gpiod.WithEventHandler(d1_fall_isr))
-	if err != nil {
-		d0.Close()
-		return nil, err
+	frame := make([]byte, r.bit_count)
+	copy(frame, r.data[:r.bit_count])
+	r.bit_count = 0
+
+	select {
+	case r.frames <- frame:
+	default:
+		log.Printf("wiegand: Frame queue full, dropping %d-bit frame", len(frame))
 	}
-	
+}
+
+// Listen returns a channel that will send every badge scanned.
+//
+// When 'ctx' is cancelled, the reader is closed (see Close), and then
+// the channel is closed.
+//
+// Each frame is decoded with the first of the reader's formats that
+// has the same number of bits.  Frames that match no format are still
+// sent, but with LengthOK false.
+func (r *Reader) Listen(ctx context.Context) <-chan BadgeRead {
 	ch := make(chan BadgeRead)
 	go func(chan<- BadgeRead) {
-		defer d0.Close()
-		defer d1.Close()
-		var data [data_len]byte
-		var even_check byte = 0
-		var odd_check byte = 0
+		defer close(ch)
+		defer r.Close()
 		for {
-			// Is there data ready?
-			n, ok := badgeCheckRaw(&data)
-			if !ok {
-				// No data was ready. Wait and poll again.
-				<-time.After(time.Millisecond * 10)
-				continue
-			}
-
-			// Make a BadgeRead and copy the bits we need:
-			br := BadgeRead{
-				RawBits: make([]byte, n),
-				Value: 0,
-				LengthOK: false,
-				ParityOK: false,
-			}
-			for i,b := range data[:n] {
-				br.RawBits[i] = b
-			}
-
-			if n != 26 {
-				// If number of bits is wrong, not much else
-				// can/should be done. Send it and give up.
-				ch <- br
-				continue
-			}
-			br.LengthOK = true
-
-			// Check parity for a 26-bit value:
-			even_check = 0
-			odd_check = 0
-			for j := 0; j < 13; j++ {
-				even_check = even_check ^ data[j]
-				odd_check  = odd_check  ^ data[j + 13]
-			}
-			br.ParityOK = (even_check == 0) && (odd_check != 0)
-
-			// Whatever the case, try to read the value:
-			var val uint64 = 0
-			var mask uint64 = 1
-			for j := 24; j > 0; j-- {
-				if data[j] > 0 {
-					val |= mask
+			select {
+			case frame := <-r.frames:
+				// Decode it and send it over the channel, whether or
+				// not any format matched:
+				select {
+				case ch <- Decode(frame, r.cfg.Formats):
+				case <-ctx.Done():
+					return
 				}
-				mask <<= 1
+			case <-ctx.Done():
+				return
 			}
-			br.Value = val
-
-			// And finally, send it over the channel:
-			ch <- br
 		}
-		
 	}(ch)
 
-	return ch, nil
+	return ch
+}
+
+// ListenBadges is a shortcut for NewReader followed by Listen, for
+// when only one reader is needed.
+//
+// The pins d0_pin and d1_pin should be given as BCM/GPIO pin numbers.
+// If no formats are given, DefaultFormats() is used.
+func ListenBadges(ctx context.Context, chip gpio.Chip, d0_pin int,
+	d1_pin int, formats ...Format) (<-chan BadgeRead, error) {
+
+	r, err := NewReader(chip, Config{
+		PinD0: d0_pin,
+		PinD1: d1_pin,
+		Formats: formats,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r.Listen(ctx), nil
 }
@@ -0,0 +1,189 @@
+package wiegand_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"hive13/rfid/gpiofake"
+	"hive13/rfid/wiegand"
+)
+
+const (
+	pin_d0 = 17
+	pin_d1 = 18
+	// Otherwise unused pins, for pausing the fake chip's clock (see
+	// pause):
+	pin_idle0 = 40
+	pin_idle1 = 41
+)
+
+// h10301 returns an H10301 frame for the given facility code and card
+// number.
+func h10301(fc uint64, cn uint64) []byte {
+	bits := make([]byte, 26)
+	v := fc<<16 | cn
+	for i := 24; i >= 1; i-- {
+		bits[i] = byte(v & 1)
+		v >>= 1
+	}
+	var even, odd byte
+	for _, b := range bits[1:13] {
+		even ^= b
+	}
+	for _, b := range bits[13:25] {
+		odd ^= b
+	}
+	bits[0] = even
+	bits[25] = odd ^ 1
+	return bits
+}
+
+// pause moves the fake chip's clock ahead by 'd' without any edges on
+// the reader's lines.
+func pause(chip *gpiofake.Chip, d time.Duration) {
+	chip.SendWiegandTimed(pin_idle0, pin_idle1, []byte{0}, d, gpiofake.DefaultWiegandPulse)
+}
+
+// listen starts a reader with 'cfg' on 'chip', and returns its Listen
+// channel, and a function to stop it (which the test must call).
+func listen(t *testing.T, chip *gpiofake.Chip, cfg wiegand.Config) (<-chan wiegand.BadgeRead, func()) {
+	t.Helper()
+	r, err := wiegand.NewReader(chip, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := r.Listen(ctx)
+	return ch, func() {
+		cancel()
+		for range ch {
+		}
+	}
+}
+
+// start returns a reader on pin_d0 and pin_d1 of a new fake chip (see
+// listen).
+func start(t *testing.T, cfg wiegand.Config) (*gpiofake.Chip, <-chan wiegand.BadgeRead, func()) {
+	t.Helper()
+	chip := gpiofake.NewChip()
+	cfg.PinD0 = pin_d0
+	cfg.PinD1 = pin_d1
+	ch, stop := listen(t, chip, cfg)
+	return chip, ch, stop
+}
+
+// next returns the next badge from 'ch', failing the test if there is
+// none within a second.
+func next(t *testing.T, ch <-chan wiegand.BadgeRead) wiegand.BadgeRead {
+	t.Helper()
+	select {
+	case br := <-ch:
+		return br
+	case <-time.After(time.Second):
+		t.Fatal("No badge read")
+	}
+	return wiegand.BadgeRead{}
+}
+
+// none fails the test if 'ch' sends anything within 'd'.
+func none(t *testing.T, ch <-chan wiegand.BadgeRead, d time.Duration) {
+	t.Helper()
+	select {
+	case br := <-ch:
+		t.Fatalf("Unexpected %d-bit frame", len(br.RawBits))
+	case <-time.After(d):
+	}
+}
+
+func TestReaderFrame(t *testing.T) {
+	chip, ch, stop := start(t, wiegand.Config{})
+	defer stop()
+	chip.SendWiegand(pin_d0, pin_d1, h10301(18, 25000))
+	br := next(t, ch)
+	if !br.LengthOK || !br.ParityOK || br.Format != "H10301" {
+		t.Fatalf("Read as format %q, length OK %t, parity OK %t",
+			br.Format, br.LengthOK, br.ParityOK)
+	}
+	if br.FacilityCode != 18 || br.CardNumber != 25000 {
+		t.Errorf("Read as %d:%d, not 18:25000", br.FacilityCode, br.CardNumber)
+	}
+	none(t, ch, 100*time.Millisecond)
+}
+
+// Frames split where the edges' timestamps are more than BitGap apart,
+// even if they all arrive at once (e.g. if the handlers ran late).
+func TestReaderSplitsOnBitGap(t *testing.T) {
+	chip, ch, stop := start(t, wiegand.Config{
+		BitGap: 10 * time.Millisecond,
+		FrameTimeout: 200 * time.Millisecond,
+	})
+	defer stop()
+	chip.SendWiegand(pin_d0, pin_d1, h10301(1, 100))
+	pause(chip, 50*time.Millisecond)
+	chip.SendWiegand(pin_d0, pin_d1, h10301(2, 200))
+
+	for _, want := range []uint64{100, 200} {
+		br := next(t, ch)
+		if len(br.RawBits) != 26 || br.CardNumber != want {
+			t.Errorf("Read %d bits, card %d; expected 26 bits, card %d",
+				len(br.RawBits), br.CardNumber, want)
+		}
+	}
+	none(t, ch, 100*time.Millisecond)
+}
+
+// Bits closer together than BitGap are one frame, even if sent
+// separately.
+func TestReaderJoinsWithinBitGap(t *testing.T) {
+	chip, ch, stop := start(t, wiegand.Config{
+		BitGap: 10 * time.Millisecond,
+		FrameTimeout: 200 * time.Millisecond,
+	})
+	defer stop()
+	bits := h10301(3, 300)
+	chip.SendWiegand(pin_d0, pin_d1, bits[:13])
+	chip.SendWiegand(pin_d0, pin_d1, bits[13:])
+
+	br := next(t, ch)
+	if len(br.RawBits) != 26 || !br.ParityOK || br.CardNumber != 300 {
+		t.Errorf("Read %d bits, card %d, parity OK %t", len(br.RawBits),
+			br.CardNumber, br.ParityOK)
+	}
+	none(t, ch, 100*time.Millisecond)
+}
+
+func TestReaderUnknownLength(t *testing.T) {
+	chip, ch, stop := start(t, wiegand.Config{Formats: []wiegand.Format{wiegand.H10301}})
+	defer stop()
+	chip.SendWiegand(pin_d0, pin_d1, []byte{1, 0, 1, 1, 0})
+	br := next(t, ch)
+	if br.LengthOK || len(br.RawBits) != 5 {
+		t.Errorf("Read %d bits, length OK %t", len(br.RawBits), br.LengthOK)
+	}
+}
+
+// Two readers on one chip each see only their own lines.
+func TestTwoReaders(t *testing.T) {
+	chip := gpiofake.NewChip()
+	ch1, stop1 := listen(t, chip, wiegand.Config{PinD0: 5, PinD1: 6})
+	defer stop1()
+	ch2, stop2 := listen(t, chip, wiegand.Config{PinD0: 22, PinD1: 23})
+	defer stop2()
+
+	chip.SendWiegand(5, 6, h10301(1, 111))
+	chip.SendWiegand(22, 23, h10301(2, 222))
+	if br := next(t, ch1); br.CardNumber != 111 {
+		t.Errorf("Reader 1 read card %d", br.CardNumber)
+	}
+	if br := next(t, ch2); br.CardNumber != 222 {
+		t.Errorf("Reader 2 read card %d", br.CardNumber)
+	}
+	none(t, ch1, 50*time.Millisecond)
+	none(t, ch2, 50*time.Millisecond)
+
+	// The same lines can't be used twice:
+	if _, err := wiegand.NewReader(chip, wiegand.Config{PinD0: 5, PinD1: 6}); err == nil {
+		t.Error("Second reader on the same lines was allowed")
+	}
+}